@@ -0,0 +1,3 @@
+module github.com/clipperhouse/go-allocations-vsix/helper
+
+go 1.22
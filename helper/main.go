@@ -0,0 +1,533 @@
+// Command profilehelper reads a pprof profile, as go test -memprofile
+// writes it, and prints it as JSON for the extension: strings resolved,
+// samples with the same stack and labels summed, and only the locations
+// and functions the samples refer to. With them come the totals by line
+// and by function, which the extension would otherwise sum from the
+// samples for every run.
+//
+// Usage:
+//
+//	profilehelper file.pb.gz
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: profilehelper file.pb.gz")
+		os.Exit(2)
+	}
+	if err := run(os.Args[1], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "profilehelper:", err)
+		os.Exit(1)
+	}
+}
+
+func run(file string, w io.Writer) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return err
+		}
+	}
+	if bytes.HasPrefix(data, []byte("heap profile:")) {
+		return errors.New("legacy text heap profiles are not supported, write one with pprof.WriteHeapProfile or go test -memprofile")
+	}
+
+	p, err := parse(data)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	if err := json.NewEncoder(out).Encode(p.aggregate()); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// The JSON the extension reads, with the field names of its Profile type
+
+type valueType struct {
+	Type string `json:"type"`
+	Unit string `json:"unit"`
+}
+
+type label struct {
+	Key     string `json:"key"`
+	Str     string `json:"str,omitempty"`
+	Num     *int64 `json:"num,omitempty"`
+	NumUnit string `json:"numUnit,omitempty"`
+}
+
+type sample struct {
+	LocationIDs []uint64 `json:"locationIds"`
+	Values      []int64  `json:"values"`
+	Labels      []label  `json:"labels"`
+}
+
+type line struct {
+	FunctionID uint64 `json:"functionId"`
+	Line       int64  `json:"line"`
+	Column     int64  `json:"column"`
+}
+
+type location struct {
+	ID      uint64 `json:"id"`
+	Address uint64 `json:"address"`
+	Lines   []line `json:"lines"`
+}
+
+type function struct {
+	ID         uint64 `json:"id"`
+	Name       string `json:"name"`
+	SystemName string `json:"systemName"`
+	Filename   string `json:"filename"`
+	StartLine  int64  `json:"startLine"`
+}
+
+type profile struct {
+	SampleTypes       []valueType     `json:"sampleTypes"`
+	Samples           []sample        `json:"samples"`
+	Locations         []location      `json:"locations"`
+	Functions         []function      `json:"functions"`
+	DefaultSampleType string          `json:"defaultSampleType,omitempty"`
+	LineTotals        []lineTotal     `json:"lineTotals"`
+	FunctionTotals    []functionTotal `json:"functionTotals"`
+}
+
+// The values at a line, as the extension's lineTotals sums them
+type lineTotal struct {
+	FunctionID uint64  `json:"functionId"`
+	Line       int64   `json:"line"`
+	Column     int64   `json:"column"`
+	Flat       []int64 `json:"flat"`
+	Cum        []int64 `json:"cum"`
+}
+
+// The values in a function, as the extension's functionTotals sums them
+type functionTotal struct {
+	FunctionID uint64  `json:"functionId"`
+	Flat       []int64 `json:"flat"`
+	Cum        []int64 `json:"cum"`
+}
+
+// aggregate sums samples with the same stack and labels, and drops
+// locations and functions no sample refers to.
+func (p profile) aggregate() profile {
+	samples := []sample{}
+	index := map[string]int{}
+	usedLocations := map[uint64]bool{}
+	for _, s := range p.Samples {
+		key := sampleKey(s)
+		if i, ok := index[key]; ok {
+			for j, v := range s.Values {
+				samples[i].Values[j] += v
+			}
+			continue
+		}
+		index[key] = len(samples)
+		samples = append(samples, s)
+		for _, id := range s.LocationIDs {
+			usedLocations[id] = true
+		}
+	}
+
+	locations := []location{}
+	usedFunctions := map[uint64]bool{}
+	for _, l := range p.Locations {
+		if !usedLocations[l.ID] {
+			continue
+		}
+		locations = append(locations, l)
+		for _, ln := range l.Lines {
+			usedFunctions[ln.FunctionID] = true
+		}
+	}
+
+	functions := slices.DeleteFunc(p.Functions, func(f function) bool { return !usedFunctions[f.ID] })
+
+	p.Samples = samples
+	p.Locations = locations
+	p.Functions = functions
+	p.LineTotals, p.FunctionTotals = p.totals()
+	return p
+}
+
+// totals sums the values of each sample type by line and by function: flat
+// at the innermost line of the leaf, and cum once per sample at each line
+// or function in its stack, however often it appears, as with recursion.
+// Both are in the order the samples first reach them.
+func (p profile) totals() ([]lineTotal, []functionTotal) {
+	types := len(p.SampleTypes)
+	locations := make(map[uint64]location, len(p.Locations))
+	for _, l := range p.Locations {
+		locations[l.ID] = l
+	}
+	add := func(into, values []int64) {
+		for i := 0; i < types && i < len(values); i++ {
+			into[i] += values[i]
+		}
+	}
+
+	type lineKey struct {
+		function     uint64
+		line, column int64
+	}
+	lines := []lineTotal{}
+	lineIndex := map[lineKey]int{}
+	functions := []functionTotal{}
+	functionIndex := map[uint64]int{}
+	for _, s := range p.Samples {
+		if !slices.ContainsFunc(s.Values, func(v int64) bool { return v != 0 }) {
+			continue
+		}
+		seenLines := map[lineKey]bool{}
+		seenFunctions := map[uint64]bool{}
+		for depth, id := range s.LocationIDs {
+			for i, ln := range locations[id].Lines {
+				leaf := depth == 0 && i == 0
+
+				key := lineKey{ln.FunctionID, ln.Line, ln.Column}
+				li, ok := lineIndex[key]
+				if !ok {
+					li = len(lines)
+					lineIndex[key] = li
+					lines = append(lines, lineTotal{FunctionID: ln.FunctionID, Line: ln.Line, Column: ln.Column, Flat: make([]int64, types), Cum: make([]int64, types)})
+				}
+				if leaf {
+					add(lines[li].Flat, s.Values)
+				}
+				if !seenLines[key] {
+					seenLines[key] = true
+					add(lines[li].Cum, s.Values)
+				}
+
+				fi, ok := functionIndex[ln.FunctionID]
+				if !ok {
+					fi = len(functions)
+					functionIndex[ln.FunctionID] = fi
+					functions = append(functions, functionTotal{FunctionID: ln.FunctionID, Flat: make([]int64, types), Cum: make([]int64, types)})
+				}
+				if leaf {
+					add(functions[fi].Flat, s.Values)
+				}
+				if !seenFunctions[ln.FunctionID] {
+					seenFunctions[ln.FunctionID] = true
+					add(functions[fi].Cum, s.Values)
+				}
+			}
+		}
+	}
+	return lines, functions
+}
+
+func sampleKey(s sample) string {
+	var b strings.Builder
+	for _, id := range s.LocationIDs {
+		b.WriteString(strconv.FormatUint(id, 10))
+		b.WriteByte(',')
+	}
+	for _, l := range s.Labels {
+		b.WriteByte('|')
+		b.WriteString(l.Key)
+		b.WriteByte('=')
+		b.WriteString(l.Str)
+		if l.Num != nil {
+			b.WriteString(strconv.FormatInt(*l.Num, 10))
+		}
+		b.WriteString(l.NumUnit)
+	}
+	return b.String()
+}
+
+// Decoding of profile.proto, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type reader struct {
+	buf []byte
+	pos int
+}
+
+var errTruncated = errors.New("truncated profile")
+
+func (r *reader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if r.pos >= len(r.buf) {
+			return 0, errTruncated
+		}
+		b := r.buf[r.pos]
+		r.pos++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("varint too long in profile")
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)-r.pos) < n {
+		return nil, errTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// fields calls f with each field's number, wire type and value: the
+// varint, or the bytes of a length-delimited field. Fixed-size fields,
+// which profile.proto doesn't use, are skipped.
+func fields(buf []byte, f func(field int, wire int, v uint64, b []byte) error) error {
+	r := &reader{buf: buf}
+	for r.pos < len(r.buf) {
+		tag, err := r.varint()
+		if err != nil {
+			return err
+		}
+		field, wire := int(tag>>3), int(tag&7)
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			v, err = r.varint()
+		case wireBytes:
+			b, err = r.bytes()
+		case wireFixed64:
+			r.pos += 8
+			continue
+		case wireFixed32:
+			r.pos += 4
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d in profile", wire)
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(field, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repeated appends a repeated integer field, packed or not
+func repeated[T int64 | uint64](dst []T, wire int, v uint64, b []byte) ([]T, error) {
+	if wire != wireBytes {
+		return append(dst, T(v)), nil
+	}
+	r := &reader{buf: b}
+	for r.pos < len(r.buf) {
+		v, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, T(v))
+	}
+	return dst, nil
+}
+
+// Messages as decoded, with string table indexes for strings
+
+type rawLabel struct {
+	key, str, numUnit uint64
+	num               *int64
+}
+
+type rawSample struct {
+	locationIDs []uint64
+	values      []int64
+	labels      []rawLabel
+}
+
+func parse(data []byte) (profile, error) {
+	var strs []string
+	var sampleTypes [][2]uint64
+	var samples []rawSample
+	var locations []location
+	var functions []function
+	var functionStrings [][3]uint64
+	var defaultSampleType uint64
+
+	err := fields(data, func(field, wire int, v uint64, b []byte) error {
+		var err error
+		switch field {
+		case 1:
+			var vt [2]uint64
+			err = fields(b, func(field, _ int, v uint64, _ []byte) error {
+				if field == 1 || field == 2 {
+					vt[field-1] = v
+				}
+				return nil
+			})
+			sampleTypes = append(sampleTypes, vt)
+		case 2:
+			var s rawSample
+			s, err = parseSample(b)
+			samples = append(samples, s)
+		case 4:
+			var l location
+			l, err = parseLocation(b)
+			locations = append(locations, l)
+		case 5:
+			var f function
+			var names [3]uint64
+			err = fields(b, func(field, _ int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					f.ID = v
+				case 2, 3, 4:
+					names[field-2] = v
+				case 5:
+					f.StartLine = int64(v)
+				}
+				return nil
+			})
+			functions = append(functions, f)
+			functionStrings = append(functionStrings, names)
+		case 6:
+			strs = append(strs, string(b))
+		case 14:
+			defaultSampleType = v
+		}
+		return err
+	})
+	if err != nil {
+		return profile{}, err
+	}
+
+	// The first index out of range, if any, fails the whole profile
+	var strErr error
+	s := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			if strErr == nil {
+				strErr = fmt.Errorf("string index %d out of range in profile", i)
+			}
+			return ""
+		}
+		return strs[i]
+	}
+
+	p := profile{Locations: locations}
+	for _, vt := range sampleTypes {
+		p.SampleTypes = append(p.SampleTypes, valueType{Type: s(vt[0]), Unit: s(vt[1])})
+	}
+	for _, raw := range samples {
+		sm := sample{LocationIDs: raw.locationIDs, Values: raw.values, Labels: []label{}}
+		for _, l := range raw.labels {
+			lb := label{Key: s(l.key), Num: l.num}
+			if l.str != 0 {
+				lb.Str = s(l.str)
+			}
+			if l.numUnit != 0 {
+				lb.NumUnit = s(l.numUnit)
+			}
+			sm.Labels = append(sm.Labels, lb)
+		}
+		p.Samples = append(p.Samples, sm)
+	}
+	for i, f := range functions {
+		names := functionStrings[i]
+		f.Name, f.SystemName, f.Filename = s(names[0]), s(names[1]), s(names[2])
+		p.Functions = append(p.Functions, f)
+	}
+	if defaultSampleType != 0 {
+		p.DefaultSampleType = s(defaultSampleType)
+	}
+	return p, strErr
+}
+
+func parseSample(b []byte) (rawSample, error) {
+	var s rawSample
+	err := fields(b, func(field, wire int, v uint64, b []byte) error {
+		var err error
+		switch field {
+		case 1:
+			s.locationIDs, err = repeated(s.locationIDs, wire, v, b)
+		case 2:
+			s.values, err = repeated(s.values, wire, v, b)
+		case 3:
+			var l rawLabel
+			err = fields(b, func(field, _ int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					l.key = v
+				case 2:
+					l.str = v
+				case 3:
+					num := int64(v)
+					l.num = &num
+				case 4:
+					l.numUnit = v
+				}
+				return nil
+			})
+			s.labels = append(s.labels, l)
+		}
+		return err
+	})
+	return s, err
+}
+
+func parseLocation(b []byte) (location, error) {
+	l := location{Lines: []line{}}
+	err := fields(b, func(field, _ int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			l.ID = v
+		case 3:
+			l.Address = v
+		case 4:
+			var ln line
+			err := fields(b, func(field, _ int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					ln.FunctionID = v
+				case 2:
+					ln.Line = int64(v)
+				case 3:
+					ln.Column = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			l.Lines = append(l.Lines, ln)
+		}
+		return nil
+	})
+	return l, err
+}
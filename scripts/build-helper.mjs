@@ -0,0 +1,24 @@
+// Builds the profile helper in helper for each platform the extension
+// supports, into bin, named by Node's platform and arch as src/helper.ts
+// looks for it. Run by vscode:prepublish; needs go on the PATH.
+import { execFileSync } from 'child_process';
+import * as path from 'path';
+
+const targets = [
+    ['darwin', 'arm64'], ['darwin', 'x64'],
+    ['linux', 'x64'], ['linux', 'arm64'],
+    ['win32', 'x64'], ['win32', 'arm64']
+];
+const goos = { darwin: 'darwin', linux: 'linux', win32: 'windows' };
+const goarch = { x64: 'amd64', arm64: 'arm64' };
+
+const root = path.join(import.meta.dirname, '..');
+for (const [platform, arch] of targets) {
+    const ext = platform === 'win32' ? '.exe' : '';
+    const out = path.join(root, 'bin', `profilehelper-${platform}-${arch}${ext}`);
+    execFileSync('go', ['build', '-trimpath', '-ldflags=-s -w', '-o', out, '.'], {
+        cwd: path.join(root, 'helper'),
+        env: { ...process.env, GOOS: goos[platform], GOARCH: goarch[arch], CGO_ENABLED: '0' },
+        stdio: 'inherit'
+    });
+}
@@ -0,0 +1,25 @@
+/**
+ * A test that fails when the benchmark allocates more per op than it does
+ * now. It runs the benchmark with testing.Benchmark, which counts
+ * allocations whether or not -benchmem is set.
+ */
+export const allocationTest = (benchmarkName: string, allocsPerOp: number): { name: string; source: string } => {
+    // BenchmarkFoo is tested by TestFooAllocs
+    const name = `Test${benchmarkName.slice('Benchmark'.length)}Allocs`;
+    const source = [
+        '',
+        `// ${name} fails if ${benchmarkName} allocates more than the`,
+        `// ${allocsPerOp} allocs/op it did when this test was written.`,
+        `func ${name}(t *testing.T) {`,
+        '\tif testing.Short() {',
+        `\t\tt.Skip("runs ${benchmarkName}")`,
+        '\t}',
+        `\tresult := testing.Benchmark(${benchmarkName})`,
+        `\tif got, want := result.AllocsPerOp(), int64(${allocsPerOp}); got > want {`,
+        `\t\tt.Errorf("${benchmarkName}: %d allocs/op, want at most %d", got, want)`,
+        '\t}',
+        '}',
+        ''
+    ].join('\n');
+    return { name, source };
+}
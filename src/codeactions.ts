@@ -0,0 +1,310 @@
+import * as vscode from 'vscode';
+import * as path from 'path';
+import { SiteAllocation } from './treedata';
+import { enclosingBenchmark } from './discovery';
+import { EscapeFinding } from './escape';
+
+// Bytes per object from which a temporary is worth pooling
+const poolableBytes = 1024;
+
+// e.g. for _, v := range items {, or for i := 0; i < n; i++ {
+const rangeRegex = /^\s*for\s+.*:=\s*range\s+(.+?)\s*\{\s*$/;
+const countRegex = /^\s*for\s+(\w+)\s*:=\s*0;\s*\1\s*<\s*(.+?);\s*\1\+\+\s*\{\s*$/;
+
+const indentOf = (text: string): string => text.slice(0, text.length - text.trimStart().length);
+
+const escapeRegex = (s: string): string => s.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+
+/**
+ * The for loop around a line: the nearest line above, indented less,
+ * that starts one, and the line of its closing brace.
+ */
+const enclosingLoop = (document: vscode.TextDocument, lineNumber: number): { start: number; end: number } | undefined => {
+    const indent = indentOf(document.lineAt(lineNumber).text).length;
+    for (let i = lineNumber - 1; i >= 0; i--) {
+        const text = document.lineAt(i).text;
+        if (!text.trim() || indentOf(text).length >= indent) {
+            continue;
+        }
+        if (!/^\s*for\b/.test(text)) {
+            return undefined;
+        }
+        const closing = `${indentOf(text)}}`;
+        for (let j = lineNumber + 1; j < document.lineCount; j++) {
+            if (document.lineAt(j).text.trimEnd() === closing) {
+                return { start: i, end: j };
+            }
+        }
+        return undefined;
+    }
+    return undefined;
+}
+
+// How many times the loop runs, when its header says: len(items), or n
+const loopCount = (header: string): string | undefined => {
+    const ranged = header.match(rangeRegex);
+    if (ranged) {
+        // TODO: ranging over an int or a channel, which len doesn't count
+        return `len(${ranged[1]})`;
+    }
+    return header.match(countRegex)?.[2];
+}
+
+// The line above that declares the variable, nearest first
+const declarationOf = (document: vscode.TextDocument, name: string, before: number, regex: (name: string) => RegExp): { line: number; match: RegExpMatchArray } | undefined => {
+    for (let i = before - 1; i >= 0; i--) {
+        const match = document.lineAt(i).text.match(regex(escapeRegex(name)));
+        if (match) {
+            return { line: i, match };
+        }
+        if (/^func\b/.test(document.lineAt(i).text)) {
+            return undefined;
+        }
+    }
+    return undefined;
+}
+
+// Where a package-level declaration goes: after the imports, or the package clause
+const afterImports = (document: vscode.TextDocument): number => {
+    let after = 0;
+    for (let i = 0; i < document.lineCount; i++) {
+        const text = document.lineAt(i).text;
+        if (/^package\s/.test(text) || /^import\s+"/.test(text)) {
+            after = i;
+        } else if (/^import\s*\($/.test(text)) {
+            while (i < document.lineCount - 1 && document.lineAt(i).text.trim() !== ')') {
+                i++;
+            }
+            after = i;
+        } else if (/^(func|type|var|const)\b/.test(text)) {
+            break;
+        }
+    }
+    return after;
+}
+
+// Imports the package, unless the file does already
+// TODO: sort it among the others, as goimports would
+const addImport = (edit: vscode.WorkspaceEdit, document: vscode.TextDocument, pkg: string, metadata: vscode.WorkspaceEditEntryMetadata): void => {
+    const text = document.getText();
+    if (new RegExp(`^\\s*(import\\s+)?"${escapeRegex(pkg)}"`, 'm').test(text)) {
+        return;
+    }
+    for (let i = 0; i < document.lineCount; i++) {
+        if (/^import\s*\($/.test(document.lineAt(i).text)) {
+            edit.insert(document.uri, new vscode.Position(i + 1, 0), `\t"${pkg}"\n`, metadata);
+            return;
+        }
+    }
+    const line = afterImports(document);
+    edit.insert(document.uri, document.lineAt(line).range.end, `\n\nimport "${pkg}"`, metadata);
+}
+
+const action = (title: string, edit: vscode.WorkspaceEdit): vscode.CodeAction => {
+    const fix = new vscode.CodeAction(title, vscode.CodeActionKind.QuickFix);
+    fix.edit = edit;
+    return fix;
+}
+
+/**
+ * Pre-sizes a slice appended to, or a map assigned to, in a loop whose
+ * count is known: x := []T{} becomes x := make([]T, 0, len(items)).
+ */
+const presize = (document: vscode.TextDocument, lineNumber: number): vscode.CodeAction | undefined => {
+    const text = document.lineAt(lineNumber).text;
+    const appended = text.match(/^\s*(\w+)\s*=\s*append\(\s*(\w+)\s*,/);
+    const assigned = text.match(/^\s*(\w+)\[.+\]\s*=[^=]/);
+    const name = appended && appended[1] === appended[2] ? appended[1] : assigned?.[1];
+    if (!name) {
+        return undefined;
+    }
+    const loop = enclosingLoop(document, lineNumber);
+    const count = loop && loopCount(document.lineAt(loop.start).text);
+    if (!loop || !count) {
+        return undefined;
+    }
+
+    // e.g. x := []T{}, var x []T, x := make([]T, 0); m := map[K]V{}, m := make(map[K]V)
+    const declaration = appended
+        ? declarationOf(document, name, loop.start, n => new RegExp(`^(\\s*)(?:${n}\\s*:=\\s*(\\[\\][^{]+)\\{\\}|var\\s+${n}\\s+(\\[\\].+?)|${n}\\s*:=\\s*make\\((\\[\\].+?),\\s*0\\))\\s*$`))
+        : declarationOf(document, name, loop.start, n => new RegExp(`^(\\s*)${n}\\s*:=\\s*(?:(map\\[.+\\][^{]+)\\{\\}|make\\((map\\[.+\\].+?)\\))\\s*$`));
+    if (!declaration) {
+        return undefined;
+    }
+    const [, indent, ...types] = declaration.match;
+    const type = types.find(Boolean);
+    const made = appended ? `make(${type}, 0, ${count})` : `make(${type}, ${count})`;
+
+    const title = `Pre-size ${name} with ${made}`;
+    const edit = new vscode.WorkspaceEdit();
+    edit.replace(document.uri, document.lineAt(declaration.line).range, `${indent}${name} := ${made}`, { needsConfirmation: true, label: title });
+    return action(title, edit);
+}
+
+/**
+ * Replaces string concatenation in a loop with a strings.Builder: s := ""
+ * and s += x become a builder written to, and s is its String() after.
+ */
+const builder = (document: vscode.TextDocument, lineNumber: number): vscode.CodeAction | undefined => {
+    const name = document.lineAt(lineNumber).text.match(/^\s*(\w+)\s*\+=/)?.[1];
+    const loop = name ? enclosingLoop(document, lineNumber) : undefined;
+    if (!name || !loop) {
+        return undefined;
+    }
+    const declaration = declarationOf(document, name, loop.start, n => new RegExp(`^(\\s*)(?:${n}\\s*:=\\s*""|var\\s+${n}\\s+string)\\s*$`));
+    // The String() after the loop declares the string again, in the same block
+    if (!declaration || declaration.match[1] !== indentOf(document.lineAt(loop.start).text)) {
+        return undefined;
+    }
+
+    // Only when the loop does nothing else with the string, which would need it built
+    const appendRegex = new RegExp(`^(\\s*)${escapeRegex(name)}\\s*\\+=\\s*(.+?)\\s*$`);
+    const usedRegex = new RegExp(`\\b${escapeRegex(name)}\\b`);
+    // Nor between the declaration and the loop, where it would be undefined once it's a builder
+    for (let i = declaration.line + 1; i < loop.start; i++) {
+        if (usedRegex.test(document.lineAt(i).text)) {
+            return undefined;
+        }
+    }
+    const appends: { line: number; indent: string; value: string }[] = [];
+    for (let i = loop.start + 1; i < loop.end; i++) {
+        const text = document.lineAt(i).text;
+        const match = text.match(appendRegex);
+        if (match) {
+            appends.push({ line: i, indent: match[1], value: match[2] });
+        } else if (usedRegex.test(text)) {
+            return undefined;
+        }
+    }
+
+    const builderName = `${name}Builder`;
+    const title = `Build ${name} with a strings.Builder`;
+    const metadata = { needsConfirmation: true, label: title };
+    const edit = new vscode.WorkspaceEdit();
+    addImport(edit, document, 'strings', metadata);
+    edit.replace(document.uri, document.lineAt(declaration.line).range, `${declaration.match[1]}var ${builderName} strings.Builder`, metadata);
+    for (const { line, indent, value } of appends) {
+        edit.replace(document.uri, document.lineAt(line).range, `${indent}${builderName}.WriteString(${value})`, metadata);
+    }
+    const end = document.lineAt(loop.end).range.end;
+    edit.insert(document.uri, end, `\n${indentOf(document.lineAt(loop.start).text)}${name} := ${builderName}.String()`, metadata);
+    return action(title, edit);
+}
+
+/**
+ * Whether escape analysis says the value made at a line is on the heap only
+ * for its size: it flows nowhere but the heap it's allocated on, so it's
+ * neither returned nor stored. Without escape analysis, it can't say.
+ */
+const heapOnlyForSize = (findings: EscapeFinding[]): boolean =>
+    findings.length > 0 && findings.every(finding =>
+        finding.explanation.some(line => line.includes('(too large for stack)')) &&
+        finding.explanation.filter(line => line.trim().startsWith('flow:')).length === 1);
+
+// Whether the rest of the function returns or reassigns the variable, such as with append, which would Put the wrong array
+const reassignedOrReturned = (document: vscode.TextDocument, name: string, lineNumber: number): boolean => {
+    const n = escapeRegex(name);
+    const regex = new RegExp(`(^|[^\\w.])${n}\\s*(,[\\w\\s,]*)?(=[^=]|:=)|\\breturn\\b.*\\b${n}\\b|\\bgo\\b.*\\b${n}\\b`);
+    for (let i = lineNumber + 1; i < document.lineCount; i++) {
+        const text = document.lineAt(i).text;
+        if (text.trimEnd() === '}') {
+            return false;
+        }
+        if (regex.test(text)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+/**
+ * Takes a large temporary of constant size from a sync.Pool, and puts it
+ * back when the function returns: buf := make([]byte, 4096) becomes a
+ * package-level pool, and a Get, cleared, with a deferred Put. Only for a
+ * temporary that stays in the function, or the Put would hand out memory
+ * still in use.
+ */
+const pool = (document: vscode.TextDocument, lineNumber: number, site: SiteAllocation, escapes: EscapeFinding[]): vscode.CodeAction | undefined => {
+    const match = document.lineAt(lineNumber).text.match(/^(\s*)(\w+)\s*:=\s*make\((\[\][\w.*]+),\s*(\d+)\)\s*$/);
+    const { sampleTypes, flat } = site.allocation.allocationData;
+    const bytes = flat[sampleTypes.findIndex(st => st.type === 'alloc_space')] ?? 0;
+    const objects = flat[sampleTypes.findIndex(st => st.type === 'alloc_objects')] ?? 0;
+    if (!match || objects <= 0 || bytes / objects < poolableBytes) {
+        return undefined;
+    }
+    const [, indent, name, type, size] = match;
+    if (!heapOnlyForSize(escapes) || reassignedOrReturned(document, name, lineNumber)) {
+        return undefined;
+    }
+    const poolName = `${name}Pool`;
+
+    const title = `Reuse ${name} from a sync.Pool`;
+    const metadata = { needsConfirmation: true, label: title };
+    const edit = new vscode.WorkspaceEdit();
+    addImport(edit, document, 'sync', metadata);
+    const declared = document.lineAt(afterImports(document)).range.end;
+    edit.insert(document.uri, declared, `\n\nvar ${poolName} = sync.Pool{New: func() any { b := make(${type}, ${size}); return &b }}`, metadata);
+    edit.replace(document.uri, document.lineAt(lineNumber).range, [
+        `${indent}${name}p := ${poolName}.Get().(*${type})`,
+        `${indent}defer ${poolName}.Put(${name}p)`,
+        `${indent}${name} := *${name}p`,
+        // A pooled buffer has what the last user wrote, where make would have zeros
+        `${indent}clear(${name})`
+    ].join('\n'), metadata);
+    return action(title, edit);
+}
+
+// At a benchmark's declaration, a test that keeps its allocs/op from growing
+const regressionTest = (document: vscode.TextDocument, lineNumber: number): vscode.CodeAction | undefined => {
+    const benchmarkName = /^func\s/.test(document.lineAt(lineNumber).text) ? enclosingBenchmark(document, lineNumber) : undefined;
+    if (!benchmarkName) {
+        return undefined;
+    }
+    const generate = new vscode.CodeAction(`Generate a test that ${benchmarkName} doesn't allocate more`, vscode.CodeActionKind.Refactor);
+    generate.command = {
+        title: generate.title,
+        command: 'goAllocations.generateAllocationTest',
+        arguments: [{ packageDir: path.dirname(document.uri.fsPath), benchmarkName }]
+    };
+    return generate;
+}
+
+/**
+ * Offers quick fixes for common allocation patterns at lines that
+ * allocated in the latest results, and a regression test at benchmarks.
+ * Each edit asks for confirmation, so it opens in the refactor preview
+ * before it's applied.
+ */
+export class AllocationCodeActions implements vscode.CodeActionProvider {
+    static readonly providedCodeActionKinds = [vscode.CodeActionKind.QuickFix, vscode.CodeActionKind.Refactor];
+
+    // The benchmarks' allocations at a line, most first, as the tree has them
+    private readonly allocationsAt: (filePath: string, lineNumber: number) => SiteAllocation[];
+    // What escape analysis says escapes at a line, once it has run
+    private readonly escapesAt: (filePath: string, lineNumber: number) => EscapeFinding[];
+
+    constructor(
+        allocationsAt: (filePath: string, lineNumber: number) => SiteAllocation[],
+        escapesAt: (filePath: string, lineNumber: number) => EscapeFinding[]
+    ) {
+        this.allocationsAt = allocationsAt;
+        this.escapesAt = escapesAt;
+    }
+
+    provideCodeActions(document: vscode.TextDocument, range: vscode.Range | vscode.Selection): vscode.CodeAction[] {
+        const lineNumber = range.start.line;
+        const test = regressionTest(document, lineNumber);
+        if (test) {
+            return [test];
+        }
+        const [top] = this.allocationsAt(document.uri.fsPath, lineNumber + 1);
+        if (!top) {
+            return [];
+        }
+        return [
+            presize(document, lineNumber),
+            builder(document, lineNumber),
+            pool(document, lineNumber, top, this.escapesAt(document.uri.fsPath, lineNumber + 1))
+        ].filter((fix): fix is vscode.CodeAction => fix !== undefined);
+    }
+}
@@ -1,12 +1,20 @@
 import * as vscode from 'vscode';
 import * as path from 'path';
+import { FunctionAllocations } from './treedata';
+import { formatBytes } from './profile';
 
 export class CodeLensProvider implements vscode.CodeLensProvider {
-    private readonly benchRegex = /^\s*func\s+(Benchmark[A-Za-z0-9_]+)\s*\(b\s*\*testing\.B\)/;
+    // As go test finds them: Benchmark, then nothing or anything but a lower case letter, whatever the parameter's name
+    private readonly benchRegex = /^\s*func\s+(Benchmark(?:[^a-z\s(]\w*)?)\s*\(\s*\w+\s+\*testing\.B\s*\)/;
     private onDidChangeCodeLensesEmitter = new vscode.EventEmitter<void>();
     public readonly onDidChangeCodeLenses: vscode.Event<void> = this.onDidChangeCodeLensesEmitter.event;
 
-    constructor() { }
+    // The benchmark's latest results, to show next to the run action
+    private readonly lastResult: (packageDir: string, benchmarkName: string) => string | undefined;
+
+    constructor(lastResult: (packageDir: string, benchmarkName: string) => string | undefined) {
+        this.lastResult = lastResult;
+    }
 
     refresh(): void {
         this.onDidChangeCodeLensesEmitter.fire();
@@ -37,12 +45,68 @@ export class CodeLensProvider implements vscode.CodeLensProvider {
                 const packageDir = path.dirname(document.uri.fsPath);
                 const cmd: vscode.Command = {
                     command: 'goAllocations.runBenchmarkFromEditor',
-                    title: 'find allocations',
-                    tooltip: 'Run this benchmark in Go Allocations Explorer',
+                    title: '$(play) Profile allocations',
+                    tooltip: 'Run this benchmark in Go Allocations Explorer, as the tree does',
                     arguments: [{ packageDir, benchmarkName }]
                 };
                 lenses.push(new vscode.CodeLens(range, cmd));
+
+                // TODO: refresh as the time since the run grows, not only when a run finishes
+                const result = this.lastResult(packageDir, benchmarkName);
+                if (result) {
+                    // Without a command, the lens is text only
+                    lenses.push(new vscode.CodeLens(range, { command: '', title: result, tooltip: 'The latest results in Go Allocations Explorer' }));
+                }
+            }
+        }
+        return lenses;
+    }
+}
+
+/**
+ * Shows how much the functions of a file allocate in the benchmarks run so
+ * far, e.g. "allocates in 3 benchmarks · 2.1MB cumulative", above their
+ * declarations, linking to those benchmarks.
+ */
+export class FunctionCodeLensProvider implements vscode.CodeLensProvider {
+    private onDidChangeCodeLensesEmitter = new vscode.EventEmitter<void>();
+    public readonly onDidChangeCodeLenses: vscode.Event<void> = this.onDidChangeCodeLensesEmitter.event;
+
+    private readonly functionsIn: (filePath: string) => FunctionAllocations[];
+
+    constructor(functionsIn: (filePath: string) => FunctionAllocations[]) {
+        this.functionsIn = functionsIn;
+    }
+
+    refresh(): void {
+        this.onDidChangeCodeLensesEmitter.fire();
+    }
+
+    provideCodeLenses(document: vscode.TextDocument, _token: vscode.CancellationToken): vscode.ProviderResult<vscode.CodeLens[]> {
+        if (!vscode.workspace.getConfiguration('goAllocations').get<boolean>('showCodeLens', true)) {
+            return [];
+        }
+
+        const lenses: vscode.CodeLens[] = [];
+        for (const { name, startLine, sites } of this.functionsIn(document.uri.fsPath)) {
+            // Benchmarks have lenses of their own
+            // TODO: the declaration may have moved since the run
+            const line = startLine - 1;
+            if (line < 0 || line >= document.lineCount || /^func\s+Benchmark/.test(document.lineAt(line).text)) {
+                continue;
             }
+            const bytes = sites.reduce((sum, { allocation }) => {
+                const { sampleTypes, function: fn } = allocation.allocationData;
+                const index = sampleTypes.findIndex(st => st.type === 'alloc_space');
+                return sum + (index < 0 ? 0 : fn.cum[index]);
+            }, 0);
+            const benchmarks = `${sites.length} ${sites.length === 1 ? 'benchmark' : 'benchmarks'}`;
+            lenses.push(new vscode.CodeLens(document.lineAt(line).range, {
+                command: 'goAllocations.showBenchmarksAtLine',
+                title: `allocates in ${benchmarks} · ${formatBytes(bytes)} cumulative`,
+                tooltip: 'The benchmarks run so far that allocate in this function, or in what it calls',
+                arguments: [{ filePath: document.uri.fsPath, functionName: name }]
+            }));
         }
         return lenses;
     }
@@ -0,0 +1,337 @@
+import * as vscode from 'vscode';
+import * as path from 'path';
+import { SiteAllocation, AllocationItem } from './treedata';
+import { formatBytes } from './profile';
+import { InliningNote } from './escape';
+import { HeatLevel, heatLevels, heatLevel, heatColor } from './heat';
+
+// A bar at the start of the line, in a theme color; a gutter icon can't be themed
+const barType = (color: vscode.ThemeColor): vscode.TextEditorDecorationType =>
+    vscode.window.createTextEditorDecorationType({
+        isWholeLine: true,
+        borderStyle: 'solid',
+        borderWidth: '0 0 0 3px',
+        borderColor: color,
+        // The same color in the overview ruler, so hot lines show in a long file without scrolling
+        overviewRulerColor: color,
+        overviewRulerLane: vscode.OverviewRulerLane.Left
+    });
+
+// How hot the line is itself, by its bytes' share of its benchmark's, whatever the view shows
+const heatAt = (allocation: AllocationItem): HeatLevel | undefined => {
+    const { sampleTypes, flat, source } = allocation.allocationData;
+    const index = sampleTypes.findIndex(st => st.type === 'alloc_space');
+    return index < 0 || flat[index] <= 0 ? undefined : heatLevel(flat[index], source.total[index]);
+}
+
+// An allocation site in the results, with whether its file changed since the run
+export type DecoratedAllocation = SiteAllocation & { stale: boolean };
+
+// A decorated site where it is now: its line after edits, and whether it was edited itself
+interface AnchoredAllocation {
+    site: SiteAllocation;
+    line: number;
+    edited: boolean;
+}
+
+// An edit to a file: lines start to end, 0-based, replaced by some number of lines
+interface LineEdit {
+    time: number;
+    start: number;
+    end: number;
+    lines: number;
+    // Whether the end line is only moved, as by a new line typed above it
+    movesEnd: boolean;
+}
+
+/**
+ * Follows the edits to files since each run, so decorations stay on their
+ * lines when lines are inserted or removed above, and know when their own
+ * line was edited.
+ */
+export class LineAnchors {
+    private readonly edits = new Map<string, LineEdit[]>();
+
+    record(event: vscode.TextDocumentChangeEvent): void {
+        const file = path.resolve(event.document.uri.fsPath);
+        const edits = this.edits.get(file) ?? [];
+        const time = Date.now();
+        // The changes of one event are against the document before it; the last first keeps them so
+        const changes = [...event.contentChanges].sort((a, b) => b.range.start.line - a.range.start.line);
+        for (const { range, text } of changes) {
+            const movesEnd = range.end.character === 0 && (text === '' ? range.end.line > range.start.line : text.endsWith('\n'));
+            edits.push({ time, start: range.start.line, end: range.end.line, lines: text.split('\n').length - 1, movesEnd });
+        }
+        this.edits.set(file, edits);
+    }
+
+    // Forgets the edits made before the time, that of the oldest results
+    forgetBefore(time: number): void {
+        for (const [file, edits] of this.edits) {
+            const kept = edits.filter(edit => edit.time > time);
+            if (kept.length > 0) {
+                this.edits.set(file, kept);
+            } else {
+                this.edits.delete(file);
+            }
+        }
+    }
+
+    // Whether the file was edited here since the time
+    editedSince(file: string, since: number): boolean {
+        return (this.edits.get(path.resolve(file)) ?? []).some(edit => edit.time > since);
+    }
+
+    // The line, 1-based as in the profile, after the file's edits since the time
+    locate(file: string, lineNumber: number, since: number): { line: number; edited: boolean } {
+        let line = lineNumber - 1;
+        let edited = false;
+        for (const edit of this.edits.get(path.resolve(file)) ?? []) {
+            if (edit.time <= since) {
+                continue;
+            }
+            if (line > edit.end || (line === edit.end && edit.movesEnd)) {
+                line += edit.lines - (edit.end - edit.start);
+            } else if (line >= edit.start) {
+                edited = true;
+                line = Math.min(line, edit.start + edit.lines);
+            }
+        }
+        return { line: line + 1, edited };
+    }
+}
+
+/**
+ * Decorations of the results' allocation sites in the visible editors. They
+ * follow the sites through edits, and can be cleared until the next run.
+ */
+abstract class AllocationDecorations implements vscode.Disposable {
+    private readonly allocations: () => DecoratedAllocation[];
+    private readonly anchors: LineAnchors;
+    private cleared = false;
+
+    constructor(allocations: () => DecoratedAllocation[], anchors: LineAnchors) {
+        this.allocations = allocations;
+        this.anchors = anchors;
+    }
+
+    // Redecorates the visible editors, after a run, an edit or a change of setting
+    update(): void {
+        for (const editor of vscode.window.visibleTextEditors) {
+            this.decorate(editor, this.cleared ? [] : this.anchored(editor));
+        }
+    }
+
+    // Hides the decorations until the next run
+    clear(): void {
+        this.cleared = true;
+        this.update();
+    }
+
+    show(): void {
+        this.cleared = false;
+        this.update();
+    }
+
+    // Whether the decorations are cleared until the next run
+    get hidden(): boolean {
+        return this.cleared;
+    }
+
+    // The sites in the editor's file, where they are now; a file changed on disk can't be followed, so all its sites count as edited
+    private anchored(editor: vscode.TextEditor): AnchoredAllocation[] {
+        const file = path.resolve(editor.document.uri.fsPath);
+        const anchored: AnchoredAllocation[] = [];
+        for (const { stale, ...site } of this.allocations()) {
+            if (path.resolve(site.allocation.filePath) !== file) {
+                continue;
+            }
+            const since = site.benchmark.finishedAt ?? 0;
+            const { line, edited } = this.anchors.locate(file, site.allocation.lineNumber, since);
+            if (line < 1 || line > editor.document.lineCount) {
+                continue;
+            }
+            anchored.push({ site, line, edited: edited || (stale && !this.anchors.editedSince(file, since)) });
+        }
+        return anchored;
+    }
+
+    protected abstract decorate(editor: vscode.TextEditor, anchored: AnchoredAllocation[]): void;
+
+    abstract dispose(): void;
+}
+
+/**
+ * Marks the lines that allocated in the latest results with a bar and in
+ * the overview ruler, colored by bytes allocated as a share of their
+ * benchmark's, in the theme's goAllocations.heat colors at the levels of
+ * goAllocations.heatThresholds, unless goAllocations.heatmap is off.
+ * Edited lines get a gray bar until the next run.
+ */
+export class HeatmapDecorations extends AllocationDecorations {
+    // TODO: the minimap too, which the decoration API doesn't offer
+    private readonly types = heatLevels.map(level => barType(heatColor(level)));
+    private readonly editedType = barType(new vscode.ThemeColor('disabledForeground'));
+
+    protected decorate(editor: vscode.TextEditor, anchored: AnchoredAllocation[]): void {
+        const enabled = vscode.workspace.getConfiguration('goAllocations').get<boolean>('heatmap', true);
+
+        // A line several benchmarks allocate at shows the hottest any of them is
+        // TODO: limit to the benchmarks of the package, or the one selected in the tree
+        const lines = new Map<number, number>();
+        const edited = new Set<number>();
+        for (const { site, line, edited: wasEdited } of enabled ? anchored : []) {
+            const heat = heatAt(site.allocation);
+            if (wasEdited) {
+                edited.add(line);
+            } else if (heat) {
+                lines.set(line, Math.max(lines.get(line) ?? 0, heatLevels.indexOf(heat)));
+            }
+        }
+
+        const ranges: vscode.Range[][] = this.types.map(() => []);
+        for (const [line, level] of lines) {
+            ranges[level].push(new vscode.Range(line - 1, 0, line - 1, 0));
+        }
+        this.types.forEach((type, i) => editor.setDecorations(type, ranges[i]));
+        editor.setDecorations(this.editedType, [...edited].filter(line => !lines.has(line)).map(line => new vscode.Range(line - 1, 0, line - 1, 0)));
+    }
+
+    dispose(): void {
+        this.types.forEach(type => type.dispose());
+        this.editedType.dispose();
+    }
+}
+
+// e.g. 1.2MB for bytes, 12,003 objs for counts; in-use values say so
+const formatAnnotation = (value: number, type: string, unit: string): string => {
+    const formatted = unit === 'bytes' ? formatBytes(value) : `${value.toLocaleString()} objs`;
+    return type.startsWith('inuse_') ? `${formatted} in use` : formatted;
+}
+
+/**
+ * Annotates the lines that allocated in the latest results at their end,
+ * e.g. // 1.2MB · 12,003 objs (BenchmarkFoo), with the sample types in
+ * goAllocations.inlineAnnotations, and the allocating calls there that
+ * escape analysis says couldn't be inlined. They can be hidden for one
+ * file, and fade when their line is edited.
+ */
+export class InlineAnnotations extends AllocationDecorations {
+    private readonly type = vscode.window.createTextEditorDecorationType({
+        after: { color: new vscode.ThemeColor('editorCodeLens.foreground'), margin: '0 0 0 2em' }
+    });
+    private readonly editedType = vscode.window.createTextEditorDecorationType({
+        after: { color: new vscode.ThemeColor('disabledForeground'), margin: '0 0 0 2em', fontStyle: 'italic' }
+    });
+    // Files whose annotations are toggled off, by URI
+    private readonly hidden = new Set<string>();
+    private readonly inliningAt: (filePath: string, lineNumber: number) => InliningNote[];
+
+    constructor(
+        allocations: () => DecoratedAllocation[],
+        anchors: LineAnchors,
+        inliningAt: (filePath: string, lineNumber: number) => InliningNote[]
+    ) {
+        super(allocations, anchors);
+        this.inliningAt = inliningAt;
+    }
+
+    // Hides or shows the annotations in the editor's file
+    toggle(editor: vscode.TextEditor): void {
+        const uri = editor.document.uri.toString();
+        if (!this.hidden.delete(uri)) {
+            this.hidden.add(uri);
+        }
+        this.update();
+    }
+
+    protected decorate(editor: vscode.TextEditor, anchored: AnchoredAllocation[]): void {
+        const sampleTypes = vscode.workspace.getConfiguration('goAllocations').get<string[]>('inlineAnnotations', ['alloc_space', 'alloc_objects']);
+        if (sampleTypes.length === 0 || this.hidden.has(editor.document.uri.toString())) {
+            editor.setDecorations(this.type, []);
+            editor.setDecorations(this.editedType, []);
+            return;
+        }
+
+        // Each line shows the benchmark that allocated the most there, by the first sample type
+        const lines = new Map<number, { site: SiteAllocation; first: number; edited: boolean }>();
+        for (const { site, line, edited } of anchored) {
+            const { allocationData } = site.allocation;
+            const index = allocationData.sampleTypes.findIndex(st => st.type === sampleTypes[0]);
+            const first = index < 0 ? 0 : allocationData.flat[index];
+            const shown = lines.get(line);
+            if (!shown || first > shown.first) {
+                lines.set(line, { site, first, edited });
+            }
+        }
+
+        const options: vscode.DecorationOptions[] = [];
+        const editedOptions: vscode.DecorationOptions[] = [];
+        for (const [line, { site, edited }] of lines) {
+            const { sampleTypes: types, flat } = site.allocation.allocationData;
+            const values = sampleTypes.flatMap(type => {
+                const index = types.findIndex(st => st.type === type);
+                return index < 0 ? [] : [formatAnnotation(flat[index], type, types[index].unit)];
+            });
+            if (values.length === 0) {
+                continue;
+            }
+            // Only those escape analysis gave a reason for, so only once it has run
+            const notInlined = this.inliningAt(site.allocation.filePath, site.allocation.lineNumber)
+                .filter(note => !note.inlined && note.reason)
+                .map(note => `${note.callee} not inlined`);
+            const end = editor.document.lineAt(line - 1).range.end;
+            const text = `// ${[...values, ...notInlined].join(' · ')} (${site.benchmark.fullName}${edited ? ', before the edit' : ''})`;
+            (edited ? editedOptions : options).push({
+                range: new vscode.Range(end, end),
+                renderOptions: { after: { contentText: text } }
+            });
+        }
+        editor.setDecorations(this.type, options);
+        editor.setDecorations(this.editedType, editedOptions);
+    }
+
+    dispose(): void {
+        this.type.dispose();
+        this.editedType.dispose();
+    }
+}
+
+/**
+ * Dims the lines that didn't allocate in the latest results, like a coverage
+ * view, so the allocating ones stand out, when goAllocations.dimNonAllocating
+ * is on. Only files with an allocating line are dimmed; a file the results
+ * don't reach stays as it is.
+ */
+export class DimDecorations extends AllocationDecorations {
+    private readonly type = vscode.window.createTextEditorDecorationType({ opacity: '0.45', isWholeLine: true });
+
+    protected decorate(editor: vscode.TextEditor, anchored: AnchoredAllocation[]): void {
+        const enabled = vscode.workspace.getConfiguration('goAllocations').get<boolean>('dimNonAllocating', false);
+
+        // A line allocates if it did itself, or a call from it did
+        const allocating = new Set<number>();
+        for (const { site, line } of enabled ? anchored : []) {
+            const { flat, cum } = site.allocation.allocationData;
+            if ([...flat, ...cum].some(v => v > 0)) {
+                allocating.add(line);
+            }
+        }
+        if (allocating.size === 0) {
+            editor.setDecorations(this.type, []);
+            return;
+        }
+
+        const ranges: vscode.Range[] = [];
+        for (let line = 1; line <= editor.document.lineCount; line++) {
+            if (!allocating.has(line)) {
+                ranges.push(new vscode.Range(line - 1, 0, line - 1, 0));
+            }
+        }
+        editor.setDecorations(this.type, ranges);
+    }
+
+    dispose(): void {
+        this.type.dispose();
+    }
+}
@@ -0,0 +1,59 @@
+import * as path from 'path';
+import { runProcess } from './process';
+
+// Calls into the runtime that allocate on the heap, as go tool objdump prints them
+const allocatingCallRegex = /\bCALL runtime\.(newobject|mallocgc|newarray|makeslice\w*|growslice|makemap\w*|makechan|convT\w*|concatstring\w*|rawstring\w*|rawbyteslice|slicebytetostring|stringtoslice\w*)\(SB\)/;
+
+// e.g. "  a.go:12		0x4a1b20		493b6610		CMPQ SP, 0x10(R14)"
+const instructionRegex = /^\s+(\S+?):(\d+)\t+(0x[0-9a-f]+)\t/;
+
+/**
+ * Marks the instructions of the line in go tool objdump's output with >,
+ * and notes the calls that allocate, such as runtime.newobject. objdump
+ * names only the base of each file, so the full paths are by address.
+ */
+export const annotateDisassembly = (output: string, file: string, line: number, files: Map<string, string>): string =>
+    output.split('\n').map(text => {
+        const match = text.match(instructionRegex);
+        if (!match) {
+            return text;
+        }
+        const at = files.get(match[3]);
+        const here = at !== undefined && path.resolve(at) === path.resolve(file) && parseInt(match[2]) === line;
+        const annotated = `${here ? '>' : ' '}${text.trimEnd()}`;
+        return allocatingCallRegex.test(text) ? `${annotated}    // allocates` : annotated;
+    }).join('\n');
+
+/**
+ * Disassembles the function in the binary with go tool objdump, annotated
+ * for the allocation site at file and line.
+ */
+export const disassemble = async (
+    go: string,
+    binary: string,
+    symbol: string,
+    file: string,
+    line: number,
+    env: NodeJS.ProcessEnv,
+    signal: AbortSignal
+): Promise<string> => {
+    // -s takes a regular expression, and names such as pkg.(*T).M have its characters
+    // TODO: generic functions, whose symbols have their shapes, e.g. F[go.shape.int]
+    const pattern = `^${symbol.replace(/[.*+?^${}()|[\]\\]/g, '\\$&')}$`;
+    const { stdout } = await runProcess(go, ['tool', 'objdump', '-s', pattern, binary], { cwd: path.dirname(binary), env, signal });
+    if (!stdout.trim()) {
+        throw new Error(`${symbol} is not in the test binary; the compiler may have inlined it everywhere.`);
+    }
+
+    // go tool addr2line prints the function and file:line of each address it reads
+    const pcs = stdout.split('\n').map(text => text.match(instructionRegex)?.[3]).filter((pc): pc is string => pc !== undefined);
+    const { stdout: positions } = await runProcess(go, ['tool', 'addr2line', binary], { cwd: path.dirname(binary), env, signal, input: `${pcs.join('\n')}\n` });
+    const lines = positions.split('\n');
+    const files = new Map(pcs.map((pc, i) => [pc, lines[i * 2 + 1]?.replace(/:\d+$/, '') ?? '']));
+    return [
+        `// ${symbol}, from go tool objdump`,
+        `// > marks the instructions of ${path.basename(file)}:${line}`,
+        '',
+        annotateDisassembly(stdout, file, line, files)
+    ].join('\n');
+}
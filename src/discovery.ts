@@ -0,0 +1,820 @@
+import * as vscode from 'vscode';
+import * as path from 'path';
+import * as fs from 'fs';
+import * as os from 'os';
+import { execFile } from 'child_process';
+import { promisify } from 'util';
+import { Sema } from 'async-sema';
+import { goCommand, goEnv } from './env';
+
+const execFileAsync = promisify(execFile);
+
+export interface ModuleCache {
+    name: string;
+    path: string;
+    // GOWORK for runs: the go.work file listing this module, or 'off' for a
+    // module in a go.work tree that isn't listed; unset to let go decide
+    goWork?: string;
+    packages: PackageCache[];
+}
+
+export interface PackageCache {
+    name: string;
+    path: string;
+    benchmarks: BenchmarkCache[];
+    // Set when the package failed to compile during discovery, or the latest run
+    buildErrors?: BuildError[];
+}
+
+export interface BuildError {
+    file: string;
+    // 1-based, as reported by the compiler
+    line: number;
+    column: number;
+    message: string;
+}
+
+const buildErrorRegex = /^(.+?\.go):(\d+)(?::(\d+))?: (.+)$/;
+
+/**
+ * Parses compiler errors, like ./foo_test.go:12:3: undefined: x, from go
+ * command output. Relative paths are resolved against cwd.
+ */
+export const parseBuildErrors = (output: string, cwd: string): BuildError[] => {
+    const errors: BuildError[] = [];
+    for (const line of output.split('\n')) {
+        const m = line.trim().match(buildErrorRegex);
+        if (!m) {
+            continue;
+        }
+        errors.push({
+            file: path.resolve(cwd, m[1]),
+            line: parseInt(m[2]),
+            column: m[3] ? parseInt(m[3]) : 1,
+            message: m[4]
+        });
+    }
+    return errors;
+}
+
+export interface BenchmarkCache {
+    name: string;
+    location: vscode.Location;
+    // The //go:build expression of the declaring file, if any
+    buildConstraint?: string;
+    // The external test package (package foo_test) declaring it, if any
+    externalPackage?: string;
+    // Names of sub-benchmarks declared with b.Run and a string literal
+    subBenchmarks?: string[];
+    // for b.Loop() (Go 1.24+) or for ... b.N, and the 0-based line of the loop
+    loopStyle?: LoopStyle;
+    loopLine?: number;
+    // Declared only in an unsaved editor buffer, so go test can't run it yet
+    unsaved?: boolean;
+}
+
+export type LoopStyle = 'b.Loop' | 'b.N';
+
+// What the regex scan knows beyond the name and location
+type ScannedFields = Omit<BenchmarkCache, 'name' | 'location'>;
+
+/**
+ * How benchmarks are verified after the pre-scan. 'auto' uses gopls, and
+ * falls back to go test -list when gopls finds nothing.
+ */
+export type DiscoveryStrategy = 'auto' | 'gopls' | 'goTestList';
+
+export const getDiscoveryStrategy = (): DiscoveryStrategy => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    return config.get<DiscoveryStrategy>('discoveryStrategy', 'auto');
+}
+
+const benchmarkNameRegex = /^Benchmark[A-Z_]/;
+
+/**
+ * Tests whether a name is a benchmark that should appear in the tree: it's
+ * named like a benchmark, and matches the benchmarkFilter setting, if any.
+ */
+export const benchmarkMatcher = (): (name: string) => boolean => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const filter = config.get<string>('benchmarkFilter', '');
+
+    let filterRegex: RegExp | undefined;
+    if (filter) {
+        try {
+            filterRegex = new RegExp(filter);
+        } catch (error) {
+            // Reported to the user when the setting changes
+            console.warn('Ignoring invalid benchmarkFilter:', error);
+        }
+    }
+
+    return (name: string) => benchmarkNameRegex.test(name) && (!filterRegex || filterRegex.test(name));
+}
+const benchmarkFuncRegex = /^func\s+(Benchmark[A-Za-z0-9_]*)\s*\(\s*(\w+)\s+\*testing\.B\s*\)/;
+const packageClauseRegex = /^package\s+(\w+)/m;
+const moduleDirectiveRegex = /^module\s+(\S+)/m;
+const subBenchmarkRegex = /\b(\w+)\.Run\(\s*"((?:[^"\\]|\\.)*)"/g;
+const funcEndRegex = /^}/;
+const buildConstraintRegex = /^\/\/go:build\s+(.+)$/m;
+const useBlockRegex = /^use\s*\(([^)]*)\)/gm;
+const useLineRegex = /^use\s+([^\s(]+)/gm;
+
+// Constraint terms that describe the platform or toolchain, rather than a tag to pass via -tags
+const platformTerms = new Set([
+    'aix', 'android', 'darwin', 'dragonfly', 'freebsd', 'illumos', 'ios', 'js', 'linux', 'netbsd',
+    'openbsd', 'plan9', 'solaris', 'wasip1', 'windows', 'unix',
+    '386', 'amd64', 'arm', 'arm64', 'loong64', 'mips', 'mipsle', 'mips64', 'mips64le',
+    'ppc64', 'ppc64le', 'riscv64', 's390x', 'wasm',
+    'cgo', 'gc', 'gccgo', 'ignore'
+]);
+
+/**
+ * The tags a build constraint requires, i.e. its non-negated terms that
+ * aren't platform or Go version terms. For `integration && !race` it is
+ * ['integration'].
+ */
+export const constraintTags = (constraint: string | undefined): string[] => {
+    if (!constraint) {
+        return [];
+    }
+
+    const tags = new Set<string>();
+    for (const m of constraint.matchAll(/(!?)\s*([A-Za-z0-9_.]+)/g)) {
+        const [, negated, term] = m;
+        if (negated || platformTerms.has(term) || /^go1\.\d+$/.test(term)) {
+            continue;
+        }
+        tags.add(term);
+    }
+    // TODO: tags that only appear within an || alternative aren't all required
+    return [...tags];
+}
+
+/**
+ * How many packages or files discovery works on at once: the
+ * discoveryConcurrency setting, or by default, the number of CPUs.
+ */
+const discoveryConcurrency = (): number => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const configured = Math.floor(config.get<number>('discoveryConcurrency', 0));
+    return configured >= 1 ? configured : Math.max(1, os.cpus().length);
+}
+
+/**
+ * Like Promise.all over items.map(fn), but with at most discoveryConcurrency
+ * calls to fn in flight. Results are in the order of items.
+ */
+const mapConcurrent = async <T, R>(items: T[], fn: (item: T) => Promise<R>): Promise<R[]> => {
+    const sema = new Sema(discoveryConcurrency());
+    return Promise.all(items.map(async item => {
+        await sema.acquire();
+        try {
+            return await fn(item);
+        } finally {
+            sema.release();
+        }
+    }));
+}
+
+const throwIfCancelled = (signal: AbortSignal): void => {
+    if (signal.aborted) {
+        throw new Error('Operation cancelled');
+    }
+}
+
+/**
+ * Whether discovery should skip a path: the go command ignores testdata
+ * directories, and vendor holds third-party code. Vendor can be opted into.
+ */
+export const isExcluded = (filePath: string): boolean => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const includeVendor = config.get<boolean>('includeVendor', false);
+    const segments = filePath.split(/[\\/]/);
+    return segments.includes('testdata') || (!includeVendor && segments.includes('vendor'));
+}
+
+const excludeGlob = (): string => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    return config.get<boolean>('includeVendor', false)
+        ? '**/testdata/**'
+        : '{**/testdata/**,**/vendor/**}';
+}
+
+export const isWithin = (dir: string, root: string): boolean =>
+    dir === root || dir.startsWith(root + path.sep);
+
+/**
+ * A directory containing a go.mod, which will become a ModuleItem.
+ */
+export interface ModuleRoot {
+    path: string;
+    goWork?: string;
+}
+
+const stripComment = (line: string): string => line.replace(/\/\/.*$/, '').trim();
+
+const unquote = (s: string): string => s.replace(/^["`](.*)["`]$/, '$1');
+
+const readGoWorkUses = async (goWork: string): Promise<string[] | undefined> => {
+    let content: string;
+    try {
+        content = await fs.promises.readFile(goWork, 'utf8');
+    } catch {
+        return undefined;
+    }
+
+    const dirs: string[] = [];
+    for (const m of content.matchAll(useBlockRegex)) {
+        dirs.push(...m[1].split('\n').map(stripComment).filter(d => d));
+    }
+    for (const m of content.matchAll(useLineRegex)) {
+        dirs.push(stripComment(m[1]));
+    }
+    return dirs.map(dir => path.resolve(path.dirname(goWork), unquote(dir)));
+}
+
+/**
+ * Finds the modules in a workspace folder: those named by use directives in
+ * its go.work, plus any other go.mod beneath it, such as tools/ or examples/.
+ */
+export const findModuleRoots = async (folderPath: string): Promise<ModuleRoot[]> => {
+    const roots = new Map<string, ModuleRoot>();
+
+    // TODO: go.work files in parent directories of the workspace folder
+    const goWork = path.join(folderPath, 'go.work');
+    const uses = await readGoWorkUses(goWork);
+    for (const dir of uses ?? []) {
+        roots.set(dir, { path: dir, goWork });
+    }
+
+    const goMods = await vscode.workspace.findFiles(
+        new vscode.RelativePattern(vscode.Uri.file(folderPath), '**/go.mod'),
+        new vscode.RelativePattern(vscode.Uri.file(folderPath), excludeGlob())
+    );
+    for (const goMod of goMods) {
+        const dir = path.dirname(goMod.fsPath);
+        if (!roots.has(dir)) {
+            // A module outside go.work can't be built in workspace mode
+            roots.set(dir, { path: dir, goWork: uses ? 'off' : undefined });
+        }
+    }
+
+    return [...roots.values()].sort((a, b) => a.path.localeCompare(b.path));
+}
+
+/**
+ * Reads the module path from go.mod in rootPath, without invoking go.
+ * Returns undefined if rootPath is not a module root.
+ */
+export const readModuleName = async (rootPath: string): Promise<string | undefined> => {
+    let goMod: string;
+    try {
+        goMod = await fs.promises.readFile(path.join(rootPath, 'go.mod'), 'utf8');
+    } catch {
+        return undefined;
+    }
+
+    const m = goMod.match(moduleDirectiveRegex);
+    return m ? m[1] : undefined;
+}
+
+/**
+ * Gets the module path via go list, which is authoritative.
+ * Returns undefined if rootPath is not a valid module.
+ */
+export const listModuleName = async (rootPath: string, signal: AbortSignal): Promise<string | undefined> => {
+    // In workspace mode, go list -m lists every module in go.work; we only want this one
+    const { stdout } = await execFileAsync(goCommand(), ['list', '-m'], {
+        cwd: rootPath,
+        env: { ...goEnv(), GOWORK: 'off' },
+        signal: signal
+    });
+
+    const moduleName = stdout.trim();
+    if (!moduleName || moduleName === 'command-line-arguments') {
+        return undefined;
+    }
+    return moduleName;
+}
+
+/**
+ * Scans the body of the benchmark declared at lines[start] for its loop style,
+ * and for b.Run("name", ...) calls, named as the testing package would:
+ * spaces become underscores.
+ * TODO: sub-benchmark names built at run time, e.g. with fmt.Sprintf, need a dry run
+ */
+const scanBody = (lines: string[], start: number, receiver: string): ScannedFields => {
+    const names: string[] = [];
+    let loopStyle: LoopStyle | undefined;
+    let loopLine: number | undefined;
+    const loopRegex = new RegExp(`\\bfor\\s+${receiver}\\.Loop\\(\\)`);
+    const nRegex = new RegExp(`\\bfor\\b.*\\b${receiver}\\.N\\b`);
+
+    for (let i = start + 1; i < lines.length && !funcEndRegex.test(lines[i]); i++) {
+        if (!loopStyle && loopRegex.test(lines[i])) {
+            loopStyle = 'b.Loop';
+            loopLine = i;
+        } else if (!loopStyle && nRegex.test(lines[i])) {
+            loopStyle = 'b.N';
+            loopLine = i;
+        }
+
+        for (const m of lines[i].matchAll(subBenchmarkRegex)) {
+            if (m[1] !== receiver) {
+                continue;
+            }
+            const name = m[2].replace(/\s/g, '_');
+            if (!names.includes(name)) {
+                names.push(name);
+            }
+        }
+    }
+    return {
+        subBenchmarks: names.length > 0 ? names : undefined,
+        loopStyle,
+        loopLine
+    };
+}
+
+/**
+ * Finds benchmark declarations in a single file by regex.
+ */
+const scanFile = async (uri: vscode.Uri): Promise<{ content: string; benchmarks: BenchmarkCache[] }> => {
+    const content = await fs.promises.readFile(uri.fsPath, 'utf8');
+    return { content, benchmarks: scanContent(uri, content) };
+}
+
+const scanContent = (uri: vscode.Uri, content: string): BenchmarkCache[] => {
+    const isBenchmark = benchmarkMatcher();
+    const lines = content.split('\n');
+    const benchmarks: BenchmarkCache[] = [];
+    const buildConstraint = content.match(buildConstraintRegex)?.[1].trim();
+    const packageClause = content.match(packageClauseRegex)?.[1];
+    const externalPackage = packageClause?.endsWith('_test') ? packageClause : undefined;
+
+    for (let i = 0; i < lines.length; i++) {
+        const m = lines[i].match(benchmarkFuncRegex);
+        if (!m || !isBenchmark(m[1])) {
+            continue;
+        }
+
+        const start = lines[i].indexOf(m[1]);
+        benchmarks.push({
+            name: m[1],
+            location: new vscode.Location(uri, new vscode.Range(i, start, i, start + m[1].length)),
+            buildConstraint,
+            externalPackage,
+            ...scanBody(lines, i, m[2])
+        });
+    }
+
+    return benchmarks;
+}
+
+/**
+ * The name of the benchmark function enclosing a line of a document, if any:
+ * the nearest func declaration at or above the line, if it's a benchmark.
+ */
+export const enclosingBenchmark = (document: vscode.TextDocument, line: number): string | undefined => {
+    for (let i = line; i >= 0; i--) {
+        const text = document.lineAt(i).text;
+        if (!text.startsWith('func ')) {
+            continue;
+        }
+        const m = text.match(benchmarkFuncRegex);
+        return m && benchmarkNameRegex.test(m[1]) ? m[1] : undefined;
+    }
+    return undefined;
+}
+
+const prescanPackageName = (content: string, packageDir: string, rootPath: string): string => {
+    const relativePath = path.relative(rootPath, packageDir);
+    if (relativePath !== '') {
+        return relativePath.replaceAll('\\', '/');
+    }
+
+    // At the module root, use the package clause, as go list would
+    const m = content.match(packageClauseRegex);
+    return m ? m[1].replace(/_test$/, '') : relativePath;
+}
+
+/**
+ * Fast first pass: regex-scans _test.go files for benchmark declarations,
+ * without invoking go or gopls. Results are provisional until verified.
+ */
+export const prescanPackages = async (
+    rootPath: string,
+    nestedRoots: string[],
+    signal: AbortSignal
+): Promise<PackageCache[]> => {
+    const files = await vscode.workspace.findFiles(
+        new vscode.RelativePattern(vscode.Uri.file(rootPath), '**/*_test.go'),
+        new vscode.RelativePattern(vscode.Uri.file(rootPath), excludeGlob())
+    );
+
+    const packageMap = new Map<string, PackageCache>();
+
+    // Files in nested modules belong to those modules
+    const ownFiles = files.filter(uri => !nestedRoots.some(root => isWithin(uri.fsPath, root)));
+    const scanned = await mapConcurrent(ownFiles, async uri => {
+        throwIfCancelled(signal);
+        return { uri, ...await scanFile(uri) };
+    });
+
+    // Packages without benchmarks are kept, the tree decides whether to show them
+    for (const { uri, content, benchmarks } of scanned) {
+        const packageDir = path.dirname(uri.fsPath);
+        let pkg = packageMap.get(packageDir);
+        if (!pkg) {
+            pkg = {
+                name: prescanPackageName(content, packageDir, rootPath),
+                path: packageDir,
+                benchmarks: []
+            };
+            packageMap.set(packageDir, pkg);
+        }
+        pkg.benchmarks.push(...benchmarks);
+    }
+
+    return [...packageMap.values()];
+}
+
+/**
+ * The contents of unsaved _test.go editors, by path, like gopls overlays.
+ */
+export const unsavedOverlays = (): Map<string, string> => {
+    const overlays = new Map<string, string>();
+    for (const document of vscode.workspace.textDocuments) {
+        if (document.isDirty && document.uri.scheme === 'file' && document.fileName.endsWith('_test.go')) {
+            overlays.set(path.resolve(document.uri.fsPath), document.getText());
+        }
+    }
+    return overlays;
+}
+
+export const hasTestFiles = async (packageDir: string): Promise<boolean> => {
+    const entries = await fs.promises.readdir(packageDir).catch(() => [] as string[]);
+    return entries.some(e => e.endsWith('_test.go'));
+}
+
+/**
+ * Rescans the _test.go files in a single package directory by regex, for
+ * incremental updates when a test file changes. Overlays take precedence
+ * over the files on disk; benchmarks only found in an overlay are marked
+ * unsaved.
+ */
+export const scanPackage = async (
+    packageDir: string,
+    rootPath: string,
+    overlays: Map<string, string> = new Map()
+): Promise<PackageCache> => {
+    const pkg: PackageCache = {
+        name: '',
+        path: packageDir,
+        benchmarks: []
+    };
+
+    const entries = await fs.promises.readdir(packageDir).catch(() => [] as string[]);
+    for (const entry of entries.filter(e => e.endsWith('_test.go'))) {
+        const uri = vscode.Uri.file(path.join(packageDir, entry));
+        const { content, benchmarks } = await scanFile(uri);
+        if (!pkg.name) {
+            pkg.name = prescanPackageName(content, packageDir, rootPath);
+        }
+
+        const overlay = overlays.get(path.resolve(uri.fsPath));
+        if (overlay === undefined) {
+            pkg.benchmarks.push(...benchmarks);
+            continue;
+        }
+
+        const saved = new Set(benchmarks.map(b => b.name));
+        for (const b of scanContent(uri, overlay)) {
+            pkg.benchmarks.push(saved.has(b.name) ? b : { ...b, unsaved: true });
+        }
+    }
+
+    return pkg;
+}
+
+const getPackageNameFromPath = async (packageDir: string, rootPath: string): Promise<string> => {
+    const relativePath = path.relative(rootPath, packageDir);
+    if (relativePath === '') {
+        try {
+            const { stdout } = await execFileAsync(goCommand(), ['list', '-f', '{{.Name}}', '.'], { cwd: packageDir, env: goEnv() });
+            return stdout.trim();
+        } catch {
+            return relativePath;
+        }
+    }
+
+    return relativePath.replaceAll('\\', '/');
+}
+
+/**
+ * Searches the whole workspace for benchmark functions via gopls.
+ * Returns an empty list if gopls is unavailable.
+ */
+export const findBenchmarkSymbols = async (): Promise<vscode.SymbolInformation[]> => {
+    try {
+        // Search for all symbols containing "Benchmark" across the workspace
+        const workspaceSymbols: vscode.SymbolInformation[] | undefined = await vscode.commands.executeCommand(
+            'vscode.executeWorkspaceSymbolProvider',
+            'Benchmark'
+        );
+
+        const isBenchmark = benchmarkMatcher();
+        return (workspaceSymbols ?? []).filter(symbol =>
+            symbol.kind === vscode.SymbolKind.Function &&
+            symbol.location.uri.fsPath.endsWith('_test.go') &&
+            isBenchmark(symbol.name)
+        );
+    } catch (error) {
+        console.warn('Workspace symbol search failed:', error);
+        return [];
+    }
+}
+
+/**
+ * Groups the gopls benchmark symbols beneath rootPath by package.
+ */
+export const goplsPackages = async (
+    rootPath: string,
+    nestedRoots: string[],
+    allBenchmarkSymbols: vscode.SymbolInformation[],
+    signal: AbortSignal
+): Promise<PackageCache[]> => {
+    const benchmarkSymbols = allBenchmarkSymbols.filter(symbol =>
+        isWithin(symbol.location.uri.fsPath, rootPath) &&
+        !nestedRoots.some(root => isWithin(symbol.location.uri.fsPath, root)) &&
+        !isExcluded(path.relative(rootPath, symbol.location.uri.fsPath))
+    );
+
+    // Group benchmarks by package directory
+    const packageMap = new Map<string, PackageCache>();
+
+    for (const symbol of benchmarkSymbols) {
+        throwIfCancelled(signal);
+
+        const packageDir = path.dirname(symbol.location.uri.fsPath);
+
+        if (!packageMap.has(packageDir)) {
+            packageMap.set(packageDir, {
+                name: await getPackageNameFromPath(packageDir, rootPath),
+                path: packageDir,
+                benchmarks: []
+            });
+        }
+
+        packageMap.get(packageDir)!.benchmarks.push({
+            name: symbol.name,
+            location: new vscode.Location(symbol.location.uri, symbol.location.range)
+        });
+    }
+
+    return [...packageMap.values()].filter(pkg => pkg.benchmarks.length > 0);
+}
+
+/**
+ * Annotates the verified benchmarks with what only the regex scan knows:
+ * build constraints and external test packages.
+ *
+ * Also, gopls and go test -list only see files satisfying the default build
+ * constraints, so this carries over the constrained benchmarks from the
+ * regex scan into the verified packages.
+ */
+export const mergeProvisional = (verified: PackageCache[], provisional: PackageCache[]): PackageCache[] => {
+    for (const provisionalPkg of provisional) {
+        for (const benchmark of provisionalPkg.benchmarks) {
+            let pkg = verified.find(p => p.path === provisionalPkg.path);
+            const existing = pkg?.benchmarks.find(b => b.name === benchmark.name);
+            if (existing) {
+                const { name, location, ...scanned } = benchmark;
+                Object.assign(existing, scanned);
+                continue;
+            }
+
+            if (!benchmark.buildConstraint) {
+                continue;
+            }
+
+            if (!pkg) {
+                pkg = { ...provisionalPkg, benchmarks: [] };
+                verified.push(pkg);
+            }
+            pkg.benchmarks.push(benchmark);
+        }
+
+        // gopls only reports benchmarks, so it never sees packages without them
+        if (provisionalPkg.benchmarks.length === 0 && !verified.some(p => p.path === provisionalPkg.path)) {
+            verified.push(provisionalPkg);
+        }
+    }
+    return verified;
+}
+
+/**
+ * Discovers benchmarks with the go command alone, for when gopls is
+ * unavailable: go list finds the packages with tests, and go test -list
+ * names the benchmarks in each.
+ */
+export const goTestListPackages = async (
+    rootPath: string,
+    nestedRoots: string[],
+    signal: AbortSignal
+): Promise<PackageCache[]> => {
+    const { stdout: dirs } = await execFileAsync(
+        goCommand(),
+        ['list', '-f', '{{if or .TestGoFiles .XTestGoFiles}}{{.Dir}}{{end}}', './...'],
+        { cwd: rootPath, env: goEnv(), signal }
+    );
+
+    const isBenchmark = benchmarkMatcher();
+
+    // ./... skips vendor and testdata, as we do by default
+    // TODO: honor includeVendor here, by listing vendored packages explicitly
+    // In workspace mode, ./... reaches into nested modules, which are listed separately
+    const packageDirs = dirs.split('\n')
+        .map(d => d.trim())
+        .filter(d => d && !nestedRoots.some(root => isWithin(d, root)));
+
+    return mapConcurrent(packageDirs, packageDir =>
+        listPackage(packageDir, rootPath, isBenchmark, signal)
+    );
+}
+
+/**
+ * Lists the benchmarks in one package with go test -list.
+ */
+const listPackage = async (
+    packageDir: string,
+    rootPath: string,
+    isBenchmark: (name: string) => boolean,
+    signal: AbortSignal
+): Promise<PackageCache> => {
+    throwIfCancelled(signal);
+
+    // go test -list doesn't report locations, so find them by scanning the package's test files
+    const declared = new Map<string, BenchmarkCache>();
+    const entries = await fs.promises.readdir(packageDir);
+    for (const entry of entries.filter(e => e.endsWith('_test.go'))) {
+        const { benchmarks } = await scanFile(vscode.Uri.file(path.join(packageDir, entry)));
+        for (const b of benchmarks) {
+            declared.set(b.name, b);
+        }
+    }
+
+    let names: string[];
+    let buildErrors: BuildError[] | undefined;
+    try {
+        const { stdout } = await execFileAsync(
+            goCommand(),
+            ['test', '-list', '^Benchmark', '-run', '^$'],
+            { cwd: packageDir, env: goEnv(), signal }
+        );
+        names = stdout.split('\n')
+            .map(line => line.trim())
+            .filter(isBenchmark);
+    } catch (error) {
+        throwIfCancelled(signal);
+
+        // The package doesn't compile. List what the regex scan found, so the
+        // user can see what exists, along with the errors to fix.
+        const stderr = (error as { stderr?: string }).stderr ?? String(error);
+        buildErrors = parseBuildErrors(stderr, packageDir);
+        names = [...declared.keys()];
+        console.warn(`go test -list failed in ${packageDir}:`, stderr);
+    }
+
+    const benchmarks: BenchmarkCache[] = [];
+    for (const name of names) {
+        const b = declared.get(name);
+        if (!b) {
+            // TODO: handle declarations the regex misses, such as multi-line signatures
+            console.warn(`Could not locate ${name} in ${packageDir}`);
+            continue;
+        }
+        benchmarks.push(b);
+    }
+
+    return {
+        name: await getPackageNameFromPath(packageDir, rootPath),
+        path: packageDir,
+        benchmarks,
+        buildErrors
+    };
+}
+
+// Discovery results persisted in workspaceState, so the tree renders
+// instantly after a window reload.
+
+const discoveryCacheKey = 'goAllocations.discoveryCache.v1';
+
+interface StoredBenchmark extends ScannedFields {
+    name: string;
+    file: string;
+    line: number;
+    start: number;
+    end: number;
+}
+
+interface StoredPackage {
+    name: string;
+    path: string;
+    // mtimes of the package's _test.go files when it was discovered
+    mtimes: Record<string, number>;
+    benchmarks: StoredBenchmark[];
+}
+
+interface StoredModule {
+    name: string;
+    path: string;
+    goWork?: string;
+    packages: StoredPackage[];
+}
+
+const testFileMtimes = async (packageDir: string): Promise<Record<string, number>> => {
+    const mtimes: Record<string, number> = {};
+    const entries = await fs.promises.readdir(packageDir).catch(() => [] as string[]);
+    for (const entry of entries.filter(e => e.endsWith('_test.go'))) {
+        const stat = await fs.promises.stat(path.join(packageDir, entry));
+        mtimes[entry] = stat.mtimeMs;
+    }
+    return mtimes;
+}
+
+const sameMtimes = (a: Record<string, number>, b: Record<string, number>): boolean => {
+    const keys = Object.keys(a);
+    return keys.length === Object.keys(b).length && keys.every(k => a[k] === b[k]);
+}
+
+export const saveModules = async (state: vscode.Memento, modules: ModuleCache[]): Promise<void> => {
+    const stored: StoredModule[] = [];
+    for (const module of modules) {
+        const packages: StoredPackage[] = [];
+        for (const pkg of module.packages) {
+            packages.push({
+                name: pkg.name,
+                path: pkg.path,
+                mtimes: await testFileMtimes(pkg.path),
+                // Unsaved benchmarks won't exist after a reload
+                benchmarks: pkg.benchmarks.filter(b => !b.unsaved).map(({ name, location, ...scanned }) => ({
+                    ...scanned,
+                    name,
+                    file: location.uri.fsPath,
+                    line: location.range.start.line,
+                    start: location.range.start.character,
+                    end: location.range.end.character
+                }))
+            });
+        }
+        stored.push({ name: module.name, path: module.path, goWork: module.goWork, packages });
+    }
+    await state.update(discoveryCacheKey, stored);
+}
+
+export const clearSavedModules = async (state: vscode.Memento): Promise<void> => {
+    await state.update(discoveryCacheKey, undefined);
+}
+
+/**
+ * Restores the persisted module at rootPath, if any. Packages whose test
+ * files changed since they were saved are rescanned; the rest are used as-is.
+ */
+export const restoreModule = async (state: vscode.Memento, rootPath: string): Promise<ModuleCache | undefined> => {
+    const stored = state.get<StoredModule[]>(discoveryCacheKey, []).find(m => m.path === rootPath);
+    if (!stored) {
+        return undefined;
+    }
+
+    // TODO: packages that gained their first _test.go file since the last session
+    // are missing here until verification catches up
+    const packages: PackageCache[] = [];
+    for (const storedPkg of stored.packages) {
+        const mtimes = await testFileMtimes(storedPkg.path);
+        if (!sameMtimes(mtimes, storedPkg.mtimes)) {
+            if (Object.keys(mtimes).length === 0) {
+                continue; // Its test files were deleted
+            }
+            const scanned = await scanPackage(storedPkg.path, rootPath);
+            packages.push({ ...scanned, name: storedPkg.name });
+            continue;
+        }
+
+        packages.push({
+            name: storedPkg.name,
+            path: storedPkg.path,
+            benchmarks: storedPkg.benchmarks.map(({ name, file, line, start, end, ...scanned }) => ({
+                ...scanned,
+                name,
+                location: new vscode.Location(
+                    vscode.Uri.file(file),
+                    new vscode.Range(line, start, line, end)
+                )
+            }))
+        });
+    }
+
+    return { name: stored.name, path: stored.path, goWork: stored.goWork, packages };
+}
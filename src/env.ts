@@ -0,0 +1,194 @@
+import * as vscode from 'vscode';
+import * as path from 'path';
+import * as fs from 'fs';
+import * as os from 'os';
+import { runProcess } from './process';
+
+// Expands a leading ~, as a shell would, for paths in settings
+const expandHome = (p: string): string =>
+    p === '~' || p.startsWith('~/') ? path.join(os.homedir(), p.slice(1)) : p;
+
+/**
+ * The go executable for discovery and runs: goAllocations.goExecutable,
+ * or else go from the PATH.
+ */
+export const goCommand = (): string => {
+    const configured = vscode.workspace.getConfiguration('goAllocations').get<string>('goExecutable', '');
+    return configured ? expandHome(configured) : 'go';
+}
+
+/**
+ * The environment for every go command: the extension's own, with GOROOT
+ * and GOFLAGS from settings, if set.
+ */
+export const goEnv = (): NodeJS.ProcessEnv => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const env = { ...process.env };
+
+    const goroot = config.get<string>('goroot', '');
+    if (goroot) {
+        env.GOROOT = expandHome(goroot);
+    }
+    const goflags = config.get<string>('goflags', '');
+    if (goflags) {
+        env.GOFLAGS = goflags;
+    }
+    // TODO: put the configured go's directory first on PATH, for tools that go itself runs
+    return env;
+}
+
+/**
+ * The Go version a go executable reports in dir, e.g. go1.23.4. The
+ * toolchain directive in go.mod may select a different one than go's own.
+ */
+export const goVersion = async (go: string, dir: string, env: NodeJS.ProcessEnv, signal: AbortSignal): Promise<string> => {
+    const { stdout } = await runProcess(go, ['env', 'GOVERSION'], { cwd: dir, env, signal });
+    return stdout.trim();
+}
+
+// Names of toolchains installed by golang.org/dl, such as go1.23.4 and gotip
+const toolchainRegex = /^go(\d+(\.\d+)*((rc|beta)\d+)?|tip)(\.exe)?$/;
+
+// Where go install puts executables for the default go: GOBIN, or else each GOPATH/bin
+const goBinDirs = async (signal: AbortSignal): Promise<string[]> => {
+    const { stdout } = await runProcess(goCommand(), ['env', 'GOBIN', 'GOPATH'], { cwd: os.tmpdir(), env: goEnv(), signal });
+    const [gobin, gopath] = stdout.split('\n').map(line => line.trim());
+
+    const dirs = new Set<string>();
+    if (gobin) {
+        dirs.add(gobin);
+    }
+    for (const p of (gopath ?? '').split(path.delimiter).filter(Boolean)) {
+        dirs.add(path.join(p, 'bin'));
+    }
+    return [...dirs];
+}
+
+/**
+ * Finds alternate Go toolchains installed with golang.org/dl, in GOBIN or
+ * GOPATH/bin of the default go. Returns their paths.
+ */
+export const findToolchains = async (signal: AbortSignal): Promise<string[]> => {
+    const toolchains: string[] = [];
+    for (const dir of await goBinDirs(signal)) {
+        const entries = await fs.promises.readdir(dir).catch(() => [] as string[]);
+        toolchains.push(...entries.filter(e => toolchainRegex.test(e)).map(e => path.join(dir, e)));
+    }
+    return toolchains.sort();
+}
+
+// Finds an executable in the directories, by default the PATH, as a shell would
+const findExecutable = (name: string, dirs = (process.env.PATH ?? '').split(path.delimiter)): string | undefined => {
+    const exts = process.platform === 'win32' ? ['.exe', '.cmd', ''] : [''];
+    for (const dir of dirs.filter(Boolean)) {
+        for (const ext of exts) {
+            const candidate = path.join(dir, name + ext);
+            try {
+                fs.accessSync(candidate, fs.constants.X_OK);
+                return candidate;
+            } catch {
+                // Not here
+            }
+        }
+    }
+    return undefined;
+}
+
+/**
+ * How benchmark runs execute, to reduce noise from the rest of the machine:
+ * under perflock, if enabled and installed, and at low priority, if
+ * enabled, which on Linux also keeps them off the first CPU.
+ */
+export interface Execution {
+    // The command line to run go test under, which takes it as its arguments, e.g. taskset -c 1-7 perflock
+    prefix: string[];
+    // For os.setPriority
+    priority: number | undefined;
+    // For tooltips, e.g. "under perflock, at low priority"
+    description: string;
+}
+
+export const benchmarkExecution = async (signal: AbortSignal): Promise<Execution> => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const prefix: string[] = [];
+    const parts: string[] = [];
+
+    if (config.get<boolean>('lowPriority', false)) {
+        // The editor keeps the first CPU to itself; runs see one fewer, as GOMAXPROCS does
+        const cpus = os.cpus().length;
+        const taskset = process.platform === 'linux' && cpus > 1 ? findExecutable('taskset') : undefined;
+        if (taskset) {
+            prefix.push(taskset, '-c', cpus > 2 ? `1-${cpus - 1}` : '1');
+        }
+        parts.push(taskset ? `at low priority, on CPUs ${prefix[2]}` : 'at low priority');
+    }
+
+    if (config.get<boolean>('perflock', false)) {
+        // go install puts it in GOBIN or GOPATH/bin, which needn't be on the PATH
+        const perflock = findExecutable('perflock') ?? findExecutable('perflock', await goBinDirs(signal));
+        if (perflock) {
+            prefix.push(perflock);
+        }
+        parts.unshift(perflock ? `under perflock (${perflock})` : 'without perflock, which is not installed');
+    }
+
+    const priority = config.get<boolean>('lowPriority', false) ? os.constants.priority.PRIORITY_LOW : undefined;
+    return { prefix, priority, description: parts.join(', ') };
+}
+
+/**
+ * Parses a .env style file: KEY=VALUE lines, with # comments and optional
+ * quotes around values, as vscode-go's go.testEnvFile does.
+ */
+export const parseEnvFile = (content: string): Record<string, string> => {
+    const env: Record<string, string> = {};
+    for (const raw of content.split(/\r?\n/)) {
+        const line = raw.trim();
+        if (!line || line.startsWith('#')) {
+            continue;
+        }
+
+        const match = line.match(/^(?:export\s+)?([\w.-]+)\s*=\s*(.*)$/);
+        if (!match) {
+            throw new Error(`Invalid line in env file: ${line}`);
+        }
+
+        let value = match[2];
+        const quoted = value.match(/^(['"])(.*)\1$/);
+        if (quoted) {
+            value = quoted[1] === '"' ? quoted[2].replace(/\\n/g, '\n') : quoted[2];
+        }
+        env[match[1]] = value;
+    }
+    return env;
+}
+
+// The workspace folder containing dir, which settings paths are relative to
+const workspaceFolderOf = (dir: string): string =>
+    vscode.workspace.getWorkspaceFolder(vscode.Uri.file(dir))?.uri.fsPath ?? dir;
+
+const resolveVariables = (value: string, dir: string): string => {
+    // TODO: other variables, such as ${env:NAME}
+    return value.replaceAll('${workspaceFolder}', workspaceFolderOf(dir));
+}
+
+/**
+ * The variables to add to the environment of go test runs in dir: those
+ * from goAllocations.testEnvFile, overridden by goAllocations.testEnvVars.
+ */
+export const testEnv = (dir: string): Record<string, string> => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const env: Record<string, string> = {};
+
+    const envFile = config.get<string>('testEnvFile', '');
+    if (envFile) {
+        const file = path.resolve(workspaceFolderOf(dir), resolveVariables(envFile, dir));
+        Object.assign(env, parseEnvFile(fs.readFileSync(file, 'utf8')));
+    }
+
+    const vars = config.get<Record<string, string>>('testEnvVars', {});
+    for (const [key, value] of Object.entries(vars)) {
+        env[key] = resolveVariables(String(value), dir);
+    }
+    return env;
+}
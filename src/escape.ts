@@ -0,0 +1,151 @@
+import * as path from 'path';
+import * as os from 'os';
+import { runProcess } from './process';
+
+// What the compiler says with -gcflags=-m about a line, such as "x escapes to heap"
+export interface EscapeFinding {
+    file: string;
+    line: number;
+    column: number;
+    message: string;
+    // Why, from -m=2: the flows that lead to the heap, indented as the compiler does
+    explanation: string[];
+}
+
+// What the compiler says with -gcflags=-m about inlining: of a function, at its declaration, or of a call
+export interface InliningDecision {
+    file: string;
+    line: number;
+    kind: 'inlinable' | 'notInlinable' | 'call';
+    // As the compiler writes it, e.g. F, (*T).M, or strings.(*Builder).WriteString for calls
+    name: string;
+    // Why not, e.g. function too complex: cost 95 exceeds budget 80
+    reason?: string;
+}
+
+// What the compiler says at a call of a function that allocates: whether the call was inlined, and why not
+export interface InliningNote {
+    callee: string;
+    inlined: boolean;
+    reason?: string;
+}
+
+// What the compiler reports for a package with -gcflags=-m=2
+export interface CompilerReport {
+    escapes: EscapeFinding[];
+    inlining: InliningDecision[];
+}
+
+const findingRegex = /^(.+?\.go):(\d+):(\d+): (.*)$/;
+
+// The findings that mean a heap allocation, rather than inlining decisions and the like
+const escapeRegex = /escapes to heap|moved to heap/;
+
+/**
+ * Makes a line of -m=2 reasoning easier to read: ~r0 is the function's
+ * first result, and &{storage for make(...)} is what make allocates.
+ */
+const denoise = (line: string): string =>
+    line
+        .replace(/:$/, '')
+        .replace(/~r(\d+)/g, (_, n: string) => `result ${parseInt(n) + 1}`)
+        .replace(/&\{storage for (.+?)\}/g, '$1')
+        .replace(/ at \.\//g, ' at ');
+
+/**
+ * Parses the compiler's -m output, keeping what escapes to the heap. With
+ * -m=2, the lines explaining why come just before each finding, at the
+ * same position. File names are relative to dir, where go build ran.
+ */
+export const parseEscapes = (output: string, dir: string): EscapeFinding[] => {
+    const findings: EscapeFinding[] = [];
+    let position = '';
+    let explanation: string[] = [];
+    for (const line of output.split('\n')) {
+        const match = line.match(findingRegex);
+        if (!match) {
+            continue;
+        }
+        const [, file, lineNumber, column, message] = match;
+        if (`${file}:${lineNumber}:${column}` !== position) {
+            position = `${file}:${lineNumber}:${column}`;
+            explanation = [];
+        }
+        // e.g. "x escapes to heap in F:", then indented flows
+        if (message.startsWith(' ') || message.endsWith(':')) {
+            explanation.push(denoise(message));
+            continue;
+        }
+        if (!escapeRegex.test(message)) {
+            continue;
+        }
+        findings.push({
+            file: path.resolve(dir, file),
+            line: parseInt(lineNumber),
+            column: parseInt(column),
+            message,
+            explanation
+        });
+        explanation = [];
+    }
+    return findings;
+}
+
+/**
+ * Parses the compiler's -m output for its inlining decisions: which
+ * functions can be inlined, why others can't, and which calls were.
+ */
+export const parseInlining = (output: string, dir: string): InliningDecision[] => {
+    const decisions: InliningDecision[] = [];
+    for (const line of output.split('\n')) {
+        const match = line.match(findingRegex);
+        if (!match) {
+            continue;
+        }
+        const [, file, lineNumber, , message] = match;
+        const at = { file: path.resolve(dir, file), line: parseInt(lineNumber) };
+        const inlinable = message.match(/^can inline (\S+)/);
+        const notInlinable = message.match(/^cannot inline (\S+?): (.*)$/);
+        const call = message.match(/^inlining call to (\S+)/);
+        if (inlinable) {
+            decisions.push({ ...at, kind: 'inlinable', name: inlinable[1] });
+        } else if (notInlinable) {
+            decisions.push({ ...at, kind: 'notInlinable', name: notInlinable[1], reason: notInlinable[2] });
+        } else if (call) {
+            decisions.push({ ...at, kind: 'call', name: call[1] });
+        }
+    }
+    return decisions;
+}
+
+// The compiler flags of -gcflags in build flags, without a package pattern, e.g. -N -l of -gcflags=all=-N -l
+const gcflagsOf = (buildFlags: string[]): string[] => {
+    const values: string[] = [];
+    buildFlags.forEach((flag, i) => {
+        const match = flag.match(/^--?gcflags(?:=(.*))?$/);
+        const value = match && (match[1] ?? buildFlags[i + 1]);
+        if (value) {
+            values.push(value.replace(/^[^\s=-][^\s=]*=/, ''));
+        }
+    });
+    return values;
+}
+
+/**
+ * Runs escape analysis on the package in dir, with its test files, as the
+ * benchmark's test binary is built: go test -c with the build flags and
+ * -gcflags=-m=2, which reports on stderr. Returns what escapes to the heap
+ * and why, and what the compiler inlined.
+ */
+export const escapeAnalysis = async (
+    go: string,
+    dir: string,
+    buildFlags: string[],
+    env: NodeJS.ProcessEnv,
+    signal: AbortSignal
+): Promise<CompilerReport> => {
+    // Last, so it's the -gcflags for the package, with the compiler flags it would have had
+    const gcflags = `-gcflags=${[...gcflagsOf(buildFlags), '-m=2'].join(' ')}`;
+    const { stderr } = await runProcess(go, ['test', '-c', '-o', os.devNull, ...buildFlags, gcflags, '.'], { cwd: dir, env, signal });
+    return { escapes: parseEscapes(stderr, dir), inlining: parseInlining(stderr, dir) };
+}
@@ -1,37 +1,109 @@
 import * as vscode from 'vscode';
-import { TreeDataProvider, Item, BenchmarkItem } from './treedata';
-import { CodeLensProvider } from './codelens';
+import * as path from 'path';
+import { TreeDataProvider, Item, BenchmarkItem, AllocationItem, SiteAllocation, benchtimeRegex, parseFlags, parseRuntimeEnv, runtimeEnvKeys, allocationView, parseThreshold, parseLabelFilter } from './treedata';
+import { quote } from 'shell-quote';
+import { findToolchains, goCommand } from './env';
+import { CodeLensProvider, FunctionCodeLensProvider } from './codelens';
+import { HeatmapDecorations, InlineAnnotations, DimDecorations, LineAnchors } from './decorations';
+import { AllocationHoverProvider } from './hover';
+import { AllocationCodeActions } from './codeactions';
+import { allocationTest } from './allocationtest';
+import { showWeblist } from './weblist';
+import { showFlameGraph } from './flamegraph';
+import { RunStatusBar } from './statusbar';
+import { StacksPanel } from './stackspanel';
+import { formatBytes } from './profile';
+import { enclosingBenchmark } from './discovery';
 import { DocumentFilter } from 'vscode';
 
+// A command handler, or the like, that shows what it throws as an error message
+const runCommand = <A extends unknown[]>(fn: (...args: A) => unknown) => async (...args: A): Promise<void> => {
+    try {
+        await fn(...args);
+    } catch (err) {
+        vscode.window.showErrorMessage(`${err}`);
+    }
+}
+
+/**
+ * Changes a goAllocations setting where it takes effect: in the workspace,
+ * if it's set there, as that wins over the user's setting.
+ */
+const updateSetting = (key: string, value: unknown): Thenable<void> => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    const target = config.inspect(key)?.workspaceValue !== undefined ? vscode.ConfigurationTarget.Workspace : vscode.ConfigurationTarget.Global;
+    return config.update(key, value, target);
+}
+
 export async function activate(context: vscode.ExtensionContext) {
-    const treeData = new TreeDataProvider();
+    const treeData = new TreeDataProvider(context.workspaceState, context.storageUri?.fsPath);
+
+    // As runCommand, for commands that run benchmarks, whose cancelling is no error
+    const runBenchmarks = <A extends unknown[]>(fn: (...args: A) => unknown) => async (...args: A): Promise<void> => {
+        const signal = treeData.abortSignal();
+        try {
+            await fn(...args);
+        } catch (err) {
+            if (signal.aborted) {
+                vscode.window.showInformationMessage('Benchmark operation cancelled');
+            } else {
+                vscode.window.showErrorMessage(`${err}`);
+            }
+        }
+    }
 
     const options: vscode.TreeViewOptions<Item> = {
         treeDataProvider: treeData,
-        showCollapseAll: true
+        showCollapseAll: true,
+        canSelectMany: true
     }
+
     const treeView = vscode.window.createTreeView<Item>('goAllocationsExplorer', options);
     context.subscriptions.push(treeView);
+    treeData.setTreeView(treeView);
+
+    // Compile errors and panics from runs
+    const diagnostics = vscode.languages.createDiagnosticCollection('goAllocations');
+    context.subscriptions.push(diagnostics);
+    treeData.setDiagnostics(diagnostics);
+
+    // What escapes to the heap, from escape analysis
+    const escapeDiagnostics = vscode.languages.createDiagnosticCollection('goAllocations.escape');
+    context.subscriptions.push(escapeDiagnostics);
+    treeData.setEscapeDiagnostics(escapeDiagnostics);
+
+    // The stacks of the allocation selected, or at the cursor, in the panel
+    const stacksPanel = new StacksPanel(treeData);
+    const stacksView = vscode.window.createTreeView<Item>('goAllocationsStacks', { treeDataProvider: stacksPanel, showCollapseAll: true });
+    context.subscriptions.push(stacksView);
+    stacksPanel.setTreeView(stacksView);
+    stacksView.onDidChangeSelection(runCommand((e: vscode.TreeViewSelectionChangeEvent<Item>) => treeData.handleSelection(e)));
+    // Not when a frame clicked moves the cursor, which would replace the stacks it's in
+    context.subscriptions.push(vscode.window.onDidChangeTextEditorSelection(e => {
+        if (e.kind === vscode.TextEditorSelectionChangeKind.Command || e.kind === undefined ||
+            e.textEditor.document.languageId !== 'go' || e.textEditor.document.uri.scheme !== 'file') {
+            return;
+        }
+        const [top] = treeData.allocationsAt(e.textEditor.document.uri.fsPath, e.selections[0].active.line + 1);
+        if (top) {
+            stacksPanel.show(top.allocation);
+        }
+    }));
 
     // Handle clicks on allocation lines
-    treeView.onDidChangeSelection(async (e) => {
+    treeView.onDidChangeSelection(runCommand(async (e: vscode.TreeViewSelectionChangeEvent<Item>) => {
+        if (e.selection.length === 1 && e.selection[0] instanceof AllocationItem) {
+            stacksPanel.show(e.selection[0]);
+        }
         await treeData.handleSelection(e);
-    });
+    }));
 
     // Register commands
     const runAllBenchmarks = vscode.commands.registerCommand(
         'goAllocations.runAllBenchmarks',
-        async () => {
-            try {
-                await treeData.runAllBenchmarks(treeView);
-            } catch (err) {
-                if (treeData.abortSignal().aborted) {
-                    vscode.window.showInformationMessage('Operation(s) cancelled');
-                } else {
-                    vscode.window.showErrorMessage(`${err}`);
-                }
-            }
-        });
+        runBenchmarks(async () => {
+            await treeData.runAllBenchmarks();
+        }));
     context.subscriptions.push(runAllBenchmarks);
 
     const stopAllBenchmarks = vscode.commands.registerCommand(
@@ -40,24 +112,587 @@ export async function activate(context: vscode.ExtensionContext) {
     );
     context.subscriptions.push(stopAllBenchmarks);
 
+    // With several items selected, context menu commands get them all as the second argument
+    const selectedBenchmarks = (item: BenchmarkItem, selected?: Item[]): BenchmarkItem[] =>
+        selected ? selected.filter((s): s is BenchmarkItem => s instanceof BenchmarkItem) : [item];
+
+    const stopBenchmark = vscode.commands.registerCommand(
+        'goAllocations.stopBenchmark',
+        (benchmarkItem: BenchmarkItem, selected?: Item[]) => {
+            const running = selectedBenchmarks(benchmarkItem, selected).filter(b => b.running);
+            if (running.length === 0) {
+                vscode.window.showInformationMessage(`${benchmarkItem.fullName} is not running`);
+                return;
+            }
+            running.forEach(b => b.cancel());
+        }
+    );
+    context.subscriptions.push(stopBenchmark);
+
     const runSingleBenchmark = vscode.commands.registerCommand(
         'goAllocations.runSingleBenchmark',
-        async (benchmarkItem: BenchmarkItem) => {
-            const signal = treeData.abortSignal();
+        runBenchmarks(async (benchmarkItem: BenchmarkItem, selected?: Item[]) => {
+            await treeData.runSelected(selectedBenchmarks(benchmarkItem, selected));
+        }));
+    context.subscriptions.push(runSingleBenchmark);
 
-            try {
-                treeData.clearBenchmarkRunState(benchmarkItem);
-                await treeView.reveal(benchmarkItem, { expand: true });
-            } catch (err) {
-                if (signal.aborted) {
-                    vscode.window.showInformationMessage('Benchmark operation cancelled');
-                } else {
-                    vscode.window.showErrorMessage(`${err}`);
+    // Runs every benchmark in a package or module, through the queue
+    const runBeneath = vscode.commands.registerCommand(
+        'goAllocations.runBeneath',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item]);
+        }));
+    context.subscriptions.push(runBeneath);
+
+    const rerunLast = vscode.commands.registerCommand(
+        'goAllocations.rerunLast',
+        runBenchmarks(async () => {
+            await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+            await treeData.rerunLast();
+        }));
+    context.subscriptions.push(rerunLast);
+
+    // Watch mode: saving a file re-runs the pinned benchmarks in its package
+    const togglePin = vscode.commands.registerCommand(
+        'goAllocations.togglePin',
+        (benchmarkItem: BenchmarkItem, selected?: Item[]) =>
+            selectedBenchmarks(benchmarkItem, selected).forEach(b => treeData.togglePin(b))
+    );
+    context.subscriptions.push(togglePin);
+
+    const setBaseline = vscode.commands.registerCommand(
+        'goAllocations.setBaseline',
+        runCommand((benchmarkItem: BenchmarkItem, selected?: Item[]) => {
+            selectedBenchmarks(benchmarkItem, selected).forEach(b => treeData.setBaseline(b));
+        })
+    );
+    context.subscriptions.push(setBaseline);
+
+    const clearBaseline = vscode.commands.registerCommand(
+        'goAllocations.clearBaseline',
+        (benchmarkItem: BenchmarkItem, selected?: Item[]) =>
+            selectedBenchmarks(benchmarkItem, selected).forEach(b => treeData.clearBaseline(b))
+    );
+    context.subscriptions.push(clearBaseline);
+
+    const toggleWarmup = vscode.commands.registerCommand(
+        'goAllocations.toggleWarmup',
+        (benchmarkItem: BenchmarkItem, selected?: Item[]) =>
+            selectedBenchmarks(benchmarkItem, selected).forEach(b => treeData.toggleWarmup(b))
+    );
+    context.subscriptions.push(toggleWarmup);
+
+    const updateWatching = (enabled: boolean) => {
+        watching = enabled;
+        treeData.setWatching(enabled);
+        vscode.commands.executeCommand('setContext', 'goAllocations.watching', enabled);
+        updateDescription();
+    };
+
+    const startWatching = vscode.commands.registerCommand(
+        'goAllocations.startWatching',
+        () => updateWatching(true)
+    );
+    context.subscriptions.push(startWatching);
+
+    const stopWatching = vscode.commands.registerCommand(
+        'goAllocations.stopWatching',
+        () => updateWatching(false)
+    );
+    context.subscriptions.push(stopWatching);
+
+    const saveListener = vscode.workspace.onDidSaveTextDocument(document => {
+        if (document.uri.scheme !== 'file' || document.languageId !== 'go') {
+            return;
+        }
+        treeData.runPinned(document.uri).catch(err => {
+            console.error('Watch mode run failed:', err);
+        });
+    });
+    context.subscriptions.push(saveListener);
+
+    // Edits after a run can move the lines the results point at
+    const staleListener = vscode.workspace.onDidChangeTextDocument(e => {
+        if (e.document.uri.scheme === 'file' && e.document.languageId === 'go' && e.contentChanges.length > 0) {
+            treeData.markStale(e.document.uri);
+        }
+    });
+    context.subscriptions.push(staleListener);
+
+    // Queued runs can be cancelled or moved before they start
+    const cancelQueued = vscode.commands.registerCommand(
+        'goAllocations.cancelQueued',
+        (benchmarkItem: BenchmarkItem, selected?: Item[]) =>
+            selectedBenchmarks(benchmarkItem, selected).forEach(b => treeData.cancelQueued(b))
+    );
+    context.subscriptions.push(cancelQueued);
+
+    const moveQueuedUp = vscode.commands.registerCommand(
+        'goAllocations.moveQueuedUp',
+        (benchmarkItem: BenchmarkItem) => treeData.moveQueued(benchmarkItem, -1)
+    );
+    context.subscriptions.push(moveQueuedUp);
+
+    const moveQueuedDown = vscode.commands.registerCommand(
+        'goAllocations.moveQueuedDown',
+        (benchmarkItem: BenchmarkItem) => treeData.moveQueued(benchmarkItem, 1)
+    );
+    context.subscriptions.push(moveQueuedDown);
+
+    const runWithBenchtime = vscode.commands.registerCommand(
+        'goAllocations.runWithBenchtime',
+        runBenchmarks(async (benchmarkItem: BenchmarkItem, selected?: Item[]) => {
+            const configured = vscode.workspace.getConfiguration('goAllocations').get<string>('benchtime', '');
+            const benchtime = await vscode.window.showInputBox({
+                title: `Run ${benchmarkItem.fullName}`,
+                prompt: 'Benchmark time, such as 100ms, 2s, or 1000x',
+                value: configured || '1s',
+                validateInput: value => benchtimeRegex.test(value.trim()) ? undefined : 'Expected a duration like 500ms or a count like 100x'
+            });
+            if (benchtime === undefined) {
+                return; // Dismissed
+            }
+
+            await treeData.runSelected(selectedBenchmarks(benchmarkItem, selected), { benchtime: benchtime.trim() });
+        }));
+    context.subscriptions.push(runWithBenchtime);
+
+    // A one-off run of a benchmark or package, with flags edited from the defaults
+    const runWithFlags = vscode.commands.registerCommand(
+        'goAllocations.runWithFlags',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            const defaults = quote(treeData.defaultFlags(item));
+            const input = await vscode.window.showInputBox({
+                title: `Run ${item.label} with flags`,
+                prompt: 'go test flags; -bench and -memprofile are added',
+                value: defaults,
+                valueSelection: [defaults.length, defaults.length],
+                validateInput: value => {
+                    try {
+                        parseFlags(value);
+                        return undefined;
+                    } catch (err) {
+                        return err instanceof Error ? err.message : String(err);
+                    }
                 }
+            });
+            if (input === undefined) {
+                return; // Dismissed
+            }
+
+            await treeData.runSelected(selected ?? [item], { flags: parseFlags(input) });
+        }));
+    context.subscriptions.push(runWithFlags);
+
+    const runSelected = vscode.commands.registerCommand(
+        'goAllocations.runSelected',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item]);
+        }));
+    context.subscriptions.push(runSelected);
+
+    // A one-off run with -memprofilerate=1, slower but without sampling
+    const runExact = vscode.commands.registerCommand(
+        'goAllocations.runExact',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item], { exact: true });
+        }));
+    context.subscriptions.push(runExact);
+
+    const runShort = vscode.commands.registerCommand(
+        'goAllocations.runShort',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item], { short: true });
+        }));
+    context.subscriptions.push(runShort);
+
+    // Another run, its profile merged with those behind the current results
+    const runMerged = vscode.commands.registerCommand(
+        'goAllocations.runMerged',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item], { merge: true });
+        }));
+    context.subscriptions.push(runMerged);
+
+    const runWithRace = vscode.commands.registerCommand(
+        'goAllocations.runWithRace',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item], { race: true });
+        }));
+    context.subscriptions.push(runWithRace);
+
+    // A one-off run with GOGC, GOMEMLIMIT or GODEBUG set
+    const runWithRuntimeEnv = vscode.commands.registerCommand(
+        'goAllocations.runWithRuntimeEnv',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            const input = await vscode.window.showInputBox({
+                title: `Run ${item.label} with runtime variables`,
+                prompt: `${runtimeEnvKeys.join(', ')}, e.g. GOGC=off`,
+                placeHolder: 'GOGC=off GODEBUG=madvdontneed=1',
+                validateInput: value => {
+                    try {
+                        parseRuntimeEnv(value);
+                        return undefined;
+                    } catch (err) {
+                        return err instanceof Error ? err.message : String(err);
+                    }
+                }
+            });
+            if (input === undefined) {
+                return; // Dismissed
+            }
+
+            await treeData.runSelected(selected ?? [item], { env: parseRuntimeEnv(input) });
+        }));
+    context.subscriptions.push(runWithRuntimeEnv);
+
+    // Runs with and without a GOEXPERIMENT, to compare
+    const runWithExperiment = vscode.commands.registerCommand(
+        'goAllocations.runWithExperiment',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            const input = await vscode.window.showInputBox({
+                title: `Run ${item.label} with GOEXPERIMENT`,
+                prompt: 'Comma-separated experiments; the benchmark also runs without them, to compare',
+                placeHolder: 'arenas',
+                validateInput: value => /^\w+(,\w+)*$/.test(value.trim())
+                    ? undefined
+                    : 'Expected experiment names separated by commas, e.g. arenas,newinliner'
+            });
+            if (input === undefined) {
+                return; // Dismissed
+            }
+
+            await treeData.runSelected(selected ?? [item], { experiment: input.trim() });
+        }));
+    context.subscriptions.push(runWithExperiment);
+
+    const runUntilStable = vscode.commands.registerCommand(
+        'goAllocations.runUntilStable',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            await treeData.runSelected(selected ?? [item], { untilStable: true });
+        }));
+    context.subscriptions.push(runUntilStable);
+
+    // A one-off run with another Go toolchain, such as one from golang.org/dl
+    const runWithToolchain = vscode.commands.registerCommand(
+        'goAllocations.runWithToolchain',
+        runBenchmarks(async (item: Item, selected?: Item[]) => {
+            const toolchains = await findToolchains(treeData.abortSignal());
+            const picks: (vscode.QuickPickItem & { go?: string })[] = [
+                { label: path.basename(goCommand()), description: 'default', go: goCommand() },
+                ...toolchains.map(go => ({ label: path.basename(go), description: path.dirname(go), go })),
+                { label: 'Other...', description: 'Path to a go executable' }
+            ];
+            const picked = await vscode.window.showQuickPick(picks, {
+                title: `Run ${item.label} with toolchain`,
+                placeHolder: 'Toolchains installed with golang.org/dl are listed'
+            });
+            if (!picked) {
+                return; // Dismissed
+            }
+
+            const go = picked.go ?? await vscode.window.showInputBox({
+                title: `Run ${item.label} with toolchain`,
+                prompt: 'Path to a go executable'
+            });
+            if (!go) {
+                return;
+            }
+
+            await treeData.runSelected(selected ?? [item], { goExecutable: go });
+        }));
+    context.subscriptions.push(runWithToolchain);
+
+    // The view description summarizes what the tree leaves out
+    let currentFileScope = false;
+    let watching = false;
+    const updateDescription = () => {
+        const parts: string[] = [];
+        if (watching) {
+            parts.push('Watching');
+        }
+        if (currentFileScope) {
+            parts.push('Current file');
+        }
+        const hidden = treeData.hiddenPackageCount();
+        if (hidden > 0) {
+            parts.push(`${hidden} empty ${hidden === 1 ? 'package' : 'packages'} hidden`);
+        }
+        treeView.description = parts.length > 0 ? parts.join(', ') : undefined;
+    };
+    context.subscriptions.push(treeData.onDidChangeTreeData(updateDescription));
+
+    // Scope the tree to the active editor's file, following it as editors change
+    const updateScope = (enabled: boolean) => {
+        currentFileScope = enabled;
+        treeData.setCurrentFileScope(enabled, vscode.window.activeTextEditor);
+        vscode.commands.executeCommand('setContext', 'goAllocations.currentFileScope', enabled);
+    };
+
+    const showCurrentFile = vscode.commands.registerCommand(
+        'goAllocations.showCurrentFile',
+        () => updateScope(true)
+    );
+    context.subscriptions.push(showCurrentFile);
+
+    const showAllBenchmarks = vscode.commands.registerCommand(
+        'goAllocations.showAllBenchmarks',
+        () => updateScope(false)
+    );
+    context.subscriptions.push(showAllBenchmarks);
+
+    // Hide or show packages with test files but no benchmarks
+    const updateHideEmptyPackages = () => {
+        const hide = vscode.workspace.getConfiguration('goAllocations').get<boolean>('hideEmptyPackages', true);
+        treeData.setHideEmptyPackages(hide);
+        vscode.commands.executeCommand('setContext', 'goAllocations.hideEmptyPackages', hide);
+    };
+    updateHideEmptyPackages();
+
+    const hideEmptyPackages = vscode.commands.registerCommand(
+        'goAllocations.hideEmptyPackages',
+        () => updateSetting('hideEmptyPackages', true)
+    );
+    context.subscriptions.push(hideEmptyPackages);
+
+    const selectSampleType = vscode.commands.registerCommand(
+        'goAllocations.selectSampleType',
+        async () => {
+            const config = vscode.workspace.getConfiguration('goAllocations');
+            const current = config.get<string>('sampleType', 'alloc_space');
+            const choices: (vscode.QuickPickItem & { sampleType: string })[] = [
+                { sampleType: 'alloc_space', label: 'Allocated bytes', description: 'alloc_space' },
+                { sampleType: 'alloc_objects', label: 'Allocated objects', description: 'alloc_objects' },
+                { sampleType: 'inuse_space', label: 'In-use bytes', description: 'inuse_space, at the end of the run' },
+                { sampleType: 'inuse_objects', label: 'In-use objects', description: 'inuse_objects, at the end of the run' }
+            ];
+            for (const choice of choices) {
+                choice.picked = choice.sampleType === current;
+            }
+            const picked = await vscode.window.showQuickPick(choices, { title: 'Show allocations as' });
+            if (picked) {
+                await updateSetting('sampleType', picked.sampleType);
             }
-            // Note: We don't need a finally block to clean up - the manager handles lifecycle
         });
-    context.subscriptions.push(runSingleBenchmark);
+    context.subscriptions.push(selectSampleType);
+
+    const showFlat = vscode.commands.registerCommand(
+        'goAllocations.showFlat',
+        () => updateSetting('attribution', 'flat')
+    );
+    context.subscriptions.push(showFlat);
+
+    const showCumulative = vscode.commands.registerCommand(
+        'goAllocations.showCumulative',
+        () => updateSetting('attribution', 'cumulative')
+    );
+    context.subscriptions.push(showCumulative);
+
+    const groupByFunction = vscode.commands.registerCommand(
+        'goAllocations.groupByFunction',
+        () => updateSetting('groupBy', 'function')
+    );
+    context.subscriptions.push(groupByFunction);
+
+    const groupByLine = vscode.commands.registerCommand(
+        'goAllocations.groupByLine',
+        () => updateSetting('groupBy', 'line')
+    );
+    context.subscriptions.push(groupByLine);
+
+    const groupByPackage = vscode.commands.registerCommand(
+        'goAllocations.groupByPackage',
+        () => updateSetting('groupBy', 'package')
+    );
+    context.subscriptions.push(groupByPackage);
+
+    const hideExternalFrames = vscode.commands.registerCommand(
+        'goAllocations.hideExternalFrames',
+        () => updateSetting('hideExternalFrames', true)
+    );
+    context.subscriptions.push(hideExternalFrames);
+
+    const showExternalFrames = vscode.commands.registerCommand(
+        'goAllocations.showExternalFrames',
+        () => updateSetting('hideExternalFrames', false)
+    );
+    context.subscriptions.push(showExternalFrames);
+
+    // As pprof -focus and -ignore, applied to the profiles already in hand
+    const filterCommand = (setting: 'focus' | 'ignore', prompt: string) => async () => {
+        const config = vscode.workspace.getConfiguration('goAllocations');
+        const value = await vscode.window.showInputBox({
+            prompt,
+            value: config.get<string>(setting, ''),
+            placeHolder: 'e.g. strconv|json',
+            validateInput: input => {
+                try {
+                    new RegExp(input);
+                    return undefined;
+                } catch (err) {
+                    return `Invalid regular expression: ${err}`;
+                }
+            }
+        });
+        if (value === undefined) {
+            return;
+        }
+        await updateSetting(setting, value);
+    };
+
+    const peekStack = vscode.commands.registerCommand(
+        'goAllocations.peekStack',
+        runCommand(async (item: AllocationItem) => {
+            await item.peekStack(allocationView());
+        })
+    );
+    context.subscriptions.push(peekStack);
+
+    const weblist = vscode.commands.registerCommand(
+        'goAllocations.showWeblist',
+        runCommand((item: AllocationItem) => {
+            const { source, function: fn } = item.allocationData;
+            // TODO: profiles without start lines, which show from the site down
+            showWeblist(source.profile, fn.name, item.filePath, fn.startLine || item.lineNumber);
+        })
+    );
+    context.subscriptions.push(weblist);
+
+    // Disassembly opens read-only, from what the command put here
+    const disassemblies = new Map<string, string>();
+    context.subscriptions.push(vscode.workspace.registerTextDocumentContentProvider('go-allocations-disasm', {
+        provideTextDocumentContent: uri => disassemblies.get(uri.toString())
+    }));
+    let disassemblyCount = 0;
+
+    const showDisassembly = vscode.commands.registerCommand(
+        'goAllocations.showDisassembly',
+        runCommand(async (item: AllocationItem) => {
+            const content = await vscode.window.withProgress(
+                { location: vscode.ProgressLocation.Window, title: 'Disassembling' },
+                () => treeData.disassembly(item)
+            );
+            const uri = vscode.Uri.from({
+                scheme: 'go-allocations-disasm',
+                path: `/${path.basename(item.filePath)}-${item.lineNumber}.s`,
+                query: `${disassemblyCount++}`
+            });
+            disassemblies.set(uri.toString(), content);
+            const document = await vscode.workspace.openTextDocument(uri);
+            await vscode.window.showTextDocument(document, { viewColumn: vscode.ViewColumn.Beside, preview: true });
+        })
+    );
+    context.subscriptions.push(showDisassembly);
+    context.subscriptions.push(vscode.workspace.onDidCloseTextDocument(document => disassemblies.delete(document.uri.toString())));
+
+    const flameGraph = vscode.commands.registerCommand(
+        'goAllocations.showFlameGraph',
+        runCommand((item: BenchmarkItem) => {
+            const { profile, index, resolvePath } = treeData.flameGraphSource(item);
+            showFlameGraph(item.label as string, profile, index, resolvePath);
+        })
+    );
+    context.subscriptions.push(flameGraph);
+
+    const setFocus = vscode.commands.registerCommand(
+        'goAllocations.setFocus',
+        filterCommand('focus', 'Show only allocations in stacks through a function matching this regular expression, empty for all')
+    );
+    context.subscriptions.push(setFocus);
+
+    const setIgnore = vscode.commands.registerCommand(
+        'goAllocations.setIgnore',
+        filterCommand('ignore', 'Hide allocations in stacks through a function matching this regular expression, empty for none')
+    );
+    context.subscriptions.push(setIgnore);
+
+    const clearFilters = vscode.commands.registerCommand(
+        'goAllocations.clearFilters',
+        async () => {
+            await updateSetting('focus', '');
+            await updateSetting('ignore', '');
+            await updateSetting('labelFilter', '');
+        }
+    );
+    context.subscriptions.push(clearFilters);
+
+    const setThreshold = vscode.commands.registerCommand(
+        'goAllocations.setThreshold',
+        async () => {
+            const config = vscode.workspace.getConfiguration('goAllocations');
+            const value = await vscode.window.showInputBox({
+                prompt: 'Fold allocation sites below a size, count, or percentage of the total into one item, empty for none',
+                value: config.get<string>('threshold', ''),
+                placeHolder: 'e.g. 4kB or 1%',
+                validateInput: input => {
+                    try {
+                        parseThreshold(input);
+                        return undefined;
+                    } catch (err) {
+                        return err instanceof Error ? err.message : String(err);
+                    }
+                }
+            });
+            if (value === undefined) {
+                return;
+            }
+            await updateSetting('threshold', value.trim());
+        }
+    );
+    context.subscriptions.push(setThreshold);
+
+    const setLabelFilter = vscode.commands.registerCommand(
+        'goAllocations.setLabelFilter',
+        async () => {
+            const config = vscode.workspace.getConfiguration('goAllocations');
+            const value = await vscode.window.showInputBox({
+                prompt: 'Show only allocations in samples with a label, as key=value or key, empty for all',
+                value: config.get<string>('labelFilter', ''),
+                placeHolder: 'e.g. phase=parse',
+                validateInput: input => {
+                    try {
+                        parseLabelFilter(input);
+                        return undefined;
+                    } catch (err) {
+                        return err instanceof Error ? err.message : String(err);
+                    }
+                }
+            });
+            if (value === undefined) {
+                return;
+            }
+            await updateSetting('labelFilter', value.trim());
+        }
+    );
+    context.subscriptions.push(setLabelFilter);
+
+    const groupByLabel = vscode.commands.registerCommand(
+        'goAllocations.groupByLabel',
+        async () => {
+            const keys = treeData.labelKeys();
+            const key = keys.length > 0
+                ? await vscode.window.showQuickPick(keys, { placeHolder: 'Group allocations by the values of a label' })
+                : await vscode.window.showInputBox({ prompt: 'No results have labels yet. Label key to group allocations by', placeHolder: 'e.g. phase' });
+            if (!key) {
+                return;
+            }
+            await updateSetting('labelKey', key);
+            await updateSetting('groupBy', 'label');
+        }
+    );
+    context.subscriptions.push(groupByLabel);
+
+    const showEmptyPackages = vscode.commands.registerCommand(
+        'goAllocations.showEmptyPackages',
+        () => updateSetting('hideEmptyPackages', false)
+    );
+    context.subscriptions.push(showEmptyPackages);
+
+    const activeEditorListener = vscode.window.onDidChangeActiveTextEditor(
+        (editor) => treeData.setActiveEditor(editor)
+    );
+    context.subscriptions.push(activeEditorListener);
+    treeData.setActiveEditor(vscode.window.activeTextEditor);
 
     const refresh = vscode.commands.registerCommand(
         'goAllocations.refresh',
@@ -65,18 +700,222 @@ export async function activate(context: vscode.ExtensionContext) {
     );
     context.subscriptions.push(refresh);
 
+    // Multi-root workspaces: discover added folders, drop removed ones
+    const workspaceFoldersListener = vscode.workspace.onDidChangeWorkspaceFolders(
+        (e) => treeData.updateWorkspaceFolders(e)
+    );
+    context.subscriptions.push(workspaceFoldersListener);
+
+    // Pick up added, changed and deleted benchmarks without a full refresh
+    const testFileWatcher = vscode.workspace.createFileSystemWatcher('**/*_test.go');
+    testFileWatcher.onDidCreate(uri => treeData.updatePackage(uri));
+    testFileWatcher.onDidChange(uri => treeData.updatePackage(uri));
+    testFileWatcher.onDidDelete(uri => treeData.updatePackage(uri));
+    context.subscriptions.push(testFileWatcher);
+
+    // Reflect unsaved edits to test files, as gopls does with overlays
+    const isTestFile = (document: vscode.TextDocument) =>
+        document.uri.scheme === 'file' && document.fileName.endsWith('_test.go');
+    const documentChangeListener = vscode.workspace.onDidChangeTextDocument((e) => {
+        if (isTestFile(e.document) && e.contentChanges.length > 0) {
+            treeData.scheduleUpdatePackage(e.document.uri);
+        }
+    });
+    context.subscriptions.push(documentChangeListener);
+
+    // Closing without saving discards the overlay
+    const documentCloseListener = vscode.workspace.onDidCloseTextDocument((document) => {
+        if (isTestFile(document)) {
+            treeData.scheduleUpdatePackage(document.uri);
+        }
+    });
+    context.subscriptions.push(documentCloseListener);
+
     const codeLensFilter: DocumentFilter = { language: 'go', scheme: 'file', pattern: '**/*_test.go' };
-    const codeLensProvider = new CodeLensProvider();
+    const codeLensProvider = new CodeLensProvider((packageDir, benchmarkName) => treeData.lastResult(packageDir, benchmarkName));
+    const functionCodeLensProvider = new FunctionCodeLensProvider(filePath => treeData.functionsIn(filePath));
+    context.subscriptions.push(treeData.onDidFinishRun(() => {
+        codeLensProvider.refresh();
+        functionCodeLensProvider.refresh();
+    }));
+
+    // Allocating lines in the editor, from the results in the tree
+    // Decorations follow their lines through edits, and fade when theirs is edited
+    const anchors = new LineAnchors();
+    const heatmap = new HeatmapDecorations(() => treeData.decoratedAllocations(), anchors);
+    const annotations = new InlineAnnotations(() => treeData.decoratedAllocations(), anchors, (filePath, lineNumber) => treeData.inliningAt(filePath, lineNumber));
+    const dim = new DimDecorations(() => treeData.decoratedAllocations(), anchors);
+    const decorations = [heatmap, annotations, dim];
+    context.subscriptions.push(...decorations);
+    context.subscriptions.push(treeData.onDidChangeTreeData(() => decorations.forEach(d => d.update())));
+    context.subscriptions.push(vscode.window.onDidChangeVisibleTextEditors(() => decorations.forEach(d => d.update())));
+    // Edits are recorded as they come, and redecorated once typing pauses
+    let redecorate: NodeJS.Timeout | undefined;
+    context.subscriptions.push(vscode.workspace.onDidChangeTextDocument(e => {
+        if (e.document.uri.scheme === 'file' && e.document.languageId === 'go' && e.contentChanges.length > 0) {
+            anchors.record(e);
+            clearTimeout(redecorate);
+            redecorate = setTimeout(() => decorations.forEach(d => d.update()), 100);
+        }
+    }));
+    context.subscriptions.push({ dispose: () => clearTimeout(redecorate) });
+    // A cleared editor shows the next run's results
+    context.subscriptions.push(treeData.onDidFinishRun(() => {
+        anchors.forgetBefore(treeData.oldestFinishedAt() ?? Date.now());
+        decorations.forEach(d => d.show());
+    }));
+
+    const clearAnnotations = vscode.commands.registerCommand(
+        'goAllocations.clearAnnotations',
+        () => decorations.forEach(d => d.clear())
+    );
+    context.subscriptions.push(clearAnnotations);
+
+    const statusBar = new RunStatusBar(item => treeData.headline(item));
+    context.subscriptions.push(statusBar);
+    context.subscriptions.push(treeData.onDidFinishRun(item => statusBar.show(item)));
+
+    const statusBarMenu = vscode.commands.registerCommand(
+        'goAllocations.statusBarMenu',
+        runCommand(async () => {
+            const benchmark = statusBar.benchmark;
+            if (!benchmark) {
+                return;
+            }
+            const hidden = heatmap.hidden;
+            const actions = [
+                { label: '$(play) Run again', action: () => treeData.runWith(benchmark) },
+                {
+                    label: '$(list-tree) Show in tree',
+                    action: async () => {
+                        await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+                        // Don't expand the benchmark itself, that would run it
+                        await treeView.reveal(benchmark, { select: true, focus: true, expand: false });
+                    }
+                },
+                {
+                    label: hidden ? '$(eye) Show allocation decorations' : '$(eye-closed) Hide allocation decorations',
+                    action: async () => decorations.forEach(d => hidden ? d.show() : d.clear())
+                }
+            ];
+            const picked = await vscode.window.showQuickPick(actions, { placeHolder: benchmark.fullName });
+            await picked?.action();
+        })
+    );
+    context.subscriptions.push(statusBarMenu);
+
+    const hover = vscode.languages.registerHoverProvider(
+        { language: 'go', scheme: 'file' },
+        new AllocationHoverProvider(
+            (filePath, lineNumber) => treeData.allocationsAt(filePath, lineNumber),
+            (filePath, lineNumber) => treeData.escapesAt(filePath, lineNumber),
+            (filePath, lineNumber) => treeData.inliningAt(filePath, lineNumber)
+        )
+    );
+    context.subscriptions.push(hover);
+
+    const codeActions = vscode.languages.registerCodeActionsProvider(
+        { language: 'go', scheme: 'file' },
+        new AllocationCodeActions(
+            (filePath, lineNumber) => treeData.allocationsAt(filePath, lineNumber),
+            (filePath, lineNumber) => treeData.escapesAt(filePath, lineNumber)
+        ),
+        { providedCodeActionKinds: AllocationCodeActions.providedCodeActionKinds }
+    );
+    context.subscriptions.push(codeActions);
+
+    const showEscapeAnalysis = vscode.commands.registerCommand(
+        'goAllocations.showEscapeAnalysis',
+        runCommand(async (item?: Item) => {
+            const count = await vscode.window.withProgress(
+                { location: vscode.ProgressLocation.Window, title: 'Running escape analysis' },
+                () => treeData.showEscapeAnalysis(item)
+            );
+            vscode.window.showInformationMessage(`Escape analysis: ${count} ${count === 1 ? 'value escapes' : 'values escape'} to the heap, see the Problems panel`);
+        }));
+    context.subscriptions.push(showEscapeAnalysis);
+
+    const toggleHeatmap = vscode.commands.registerCommand(
+        'goAllocations.toggleHeatmap',
+        () => {
+            const config = vscode.workspace.getConfiguration('goAllocations');
+            return updateSetting('heatmap', !config.get<boolean>('heatmap', true));
+        }
+    );
+    context.subscriptions.push(toggleHeatmap);
+
+    const toggleDimNonAllocating = vscode.commands.registerCommand(
+        'goAllocations.toggleDimNonAllocating',
+        () => {
+            const config = vscode.workspace.getConfiguration('goAllocations');
+            return updateSetting('dimNonAllocating', !config.get<boolean>('dimNonAllocating', false));
+        }
+    );
+    context.subscriptions.push(toggleDimNonAllocating);
+
+    const toggleInlineAnnotations = vscode.commands.registerCommand(
+        'goAllocations.toggleInlineAnnotations',
+        () => {
+            const editor = vscode.window.activeTextEditor;
+            if (!editor) {
+                throw new Error('No active editor.');
+            }
+            annotations.toggle(editor);
+        }
+    );
+    context.subscriptions.push(toggleInlineAnnotations);
     const codeLens = vscode.languages.registerCodeLensProvider(
         codeLensFilter,
         codeLensProvider
     );
     context.subscriptions.push(codeLens);
+    const functionCodeLens = vscode.languages.registerCodeLensProvider(
+        { language: 'go', scheme: 'file' },
+        functionCodeLensProvider
+    );
+    context.subscriptions.push(functionCodeLens);
 
-    // Listen for configuration changes to refresh code lenses
+    // Listen for configuration changes to refresh code lenses and discovery
     const configChangeListener = vscode.workspace.onDidChangeConfiguration((e) => {
         if (e.affectsConfiguration('goAllocations.showCodeLens')) {
             codeLensProvider.refresh();
+            functionCodeLensProvider.refresh();
+        }
+        if (e.affectsConfiguration('goAllocations.heatmap') || e.affectsConfiguration('goAllocations.heatThresholds')) {
+            heatmap.update();
+        }
+        if (e.affectsConfiguration('goAllocations.dimNonAllocating')) {
+            dim.update();
+        }
+        if (e.affectsConfiguration('goAllocations.inlineAnnotations')) {
+            annotations.update();
+        }
+        if (e.affectsConfiguration('goAllocations.hideEmptyPackages')) {
+            updateHideEmptyPackages();
+        }
+        if (e.affectsConfiguration('goAllocations.sampleType') || e.affectsConfiguration('goAllocations.attribution') ||
+            e.affectsConfiguration('goAllocations.groupBy') || e.affectsConfiguration('goAllocations.hideExternalFrames') ||
+            e.affectsConfiguration('goAllocations.focus') || e.affectsConfiguration('goAllocations.ignore') ||
+            e.affectsConfiguration('goAllocations.threshold') || e.affectsConfiguration('goAllocations.labelFilter') ||
+            e.affectsConfiguration('goAllocations.labelKey') || e.affectsConfiguration('goAllocations.heatThresholds')) {
+            treeData.setAllocationView(allocationView());
+            stacksPanel.refresh();
+        }
+        if (e.affectsConfiguration('goAllocations.benchmarkFilter')) {
+            const filter = vscode.workspace.getConfiguration('goAllocations').get<string>('benchmarkFilter', '');
+            try {
+                new RegExp(filter);
+            } catch (err) {
+                vscode.window.showErrorMessage(`Invalid goAllocations.benchmarkFilter, showing all benchmarks: ${err}`);
+            }
+        }
+        if (e.affectsConfiguration('goAllocations.discoveryStrategy') ||
+            e.affectsConfiguration('goAllocations.includeVendor') ||
+            e.affectsConfiguration('goAllocations.benchmarkFilter') ||
+            e.affectsConfiguration('goAllocations.goExecutable') ||
+            e.affectsConfiguration('goAllocations.goroot') ||
+            e.affectsConfiguration('goAllocations.goflags')) {
+            treeData.refresh();
         }
     });
     context.subscriptions.push(configChangeListener);
@@ -84,32 +923,276 @@ export async function activate(context: vscode.ExtensionContext) {
     // Command invoked by CodeLens in editor to run a specific benchmark
     const runBenchmarkFromEditor = vscode.commands.registerCommand(
         'goAllocations.runBenchmarkFromEditor',
-        async (args: { packageDir: string; benchmarkName: string }) => {
-            try {
-                if (!args || !args.packageDir || !args.benchmarkName) {
-                    throw new Error('Missing benchmark information from editor.');
+        runCommand(async (args: { packageDir: string; benchmarkName: string }) => {
+            if (!args || !args.packageDir || !args.benchmarkName) {
+                throw new Error('Missing benchmark information from editor.');
+            }
+            // Focus the Go Allocations Explorer view
+            await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+
+            const benchmarkItem = await treeData.findBenchmark(args.packageDir, args.benchmarkName);
+            if (benchmarkItem.benchmark.unsaved) {
+                throw new Error(`Save the file to run ${args.benchmarkName}.`);
+            }
+            await treeView.reveal(benchmarkItem, { select: true, expand: false });
+            await treeData.runWith(benchmarkItem);
+        }));
+    context.subscriptions.push(runBenchmarkFromEditor);
+
+    // Locks in the benchmark's allocs/op with a test next to it, from the tree or the editor
+    const generateAllocationTest = vscode.commands.registerCommand(
+        'goAllocations.generateAllocationTest',
+        runCommand(async (args: BenchmarkItem | { packageDir: string; benchmarkName: string } | undefined) => {
+            let item: BenchmarkItem;
+            if (args instanceof BenchmarkItem) {
+                item = args;
+            } else if (args) {
+                item = await treeData.findBenchmark(args.packageDir, args.benchmarkName);
+            } else {
+                const editor = vscode.window.activeTextEditor;
+                const benchmarkName = editor && enclosingBenchmark(editor.document, editor.selection.active.line);
+                if (!editor || !benchmarkName) {
+                    throw new Error('The cursor is not within a benchmark function.');
                 }
-                // Focus the Go Allocations Explorer view
-                await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+                item = await treeData.findBenchmark(path.dirname(editor.document.uri.fsPath), benchmarkName);
+            }
+            if (item.parentBenchmark) {
+                throw new Error('Generate the test for the top-level benchmark, testing.Benchmark runs it with its sub-benchmarks.');
+            }
+            const allocsPerOp = treeData.allocsPerOp(item);
+            if (allocsPerOp === undefined) {
+                throw new Error(`Run ${item.benchmark.name} first, to know its allocs/op.`);
+            }
 
-                const benchmarkItem = await treeData.findBenchmark(args.packageDir, args.benchmarkName);
-                treeData.clearBenchmarkRunState(benchmarkItem);
-                await treeView.reveal(benchmarkItem, { expand: true, select: true });
-            } catch (err) {
-                vscode.window.showErrorMessage(`${err}`);
+            const { name, source } = allocationTest(item.benchmark.name, Math.ceil(allocsPerOp));
+            const document = await vscode.workspace.openTextDocument(item.location.uri);
+            if (new RegExp(`^func ${name}\\(`, 'm').test(document.getText())) {
+                throw new Error(`${name} already exists in ${path.basename(document.uri.fsPath)}.`);
+            }
+            const edit = new vscode.WorkspaceEdit();
+            const end = document.lineAt(document.lineCount - 1).range.end;
+            edit.insert(document.uri, end, source, { needsConfirmation: true, label: `Add ${name}` });
+            await vscode.workspace.applyEdit(edit);
+        }));
+    context.subscriptions.push(generateAllocationTest);
+
+    // Command invoked from the editor context menu, to find the benchmark at the cursor in the tree
+    const revealInView = vscode.commands.registerCommand(
+        'goAllocations.revealInView',
+        runCommand(async () => {
+            const editor = vscode.window.activeTextEditor;
+            if (!editor) {
+                throw new Error('No active editor.');
             }
+
+            const benchmarkName = enclosingBenchmark(editor.document, editor.selection.active.line);
+            if (!benchmarkName) {
+                throw new Error('The cursor is not within a benchmark function.');
+            }
+
+            await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+
+            const packageDir = path.dirname(editor.document.uri.fsPath);
+            const benchmarkItem = await treeData.findBenchmark(packageDir, benchmarkName);
+
+            // Don't expand the benchmark itself, that would run it
+            await treeView.reveal(benchmarkItem, { select: true, focus: true, expand: false });
+        }));
+    context.subscriptions.push(revealInView);
+
+    /**
+     * Lists the benchmarks of the sites to pick from: picking one reveals it
+     * in the tree, and its button runs it again, too.
+     */
+    const pickBenchmark = async (
+        found: SiteAllocation[],
+        none: string,
+        placeholder: string,
+        describe: (site: SiteAllocation) => string = site => `${site.allocation.description ?? ''}`
+    ): Promise<void> => {
+        if (found.length === 0) {
+            vscode.window.showInformationMessage(none);
+            return;
+        }
+
+        const runAgain: vscode.QuickInputButton = { iconPath: new vscode.ThemeIcon('play'), tooltip: 'Run again' };
+        const quickPick = vscode.window.createQuickPick<vscode.QuickPickItem & { site: SiteAllocation }>();
+        quickPick.placeholder = placeholder;
+        quickPick.items = found.map(site => ({
+            label: site.benchmark.fullName,
+            description: [site.run, describe(site)].filter(Boolean).join(' · '),
+            detail: vscode.workspace.asRelativePath(site.benchmark.folderPath),
+            buttons: site.benchmark.benchmark.unsaved ? [] : [runAgain],
+            site
+        }));
+        const picked = await new Promise<{ site: SiteAllocation; run: boolean } | undefined>(resolve => {
+            quickPick.onDidAccept(() => resolve(quickPick.selectedItems[0] && { site: quickPick.selectedItems[0].site, run: false }));
+            quickPick.onDidTriggerItemButton(e => resolve({ site: e.item.site, run: true }));
+            quickPick.onDidHide(() => resolve(undefined));
+            quickPick.show();
         });
-    context.subscriptions.push(runBenchmarkFromEditor);
+        quickPick.dispose();
+        if (!picked) {
+            return;
+        }
+        await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+        await treeView.reveal(picked.site.benchmark, { select: true, focus: true, expand: !picked.run });
+        if (picked.run) {
+            await treeData.runWith(picked.site.benchmark);
+        }
+    };
 
-    const navigateToBenchmark = vscode.commands.registerCommand(
-        'goAllocations.navigateToBenchmark',
-        async (benchmarkItem: BenchmarkItem) => {
+    // Every benchmark that allocates at a line, from an allocation in the tree or the cursor in an editor
+    const showBenchmarksAtLine = vscode.commands.registerCommand(
+        'goAllocations.showBenchmarksAtLine',
+        runCommand(async (item?: Item | { filePath: string; functionName: string }) => {
+            // From a function's lens, the benchmarks that allocate anywhere in it
+            if (item && 'functionName' in item) {
+                const { filePath, functionName } = item;
+                await treeData.restoreSavedResults();
+                const sites = treeData.functionsIn(filePath).find(fn => fn.name === functionName)?.sites ?? [];
+                const short = functionName.slice(functionName.lastIndexOf('/') + 1);
+                await pickBenchmark(sites, `No benchmark run so far allocates in ${short}.`, `Benchmarks that allocate in ${short}`, ({ allocation }) => {
+                    const { sampleTypes, function: fn } = allocation.allocationData;
+                    const index = sampleTypes.findIndex(st => st.type === 'alloc_space');
+                    return index < 0 ? '' : `${formatBytes(fn.cum[index])} cumulative`;
+                });
+                return;
+            }
+
+            let filePath: string;
+            let lineNumber: number;
+            if (item instanceof AllocationItem) {
+                filePath = item.filePath;
+                lineNumber = item.lineNumber;
+            } else {
+                const editor = vscode.window.activeTextEditor;
+                if (!editor) {
+                    throw new Error('No active editor.');
+                }
+                filePath = editor.document.uri.fsPath;
+                lineNumber = editor.selection.active.line + 1;
+            }
+
+            // The last session's results count too, not only those expanded since
+            await treeData.restoreSavedResults();
+            await pickBenchmark(
+                treeData.allocationsAt(filePath, lineNumber),
+                `No benchmark run so far allocates at ${path.basename(filePath)}:${lineNumber}.`,
+                `Benchmarks that allocate at ${path.basename(filePath)}:${lineNumber}`
+            );
+        }));
+    context.subscriptions.push(showBenchmarksAtLine);
+
+    // Allocation sites in every benchmark's results, by function or file name, to jump to
+    const searchAllocationSites = vscode.commands.registerCommand(
+        'goAllocations.searchAllocationSites',
+        runCommand(async () => {
+            await treeData.restoreSavedResults();
+            const sites = treeData.allAllocations();
+            if (sites.length === 0) {
+                vscode.window.showInformationMessage('No allocation sites yet. Run a benchmark first.');
+                return;
+            }
+            const picked = await vscode.window.showQuickPick(
+                sites.map(site => {
+                    const { allocation, benchmark, run } = site;
+                    const { functionName } = allocation.allocationData;
+                    return {
+                        label: `$(symbol-function) ${functionName.slice(functionName.lastIndexOf('/') + 1)}`,
+                        description: `${vscode.workspace.asRelativePath(allocation.filePath)}:${allocation.lineNumber}`,
+                        detail: [benchmark.fullName, run, allocation.description].filter(Boolean).join(' · '),
+                        site
+                    };
+                }),
+                { placeHolder: 'Search allocation sites by function or file', matchOnDescription: true, matchOnDetail: true }
+            );
+            await picked?.site.allocation.navigateTo();
+        }));
+    context.subscriptions.push(searchAllocationSites);
+
+    // The lines that allocate the most over every benchmark run so far, to prioritize across the module
+    const showTopSites = vscode.commands.registerCommand(
+        'goAllocations.showTopSites',
+        runCommand(async () => {
+            await treeData.restoreSavedResults();
+            const count = vscode.workspace.getConfiguration('goAllocations').get<number>('topSitesCount', 25);
+            const top = treeData.topSites(count);
+            if (top.length === 0) {
+                vscode.window.showInformationMessage('No allocation sites yet. Run a benchmark first.');
+                return;
+            }
+            const picked = await vscode.window.showQuickPick(
+                top.map((line, i) => {
+                    const short = line.functionName.slice(line.functionName.lastIndexOf('/') + 1);
+                    const benchmarks = line.sites.map(site => site.benchmark.fullName);
+                    return {
+                        label: `${i + 1}. ${formatBytes(line.bytesPerOp)}/op`,
+                        description: `${short} · ${vscode.workspace.asRelativePath(line.filePath)}:${line.lineNumber}`,
+                        detail: `${benchmarks.length === 1 ? '1 benchmark' : `${benchmarks.length} benchmarks`}: ${benchmarks.join(', ')}`,
+                        line
+                    };
+                }),
+                { placeHolder: `The ${top.length} lines that allocate the most, over every benchmark run`, matchOnDescription: true, matchOnDetail: true }
+            );
+            await picked?.line.sites[0].allocation.navigateTo();
+        }));
+    context.subscriptions.push(showTopSites);
+
+    const openProfile = vscode.commands.registerCommand(
+        'goAllocations.openProfile',
+        async (uri?: vscode.Uri) => {
             try {
-                await benchmarkItem.navigateTo();
+                const picked = uri ? [uri] : await vscode.window.showOpenDialog({
+                    title: 'Open heap profile',
+                    canSelectMany: false,
+                    filters: { 'Heap profiles': ['pprof', 'pb.gz', 'out', 'prof'], 'All files': ['*'] }
+                });
+                if (!picked || picked.length === 0) {
+                    return;
+                }
+                await vscode.commands.executeCommand('workbench.view.extension.goAllocations');
+                await treeData.openProfile(picked[0].fsPath);
             } catch (err) {
-                vscode.window.showErrorMessage(`${err}`);
+                vscode.window.showErrorMessage(`Can't open heap profile: ${err}`);
             }
         });
+    context.subscriptions.push(openProfile);
+
+    const closeProfile = vscode.commands.registerCommand(
+        'goAllocations.closeProfile',
+        (item: Item) => treeData.closeProfile(item)
+    );
+    context.subscriptions.push(closeProfile);
+
+    // Two profiles, from runs or files, as pprof -diff_base
+    const compareProfiles = vscode.commands.registerCommand(
+        'goAllocations.compareProfiles',
+        runCommand(async () => {
+            const profiles = treeData.recentProfiles().map(profile => ({ label: profile.label, profile }));
+            if (profiles.length < 2) {
+                throw new Error('Run benchmarks, or open heap profiles, to have two profiles to compare.');
+            }
+            const base = await vscode.window.showQuickPick(profiles, { title: 'Compare profiles', placeHolder: 'The base, such as the run before a change' });
+            if (!base) {
+                return;
+            }
+            const current = await vscode.window.showQuickPick(
+                profiles.filter(p => p !== base),
+                { title: 'Compare profiles', placeHolder: `The profile to compare with ${base.label}` }
+            );
+            if (!current) {
+                return;
+            }
+            treeData.showDiff(base.profile, current.profile);
+        }));
+    context.subscriptions.push(compareProfiles);
+
+    const navigateToBenchmark = vscode.commands.registerCommand(
+        'goAllocations.navigateToBenchmark',
+        runCommand(async (benchmarkItem: BenchmarkItem) => {
+            await benchmarkItem.navigateTo();
+        }));
     context.subscriptions.push(navigateToBenchmark);
 }
 
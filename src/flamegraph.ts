@@ -0,0 +1,187 @@
+import * as vscode from 'vscode';
+import * as fs from 'fs';
+import * as crypto from 'crypto';
+import { Profile, sampleFrames, formatValue } from './profile';
+import { escapeHtml } from './weblist';
+
+// A function in the flame graph, under its caller; as JSON for the webview, with short keys
+interface FlameNode {
+    // Function name, its file and heaviest line, the value, formatted, and the callees
+    n: string;
+    f: string;
+    l: number;
+    v: number;
+    s: string;
+    c: FlameNode[];
+}
+
+/**
+ * Builds the flame graph of the profile's sample type at index: each
+ * stack from the benchmark down, cut at the testing package that calls
+ * it, with the callees of a function merged by name, as pprof's flame
+ * graph does.
+ */
+const flameTree = (profile: Profile, index: number, resolvePath: (file: string) => string): FlameNode => {
+    const { unit } = profile.sampleTypes[index];
+    const root: FlameNode = { n: 'all', f: '', l: 0, v: 0, s: '', c: [] };
+    // The value of each line of a node, for the line it opens at
+    const lines = new Map<FlameNode, Map<number, number>>();
+
+    for (const sample of profile.samples) {
+        const value = sample.values[index] ?? 0;
+        if (value <= 0) {
+            continue;
+        }
+        const frames = sampleFrames(profile, sample);
+        const end = frames.findIndex(frame => frame.fn.name.startsWith('testing.'));
+        const kept = (end >= 0 ? frames.slice(0, end) : frames).reverse();
+
+        root.v += value;
+        let node = root;
+        for (const frame of kept) {
+            let child = node.c.find(c => c.n === frame.fn.name);
+            if (!child) {
+                child = { n: frame.fn.name, f: resolvePath(frame.fn.filename), l: frame.line, v: 0, s: '', c: [] };
+                node.c.push(child);
+                lines.set(child, new Map());
+            }
+            child.v += value;
+            const byLine = lines.get(child)!;
+            byLine.set(frame.line, (byLine.get(frame.line) ?? 0) + value);
+            node = child;
+        }
+    }
+
+    const finish = (node: FlameNode) => {
+        node.s = formatValue(node.v, unit);
+        const byLine = lines.get(node);
+        if (byLine) {
+            node.l = [...byLine].reduce((best, entry) => entry[1] > best[1] ? entry : best)[0];
+        }
+        node.c.sort((a, b) => b.v - a.v);
+        node.c.forEach(finish);
+    };
+    finish(root);
+    return root;
+}
+
+// The webview renders the graph itself, as an icicle with the benchmark at the top
+const flameGraphHtml = (title: string, root: FlameNode, nonce: string): string => `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="Content-Security-Policy" content="default-src 'none'; style-src 'unsafe-inline'; script-src 'nonce-${nonce}';">
+<style>
+    body { font-family: var(--vscode-font-family); font-size: 12px; color: var(--vscode-foreground); }
+    #toolbar { display: flex; gap: 0.5em; align-items: center; margin-bottom: 0.5em; }
+    #toolbar input { background: var(--vscode-input-background); color: var(--vscode-input-foreground); border: 1px solid var(--vscode-input-border, transparent); padding: 2px 4px; }
+    #toolbar button { background: var(--vscode-button-background); color: var(--vscode-button-foreground); border: none; padding: 2px 8px; cursor: pointer; }
+    #graph { position: relative; }
+    .node { position: absolute; height: 17px; line-height: 17px; overflow: hidden; white-space: nowrap; text-overflow: ellipsis;
+        padding: 0 3px; box-sizing: border-box; border-right: 1px solid var(--vscode-editor-background); color: #000; cursor: pointer; }
+    .node.match { outline: 2px solid var(--vscode-focusBorder); outline-offset: -2px; }
+    .node.dim { opacity: 0.35; }
+</style>
+</head>
+<body>
+<h3>${escapeHtml(title)}</h3>
+<div id="toolbar">
+    <input id="search" placeholder="Search functions" size="30">
+    <button id="reset">Reset zoom</button>
+    <span id="status"></span>
+</div>
+<div id="graph"></div>
+<script nonce="${nonce}">
+    const vscode = acquireVsCodeApi();
+    const root = ${JSON.stringify(root).replace(/</g, '\\u003c')};
+    const graph = document.getElementById('graph');
+    const search = document.getElementById('search');
+    const status = document.getElementById('status');
+    const rowHeight = 18;
+    let zoomed = root;
+
+    // Warm colors, the same for a function wherever it is
+    const color = name => {
+        let hash = 0;
+        for (const ch of name) {
+            hash = (hash * 31 + ch.charCodeAt(0)) | 0;
+        }
+        return 'hsl(' + (10 + Math.abs(hash) % 40) + ', 80%, ' + (55 + Math.abs(hash >> 8) % 15) + '%)';
+    };
+
+    const render = () => {
+        graph.replaceChildren();
+        const query = search.value.toLowerCase();
+        let matched = 0;
+        let depth = 0;
+        const add = (node, x, width, level, inMatch) => {
+            // Too narrow to see; its callees are narrower still
+            if (width < 0.001) {
+                return;
+            }
+            depth = Math.max(depth, level);
+            const matches = query !== '' && node.n.toLowerCase().includes(query);
+            if (matches && !inMatch) {
+                matched += node.v;
+            }
+            const div = document.createElement('div');
+            div.className = 'node' + (matches ? ' match' : query !== '' && !inMatch ? ' dim' : '');
+            div.style.left = (x * 100) + '%';
+            div.style.width = (width * 100) + '%';
+            div.style.top = (level * rowHeight) + 'px';
+            div.style.background = color(node.n);
+            div.textContent = node.n.slice(node.n.lastIndexOf('/') + 1);
+            div.title = node.n + '\\n' + node.s + ' (' + (node.v / root.v * 100).toFixed(1) + '%)' + (node.f ? '\\n' + node.f + ':' + node.l : '') +
+                '\\n\\nClick to zoom, double-click to open the source';
+            div.addEventListener('click', () => { zoomed = node; render(); });
+            div.addEventListener('dblclick', () => { if (node.f) { vscode.postMessage({ type: 'open', file: node.f, line: node.l }); } });
+            graph.appendChild(div);
+            let offset = x;
+            for (const child of node.c) {
+                const w = width * child.v / node.v;
+                add(child, offset, w, level + 1, inMatch || matches);
+                offset += w;
+            }
+        };
+        add(zoomed, 0, 1, 0, false);
+        graph.style.height = ((depth + 1) * rowHeight) + 'px';
+        status.textContent = query === '' ? '' : 'Matched: ' + (matched / root.v * 100).toFixed(1) + '% of all';
+    };
+
+    search.addEventListener('input', render);
+    document.getElementById('reset').addEventListener('click', () => { zoomed = root; render(); });
+    render();
+</script>
+</body>
+</html>`;
+
+/**
+ * Opens a flame graph of the profile's sample type at index, beside the
+ * editor: click a function to zoom to it, search to highlight functions,
+ * and double-click one to open its source.
+ */
+export const showFlameGraph = (title: string, profile: Profile, index: number, resolvePath: (file: string) => string): void => {
+    const panel = vscode.window.createWebviewPanel(
+        'goAllocations.flameGraph',
+        `Flame graph: ${title}`,
+        { viewColumn: vscode.ViewColumn.Beside, preserveFocus: true },
+        { enableScripts: true }
+    );
+    const messages = panel.webview.onDidReceiveMessage((message: { type: string; file: string; line: number }) => {
+        if (message.type !== 'open') {
+            return;
+        }
+        if (!fs.existsSync(message.file)) {
+            vscode.window.showErrorMessage(`${message.file} not found. A dependency's source may need go mod download.`);
+            return;
+        }
+        const line = Math.max(0, message.line - 1);
+        vscode.commands.executeCommand('vscode.open', vscode.Uri.file(message.file), {
+            viewColumn: vscode.ViewColumn.One,
+            selection: new vscode.Range(line, 0, line, 0)
+        });
+    });
+    panel.onDidDispose(() => messages.dispose());
+    const nonce = crypto.randomBytes(16).toString('base64');
+    panel.webview.html = flameGraphHtml(`${title}, ${profile.sampleTypes[index].type}`, flameTree(profile, index, resolvePath), nonce);
+}
@@ -0,0 +1,34 @@
+import * as vscode from 'vscode';
+
+// How hot an allocation is, by its share of what its benchmark allocated
+export type HeatLevel = 'low' | 'medium' | 'high';
+
+export const heatLevels: HeatLevel[] = ['low', 'medium', 'high'];
+
+// The theme colors package.json contributes, which themes and users can override
+export const heatColor = (level: HeatLevel): vscode.ThemeColor => {
+    switch (level) {
+        case 'low':
+            return new vscode.ThemeColor('goAllocations.heatLow');
+        case 'medium':
+            return new vscode.ThemeColor('goAllocations.heatMedium');
+        case 'high':
+            return new vscode.ThemeColor('goAllocations.heatHigh');
+    }
+}
+
+/**
+ * The level of a value, by its share of the total, from the percentages
+ * of goAllocations.heatThresholds at which medium and high start.
+ */
+export const heatLevel = (value: number, total: number): HeatLevel => {
+    const thresholds = vscode.workspace.getConfiguration('goAllocations').get<{ medium?: number; high?: number }>('heatThresholds', {});
+    const percent = total > 0 ? value / total * 100 : 0;
+    if (percent >= (thresholds.high ?? 20)) {
+        return 'high';
+    }
+    if (percent >= (thresholds.medium ?? 5)) {
+        return 'medium';
+    }
+    return 'low';
+}
@@ -0,0 +1,61 @@
+import * as path from 'path';
+import * as fs from 'fs';
+import * as os from 'os';
+import { runProcess } from './process';
+import { Profile, Location, ProfileFunction, ValueType, Sample, TotalsById, readProfile, setSummedTotals } from './profile';
+
+// The profile as the helper prints it, with arrays where Profile has maps
+interface HelperProfile {
+    sampleTypes: ValueType[];
+    samples: Sample[];
+    locations: Location[];
+    functions: ProfileFunction[];
+    defaultSampleType?: string;
+    lineTotals: TotalsById['lines'];
+    functionTotals: TotalsById['functions'];
+}
+
+/**
+ * The helper binary for this platform, as built into bin by
+ * scripts/build-helper.mjs when the extension is packaged, or undefined
+ * if it wasn't.
+ */
+const helperPath = (): string | undefined => {
+    // The bundle is in out, next to bin
+    const ext = process.platform === 'win32' ? '.exe' : '';
+    const helper = path.join(__dirname, '..', 'bin', `profilehelper-${process.platform}-${process.arch}${ext}`);
+    return fs.existsSync(helper) ? helper : undefined;
+}
+
+/**
+ * Reads a profile file. The helper decodes and aggregates it outside the
+ * extension host, which is much faster for large profiles; without the
+ * helper, or if it fails, the profile is parsed here.
+ */
+export const loadProfile = async (file: string, signal: AbortSignal): Promise<Profile> => {
+    const helper = helperPath();
+    if (helper) {
+        try {
+            // TODO: stream the output, rather than collecting it as one string
+            const { stdout } = await runProcess(helper, [file], { cwd: os.tmpdir(), env: process.env, signal });
+            const p = JSON.parse(stdout) as HelperProfile;
+            const profile: Profile = {
+                sampleTypes: p.sampleTypes,
+                samples: p.samples,
+                locations: new Map(p.locations.map(l => [l.id, l])),
+                functions: new Map(p.functions.map(fn => [fn.id, fn])),
+                defaultSampleType: p.defaultSampleType
+            };
+            // The tree's sites are these totals; the samples are for stacks, labels and filters
+            // TODO: leave the samples in the helper until something asks for them
+            setSummedTotals(profile, { lines: p.lineTotals, functions: p.functionTotals });
+            return profile;
+        } catch (error) {
+            if (signal.aborted) {
+                throw error;
+            }
+            console.warn('Profile helper failed, parsing the profile in the extension:', error);
+        }
+    }
+    return readProfile(file);
+}
@@ -0,0 +1,133 @@
+import * as vscode from 'vscode';
+import { SiteAllocation } from './treedata';
+import { formatBytes, Frame } from './profile';
+import { EscapeFinding, InliningNote } from './escape';
+
+// How many callers of the top stack to list
+const maxCallers = 8;
+
+// A markdown link that runs a command with the arguments
+const commandLink = (title: string, command: string, args: unknown[]): string =>
+    `[${title}](command:${command}?${encodeURIComponent(JSON.stringify(args))})`;
+
+/**
+ * Shows the allocations at a line when hovered: each benchmark that
+ * allocates there, with bytes and objects, and the stack that allocated
+ * the most, with links to its callers and to run each benchmark again.
+ * Lines that escape analysis flagged show the compiler's reasoning.
+ */
+export class AllocationHoverProvider implements vscode.HoverProvider {
+    // The benchmarks' allocations at a line, most first, as the tree has them
+    private readonly allocationsAt: (filePath: string, lineNumber: number) => SiteAllocation[];
+    private readonly escapesAt: (filePath: string, lineNumber: number) => EscapeFinding[];
+    private readonly inliningAt: (filePath: string, lineNumber: number) => InliningNote[];
+
+    constructor(
+        allocationsAt: (filePath: string, lineNumber: number) => SiteAllocation[],
+        escapesAt: (filePath: string, lineNumber: number) => EscapeFinding[],
+        inliningAt: (filePath: string, lineNumber: number) => InliningNote[]
+    ) {
+        this.allocationsAt = allocationsAt;
+        this.escapesAt = escapesAt;
+        this.inliningAt = inliningAt;
+    }
+
+    provideHover(document: vscode.TextDocument, position: vscode.Position): vscode.ProviderResult<vscode.Hover> {
+        const found = this.allocationsAt(document.uri.fsPath, position.line + 1);
+        const escapes = this.escapesAt(document.uri.fsPath, position.line + 1);
+        if (found.length === 0 && escapes.length === 0) {
+            return undefined;
+        }
+
+        const markdown = new vscode.MarkdownString();
+        // Only our own commands, for the links
+        markdown.isTrusted = { enabledCommands: ['goAllocations.runBenchmarkFromEditor', 'vscode.open'] };
+        if (found.length > 0) {
+            this.appendAllocations(markdown, found);
+            appendInlining(markdown, this.inliningAt(document.uri.fsPath, position.line + 1));
+        }
+        for (const escape of escapes) {
+            appendEscape(markdown, escape);
+        }
+        return new vscode.Hover(markdown);
+    }
+
+    private appendAllocations(markdown: vscode.MarkdownString, found: SiteAllocation[]): void {
+        markdown.appendMarkdown('**Allocations at this line**\n\n');
+
+        for (const { benchmark, allocation, run } of found) {
+            const { sampleTypes, flat } = allocation.allocationData;
+            const value = (type: string) => {
+                const index = sampleTypes.findIndex(st => st.type === type);
+                return index < 0 ? undefined : flat[index];
+            };
+            const bytes = value('alloc_space');
+            const objects = value('alloc_objects');
+            const numbers = [
+                bytes === undefined ? undefined : formatBytes(bytes),
+                objects === undefined ? undefined : `${objects.toLocaleString()} objs`
+            ].filter(Boolean).join(' · ');
+            // TODO: sub-benchmarks run as their parent, since the editor only knows top-level names
+            const rerun = commandLink('Run again', 'goAllocations.runBenchmarkFromEditor', [{ packageDir: benchmark.folderPath, benchmarkName: benchmark.benchmark.name }]);
+            markdown.appendMarkdown(`- \`${benchmark.fullName}\`${run ? ` (${run})` : ''}: ${numbers} · ${rerun}\n`);
+        }
+
+        // The stack behind the most bytes, of the benchmark that allocates the most here
+        const top = found[0].allocation.allocationData;
+        const index = Math.max(0, top.sampleTypes.findIndex(st => st.type === 'alloc_space'));
+        const [stack] = top.stacks().sort((a, b) => b.values[index] - a.values[index]);
+        if (stack && stack.frames.length > 1) {
+            markdown.appendMarkdown(`\n**Top stack** of \`${found[0].benchmark.fullName}\`, ${formatBytes(stack.values[index])}\n\n`);
+            for (const frame of stack.frames.slice(1, maxCallers + 1)) {
+                markdown.appendMarkdown(`- ${this.frameLink(frame, top.source.options.resolvePath)}\n`);
+            }
+        }
+    }
+
+    // The caller's function, linking to the line that calls
+    private frameLink(frame: Frame, resolvePath: (file: string) => string): string {
+        const name = frame.fn.name.slice(frame.fn.name.lastIndexOf('/') + 1);
+        const uri = vscode.Uri.file(resolvePath(frame.fn.filename));
+        const line = Math.max(0, frame.line - 1);
+        const selection = { start: { line, character: 0 }, end: { line, character: 0 } };
+        return `${commandLink(`${name}:${frame.line}`, 'vscode.open', [uri, { selection }])}${frame.inlined ? ' (inlined)' : ''}`;
+    }
+}
+
+/**
+ * Whether the allocating calls at the line were inlined: a call that
+ * isn't can make its caller's values escape, where inlined they might
+ * stay on the stack.
+ */
+const appendInlining = (markdown: vscode.MarkdownString, notes: InliningNote[]): void => {
+    if (notes.length === 0) {
+        return;
+    }
+    markdown.appendMarkdown('\n**Inlining**\n\n');
+    for (const { callee, inlined, reason } of notes) {
+        markdown.appendMarkdown(`- \`${callee}\` ${inlined ? 'inlined here' : 'not inlined'}`);
+        if (reason) {
+            markdown.appendText(`: ${reason}`);
+        }
+        markdown.appendMarkdown('\n');
+    }
+}
+
+/**
+ * Why a value escapes, as -m=2 explains it: the first line says where,
+ * then each flow to the heap, nested as the compiler indents it.
+ */
+const appendEscape = (markdown: vscode.MarkdownString, escape: EscapeFinding): void => {
+    markdown.appendMarkdown(`\n**Escape analysis:** ${escape.message}\n\n`);
+    if (escape.explanation.length === 0) {
+        return;
+    }
+    for (const line of escape.explanation) {
+        const indent = line.length - line.trimStart().length;
+        // flows are indented by two, their steps by four, and the first line not at all
+        const depth = Math.max(0, indent / 2 - 1);
+        markdown.appendMarkdown(`${'  '.repeat(depth)}- `);
+        markdown.appendText(line.trim());
+        markdown.appendMarkdown('\n');
+    }
+}
@@ -0,0 +1,83 @@
+import * as path from 'path';
+import * as fs from 'fs';
+import { runProcess } from './process';
+
+// Where the sources a profile refers to live on disk
+export interface SourceRoots {
+    goroot: string;
+    gomodcache: string;
+    // The main modules, those in go.work, and dependencies, with replacements applied
+    modules: { path: string; version: string; dir: string }[];
+}
+
+/**
+ * Finds the source roots for the module in dir from go env and go list -m,
+ * to map the file names of a -trimpath build back to files.
+ */
+export const sourceRoots = async (
+    go: string,
+    dir: string,
+    env: NodeJS.ProcessEnv,
+    signal: AbortSignal
+): Promise<SourceRoots> => {
+    const { stdout: goEnvOut } = await runProcess(go, ['env', 'GOROOT', 'GOMODCACHE'], { cwd: dir, env, signal });
+    const [goroot, gomodcache] = goEnvOut.split('\n').map(line => line.trim());
+
+    const { stdout } = await runProcess(
+        go,
+        ['list', '-m', '-f', '{{.Path}}\t{{.Version}}\t{{.Dir}}', 'all'],
+        { cwd: dir, env, signal }
+    );
+    const modules = stdout.split('\n')
+        .map(line => line.split('\t'))
+        // Modules that aren't downloaded have no Dir
+        .filter(fields => fields.length === 3 && fields[2])
+        .map(([modulePath, version, moduleDir]) => ({ path: modulePath, version, dir: moduleDir }))
+        // Longest first, so nested modules win over their parents
+        .sort((a, b) => b.path.length - a.path.length);
+
+    return { goroot, gomodcache, modules };
+}
+
+// The module cache's escaping of upper case letters, e.g. !burnt!sushi for BurntSushi
+const escapeModulePath = (modulePath: string): string =>
+    modulePath.replace(/[A-Z]/g, c => `!${c.toLowerCase()}`);
+
+/**
+ * Maps a file name from a profile to a file on disk. -trimpath builds
+ * record module files as module/path/file.go, module cache files as
+ * module@version/file.go, and standard library files relative to
+ * GOROOT/src. Returns the name unchanged if nothing matches.
+ */
+export const resolveSourcePath = (file: string, roots: SourceRoots): string => {
+    if (path.isAbsolute(file) && fs.existsSync(file)) {
+        return file;
+    }
+    const name = file.replaceAll('\\', '/');
+
+    // A dependency, module@version/file.go
+    const versioned = name.match(/^(.+?)@([^/]+)\/(.+)$/);
+    if (versioned) {
+        const [, modulePath, version, rest] = versioned;
+        const module = roots.modules.find(m => m.path === modulePath && m.version === version);
+        if (module) {
+            return path.join(module.dir, rest);
+        }
+        return path.join(roots.gomodcache, `${escapeModulePath(modulePath)}@${version}`, rest);
+    }
+
+    // A main or replaced module, module/path/file.go
+    const module = roots.modules.find(m => name.startsWith(`${m.path}/`));
+    if (module) {
+        return path.join(module.dir, name.slice(module.path.length + 1));
+    }
+
+    // The standard library has no dot in its first path element
+    if (!name.split('/')[0].includes('.')) {
+        const std = path.join(roots.goroot, 'src', name);
+        if (fs.existsSync(std)) {
+            return std;
+        }
+    }
+    return file;
+}
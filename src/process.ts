@@ -0,0 +1,110 @@
+import { spawn, ChildProcess } from 'child_process';
+import * as os from 'os';
+
+export interface ProcessResult {
+    stdout: string;
+    stderr: string;
+}
+
+export interface ProcessOptions {
+    cwd: string;
+    env: NodeJS.ProcessEnv;
+    signal: AbortSignal;
+    // Scheduling priority, as for os.setPriority; processes it starts inherit it
+    priority?: number;
+    // Called with stdout as it arrives, for progress
+    onStdout?: (data: string) => void;
+    // Written to stdin, which is otherwise closed
+    input?: string;
+}
+
+/**
+ * Kills a process and its descendants. go test runs the compiled test
+ * binary as a child, which would outlive a kill of go alone.
+ */
+export const killProcessTree = (child: ChildProcess): void => {
+    if (child.pid === undefined || child.exitCode !== null) {
+        return;
+    }
+
+    if (process.platform === 'win32') {
+        spawn('taskkill', ['/pid', String(child.pid), '/T', '/F'], { stdio: 'ignore' });
+        return;
+    }
+
+    // The child leads its own process group, see runProcess
+    // TODO: escalate to SIGKILL if the group ignores SIGTERM
+    try {
+        process.kill(-child.pid, 'SIGTERM');
+    } catch (error) {
+        console.warn(`Could not kill process group ${child.pid}:`, error);
+    }
+}
+
+/**
+ * Runs a command without a shell, collecting its output. Aborting the
+ * signal kills the command along with any processes it started.
+ *
+ * On a non-zero exit, rejects with an Error carrying stdout and stderr,
+ * like child_process.exec does.
+ */
+export const runProcess = (command: string, args: string[], options: ProcessOptions): Promise<ProcessResult> => {
+    const { cwd, env, signal } = options;
+
+    return new Promise((resolve, reject) => {
+        if (signal.aborted) {
+            reject(new Error('Operation cancelled'));
+            return;
+        }
+
+        const child = spawn(command, args, {
+            cwd,
+            env,
+            // A process group of its own, so it can be killed as a whole
+            detached: process.platform !== 'win32',
+            stdio: [options.input === undefined ? 'ignore' : 'pipe', 'pipe', 'pipe']
+        });
+        child.stdin?.end(options.input);
+
+        if (options.priority !== undefined && child.pid !== undefined) {
+            try {
+                os.setPriority(child.pid, options.priority);
+            } catch (error) {
+                console.warn(`Could not set priority of process ${child.pid}:`, error);
+            }
+        }
+
+        let stdout = '';
+        let stderr = '';
+        child.stdout?.on('data', (data) => {
+            stdout += data.toString();
+            options.onStdout?.(data.toString());
+        });
+        child.stderr?.on('data', (data) => {
+            stderr += data.toString();
+        });
+
+        const onAbort = () => killProcessTree(child);
+        signal.addEventListener('abort', onAbort, { once: true });
+
+        child.on('error', (error) => {
+            signal.removeEventListener('abort', onAbort);
+            reject(Object.assign(error, { stdout, stderr }));
+        });
+
+        child.on('close', (code, killSignal) => {
+            signal.removeEventListener('abort', onAbort);
+            if (signal.aborted) {
+                reject(Object.assign(new Error('Operation cancelled'), { stdout, stderr }));
+                return;
+            }
+            if (code !== 0) {
+                const status = code ?? killSignal;
+                const message = `Command failed (${status}): ${command} ${args.join(' ')}\n${stderr}`;
+                reject(Object.assign(new Error(message), { stdout, stderr, code }));
+                return;
+            }
+            resolve({ stdout, stderr });
+        });
+    });
+}
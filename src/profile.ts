@@ -0,0 +1,827 @@
+import * as fs from 'fs';
+import * as zlib from 'zlib';
+
+// Decoding of pprof's profile.proto, as go test -memprofile writes it, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+
+export interface ValueType {
+    // e.g. alloc_space
+    type: string;
+    // e.g. bytes
+    unit: string;
+}
+
+export interface Label {
+    key: string;
+    str?: string;
+    num?: number;
+    numUnit?: string;
+}
+
+export interface Sample {
+    // The stack, leaf first
+    locationIds: number[];
+    // One per sample type
+    values: number[];
+    labels: Label[];
+}
+
+export interface Line {
+    functionId: number;
+    line: number;
+    // 0 if unknown, as it is from the Go runtime so far
+    column: number;
+}
+
+export interface Location {
+    id: number;
+    address: number;
+    // Inlined calls at this address, innermost first; the last is the caller they're inlined into
+    lines: Line[];
+}
+
+export interface ProfileFunction {
+    id: number;
+    name: string;
+    systemName: string;
+    filename: string;
+    startLine: number;
+}
+
+export interface Profile {
+    sampleTypes: ValueType[];
+    samples: Sample[];
+    locations: Map<number, Location>;
+    functions: Map<number, ProfileFunction>;
+    // The sample type pprof shows unless asked for another, if set
+    defaultSampleType: string | undefined;
+}
+
+// Wire types
+const VARINT = 0;
+const FIXED64 = 1;
+const BYTES = 2;
+const FIXED32 = 5;
+
+class Reader {
+    private readonly buf: Buffer;
+    private pos: number;
+    private readonly end: number;
+
+    constructor(buf: Buffer, start = 0, end = buf.length) {
+        this.buf = buf;
+        this.pos = start;
+        this.end = end;
+    }
+
+    get done(): boolean {
+        return this.pos >= this.end;
+    }
+
+    // As an int64, which a uint64 in a profile never exceeds; exact up to
+    // 2^53, beyond any count, size or line number in one
+    varint(): number {
+        const start = this.pos;
+        let result = 0;
+        let scale = 1;
+        for (; ;) {
+            if (this.pos >= this.end) {
+                throw new Error('Truncated profile');
+            }
+            const b = this.buf[this.pos++];
+            result += (b & 0x7f) * scale;
+            if (b < 0x80) {
+                // Only a negative number, in two's complement, takes all ten bytes
+                return this.pos - start < 10 ? result : this.int64(start);
+            }
+            scale *= 128;
+        }
+    }
+
+    private int64(start: number): number {
+        let value = 0n;
+        for (let i = 0; i < 10; i++) {
+            value |= BigInt(this.buf[start + i] & 0x7f) << BigInt(7 * i);
+        }
+        return Number(BigInt.asIntN(64, value));
+    }
+
+    // A length-delimited field, as a reader of its own
+    bytes(): Reader {
+        const length = this.varint();
+        const start = this.pos;
+        this.pos += length;
+        if (this.pos > this.end) {
+            throw new Error('Truncated profile');
+        }
+        return new Reader(this.buf, start, this.pos);
+    }
+
+    string(): string {
+        const r = this.bytes();
+        return r.buf.toString('utf8', r.pos, r.end);
+    }
+
+    // Calls fn with each field number and wire type; fn reads the value, or
+    // returns false to skip it
+    fields(fn: (field: number, wireType: number) => boolean): void {
+        while (!this.done) {
+            const tag = this.varint();
+            const field = Math.floor(tag / 8);
+            const wireType = tag & 7;
+            if (!fn(field, wireType)) {
+                this.skip(wireType);
+            }
+        }
+    }
+
+    // A repeated integer field, whether packed or not
+    repeated(wireType: number, into: number[]): void {
+        if (wireType !== BYTES) {
+            into.push(this.varint());
+            return;
+        }
+        const r = this.bytes();
+        while (!r.done) {
+            into.push(r.varint());
+        }
+    }
+
+    private skip(wireType: number): void {
+        switch (wireType) {
+            case VARINT:
+                this.varint();
+                return;
+            case FIXED64:
+                this.pos += 8;
+                return;
+            case BYTES:
+                this.bytes();
+                return;
+            case FIXED32:
+                this.pos += 4;
+                return;
+            default:
+                throw new Error(`Unsupported wire type ${wireType} in profile`);
+        }
+    }
+}
+
+// A ValueType, Label or the like, with string table indexes for strings
+type Indexed<T> = { [K in keyof T]: T[K] extends string | undefined ? number : T[K] };
+
+const parseValueType = (r: Reader): Indexed<ValueType> => {
+    const vt = { type: 0, unit: 0 };
+    r.fields(field => {
+        switch (field) {
+            case 1: vt.type = r.varint(); return true;
+            case 2: vt.unit = r.varint(); return true;
+            default: return false;
+        }
+    });
+    return vt;
+}
+
+const parseLabel = (r: Reader): Indexed<Label> => {
+    const label: Indexed<Label> = { key: 0, str: 0, num: undefined, numUnit: 0 };
+    r.fields(field => {
+        switch (field) {
+            case 1: label.key = r.varint(); return true;
+            case 2: label.str = r.varint(); return true;
+            case 3: label.num = r.varint(); return true;
+            case 4: label.numUnit = r.varint(); return true;
+            default: return false;
+        }
+    });
+    return label;
+}
+
+const parseSample = (r: Reader): { locationIds: number[]; values: number[]; labels: Indexed<Label>[] } => {
+    const sample = { locationIds: [] as number[], values: [] as number[], labels: [] as Indexed<Label>[] };
+    r.fields((field, wireType) => {
+        switch (field) {
+            case 1: r.repeated(wireType, sample.locationIds); return true;
+            case 2: r.repeated(wireType, sample.values); return true;
+            case 3: sample.labels.push(parseLabel(r.bytes())); return true;
+            default: return false;
+        }
+    });
+    return sample;
+}
+
+const parseLine = (r: Reader): Line => {
+    const line = { functionId: 0, line: 0, column: 0 };
+    r.fields(field => {
+        switch (field) {
+            case 1: line.functionId = r.varint(); return true;
+            case 2: line.line = r.varint(); return true;
+            case 3: line.column = r.varint(); return true;
+            default: return false;
+        }
+    });
+    return line;
+}
+
+const parseLocation = (r: Reader): Location => {
+    const location: Location = { id: 0, address: 0, lines: [] };
+    r.fields(field => {
+        switch (field) {
+            case 1: location.id = r.varint(); return true;
+            case 3: location.address = r.varint(); return true;
+            case 4: location.lines.push(parseLine(r.bytes())); return true;
+            default: return false;
+        }
+    });
+    return location;
+}
+
+const parseFunction = (r: Reader): Indexed<ProfileFunction> => {
+    const fn = { id: 0, name: 0, systemName: 0, filename: 0, startLine: 0 };
+    r.fields(field => {
+        switch (field) {
+            case 1: fn.id = r.varint(); return true;
+            case 2: fn.name = r.varint(); return true;
+            case 3: fn.systemName = r.varint(); return true;
+            case 4: fn.filename = r.varint(); return true;
+            case 5: fn.startLine = r.varint(); return true;
+            default: return false;
+        }
+    });
+    return fn;
+}
+
+/**
+ * Decodes a profile, gzipped as the runtime writes it or not. Strings are
+ * resolved from the string table.
+ */
+export const parseProfile = (data: Buffer): Profile => {
+    const buf = data[0] === 0x1f && data[1] === 0x8b ? zlib.gunzipSync(data) : data;
+    // As runtime.MemProfile writes with debug=1, or old Go versions did
+    if (buf.subarray(0, 13).toString() === 'heap profile:') {
+        throw new Error('Legacy text heap profiles are not supported, write one with pprof.WriteHeapProfile or go test -memprofile');
+    }
+
+    // Messages refer to the string table, which may come last, by index
+    const strings: string[] = [];
+    const sampleTypes: Indexed<ValueType>[] = [];
+    const samples: ReturnType<typeof parseSample>[] = [];
+    const locations = new Map<number, Location>();
+    const functions: Indexed<ProfileFunction>[] = [];
+    let defaultSampleType = 0;
+
+    const r = new Reader(buf);
+    r.fields(field => {
+        switch (field) {
+            case 1: sampleTypes.push(parseValueType(r.bytes())); return true;
+            case 2: samples.push(parseSample(r.bytes())); return true;
+            case 4: {
+                const location = parseLocation(r.bytes());
+                locations.set(location.id, location);
+                return true;
+            }
+            case 5: functions.push(parseFunction(r.bytes())); return true;
+            case 6: strings.push(r.string()); return true;
+            case 14: defaultSampleType = r.varint(); return true;
+            // Mappings, drop and keep frames, times and comments aren't needed
+            default: return false;
+        }
+    });
+
+    const str = (index: number): string => {
+        if (index >= strings.length) {
+            throw new Error(`String index ${index} out of range in profile`);
+        }
+        return strings[index];
+    };
+
+    return {
+        sampleTypes: sampleTypes.map(vt => ({ type: str(vt.type), unit: str(vt.unit) })),
+        samples: samples.map(s => ({
+            locationIds: s.locationIds,
+            values: s.values,
+            labels: s.labels.map(l => ({
+                key: str(l.key),
+                str: l.str ? str(l.str) : undefined,
+                num: l.num,
+                numUnit: l.numUnit ? str(l.numUnit) : undefined
+            }))
+        })),
+        locations,
+        functions: new Map(functions.map(fn => [fn.id, {
+            id: fn.id,
+            name: str(fn.name),
+            systemName: str(fn.systemName),
+            filename: str(fn.filename),
+            startLine: fn.startLine
+        }])),
+        defaultSampleType: defaultSampleType ? str(defaultSampleType) : undefined
+    };
+}
+
+export const readProfile = async (file: string): Promise<Profile> =>
+    parseProfile(await fs.promises.readFile(file));
+
+/**
+ * The index of the values pprof shows by default: the profile's default
+ * sample type, or else the last one, which is inuse_space for a heap profile.
+ */
+export const defaultSampleIndex = (profile: Profile): number => {
+    const index = profile.sampleTypes.findIndex(st => st.type === profile.defaultSampleType);
+    return index >= 0 ? index : profile.sampleTypes.length - 1;
+}
+
+// The allocations at one source line, as pprof -list reports them, by sample type
+export interface LineTotal {
+    fn: ProfileFunction;
+    line: number;
+    // Set if the profile has columns, which tell allocations on one line apart
+    column: number;
+    // Allocated at this line
+    flat: number[];
+    // Allocated at this line or in what it calls
+    cum: number[];
+}
+
+// Totals by line and by function, of every function, by function id
+export interface TotalsById {
+    lines: { functionId: number; line: number; column: number; flat: number[]; cum: number[] }[];
+    functions: { functionId: number; flat: number[]; cum: number[] }[];
+}
+
+// Totals summed already, by the helper, for the profile exactly as it was
+// read; a profile derived from it, filtered or merged, sums its own
+const summed = new WeakMap<Profile, TotalsById>();
+
+export const setSummedTotals = (profile: Profile, totals: TotalsById): void => {
+    summed.set(profile, totals);
+}
+
+/**
+ * Totals the values of each sample type by source line, for lines in
+ * functions that include says to. A line counts once per sample toward
+ * cum, however often it appears in the stack, as with recursion.
+ */
+export const lineTotals = (
+    profile: Profile,
+    include: (fn: ProfileFunction) => boolean
+): LineTotal[] => {
+    const precomputed = summed.get(profile);
+    if (precomputed) {
+        return precomputed.lines.flatMap(({ functionId, ...total }) => {
+            const fn = profile.functions.get(functionId);
+            return fn && include(fn) ? [{ fn, ...total }] : [];
+        });
+    }
+
+    const totals = new Map<string, LineTotal>();
+    const types = profile.sampleTypes.length;
+    const add = (into: number[], values: number[]) => {
+        for (let i = 0; i < types; i++) {
+            into[i] += values[i] ?? 0;
+        }
+    };
+
+    for (const sample of profile.samples) {
+        if (sample.values.every(v => v === 0)) {
+            continue;
+        }
+
+        const seen = new Set<string>();
+        sample.locationIds.forEach((locationId, depth) => {
+            const location = profile.locations.get(locationId);
+            if (!location) {
+                throw new Error(`Unknown location ${locationId} in profile`);
+            }
+            location.lines.forEach((line, i) => {
+                const fn = profile.functions.get(line.functionId);
+                if (!fn || !include(fn)) {
+                    return;
+                }
+                // Each line of a function is a site of its own, like pprof -lines
+                const key = `${fn.id}:${line.line}:${line.column}`;
+                let total = totals.get(key);
+                if (!total) {
+                    total = { fn, line: line.line, column: line.column, flat: new Array(types).fill(0), cum: new Array(types).fill(0) };
+                    totals.set(key, total);
+                }
+                // The leaf is the innermost line of the first location
+                if (depth === 0 && i === 0) {
+                    add(total.flat, sample.values);
+                }
+                if (!seen.has(key)) {
+                    seen.add(key);
+                    add(total.cum, sample.values);
+                }
+            });
+        });
+    }
+    return [...totals.values()];
+}
+
+// The allocations in one function, as pprof -top reports them, by sample type
+export interface FunctionTotal {
+    fn: ProfileFunction;
+    // Allocated in this function
+    flat: number[];
+    // Allocated in this function or in what it calls
+    cum: number[];
+}
+
+/**
+ * Totals the values of each sample type by function, for functions that
+ * include says to. As with lineTotals, a function counts once per sample
+ * toward cum.
+ */
+export const functionTotals = (
+    profile: Profile,
+    include: (fn: ProfileFunction) => boolean
+): FunctionTotal[] => {
+    const precomputed = summed.get(profile);
+    if (precomputed) {
+        return precomputed.functions.flatMap(({ functionId, ...total }) => {
+            const fn = profile.functions.get(functionId);
+            return fn && include(fn) ? [{ fn, ...total }] : [];
+        });
+    }
+
+    const totals = new Map<number, FunctionTotal>();
+    const types = profile.sampleTypes.length;
+    const add = (into: number[], values: number[]) => {
+        for (let i = 0; i < types; i++) {
+            into[i] += values[i] ?? 0;
+        }
+    };
+
+    for (const sample of profile.samples) {
+        if (sample.values.every(v => v === 0)) {
+            continue;
+        }
+
+        const seen = new Set<number>();
+        sample.locationIds.forEach((locationId, depth) => {
+            const location = profile.locations.get(locationId);
+            if (!location) {
+                throw new Error(`Unknown location ${locationId} in profile`);
+            }
+            location.lines.forEach((line, i) => {
+                const fn = profile.functions.get(line.functionId);
+                if (!fn || !include(fn)) {
+                    return;
+                }
+                let total = totals.get(fn.id);
+                if (!total) {
+                    total = { fn, flat: new Array(types).fill(0), cum: new Array(types).fill(0) };
+                    totals.set(fn.id, total);
+                }
+                if (depth === 0 && i === 0) {
+                    add(total.flat, sample.values);
+                }
+                if (!seen.has(fn.id)) {
+                    seen.add(fn.id);
+                    add(total.cum, sample.values);
+                }
+            });
+        });
+    }
+    return [...totals.values()];
+}
+
+// A function call in a stack, at a source line
+export interface Frame {
+    fn: ProfileFunction;
+    line: number;
+    column: number;
+    // Whether the compiler inlined this call into the frame after it
+    inlined: boolean;
+}
+
+// A sample's call stack, innermost first, with what it allocated by sample type
+export interface Stack {
+    frames: Frame[];
+    values: number[];
+}
+
+/**
+ * The frames of a sample, innermost first, with inlined calls as frames of
+ * their own, as pprof -traces shows them.
+ */
+export const sampleFrames = (profile: Profile, sample: Sample): Frame[] => {
+    const frames: Frame[] = [];
+    for (const locationId of sample.locationIds) {
+        const location = profile.locations.get(locationId);
+        if (!location) {
+            throw new Error(`Unknown location ${locationId} in profile`);
+        }
+        location.lines.forEach((line, i) => {
+            const fn = profile.functions.get(line.functionId);
+            if (fn) {
+                frames.push({ fn, line: line.line, column: line.column, inlined: i < location.lines.length - 1 });
+            }
+        });
+    }
+    return frames;
+}
+
+/**
+ * The distinct stacks of the samples that pass through a source line, as
+ * lineTotals keys them, each cut off at the first frame that outer says
+ * to, such as the testing package's. Stacks that are the same once cut
+ * are summed.
+ */
+export const stacksAt = (
+    profile: Profile,
+    site: { functionId: number; line: number; column: number },
+    outer: (fn: ProfileFunction) => boolean
+): Stack[] => {
+    const stacks = new Map<string, Stack>();
+    const types = profile.sampleTypes.length;
+
+    for (const sample of profile.samples) {
+        if (sample.values.every(v => v === 0)) {
+            continue;
+        }
+        const frames = sampleFrames(profile, sample);
+        if (!frames.some(f => f.fn.id === site.functionId && f.line === site.line && f.column === site.column)) {
+            continue;
+        }
+
+        const end = frames.findIndex(f => outer(f.fn));
+        const kept = end >= 0 ? frames.slice(0, end) : frames;
+        const key = kept.map(f => `${f.fn.id}:${f.line}:${f.column}`).join(',');
+        let stack = stacks.get(key);
+        if (!stack) {
+            stack = { frames: kept, values: new Array(types).fill(0) };
+            stacks.set(key, stack);
+        }
+        for (let i = 0; i < types; i++) {
+            stack.values[i] += sample.values[i] ?? 0;
+        }
+    }
+    return [...stacks.values()];
+}
+
+/**
+ * The import path of the package a function is in, e.g. strconv for
+ * strconv.Itoa and example.com/m/pkg for example.com/m/pkg.(*T).M.
+ */
+export const functionPackage = (name: string): string => {
+    // Type arguments, as in pkg.F[go.shape.int], may have dots and slashes of their own
+    const plain = name.replace(/\[.*\]/, '');
+    const slash = plain.lastIndexOf('/');
+    const dot = plain.indexOf('.', slash + 1);
+    return dot >= 0 ? plain.slice(0, dot) : plain;
+}
+
+const ownedByCaller = (pkg: string): boolean =>
+    pkg === 'runtime' || pkg.startsWith('runtime/') || pkg === 'internal' || pkg.startsWith('internal/');
+
+// What the samples through a source line allocated in one package
+export interface PackageShare {
+    package: string;
+    site: { functionId: number; line: number; column: number };
+    values: number[];
+}
+
+/**
+ * Totals the samples by two things: the package that allocated, and the
+ * included line whose call led there. The package is the leaf's, or that
+ * of its nearest caller outside the runtime, which allocates for others.
+ * The line is the innermost one in a function include accepts; samples
+ * with no such line are left out.
+ */
+export const packageShares = (
+    profile: Profile,
+    include: (fn: ProfileFunction) => boolean
+): PackageShare[] => {
+    const shares = new Map<string, PackageShare>();
+    const types = profile.sampleTypes.length;
+
+    for (const sample of profile.samples) {
+        if (sample.values.every(v => v === 0)) {
+            continue;
+        }
+        const frames = sampleFrames(profile, sample);
+        const site = frames.find(f => include(f.fn));
+        if (frames.length === 0 || !site) {
+            continue;
+        }
+
+        // The runtime, and internal packages such as bytealg, allocate on behalf of their caller
+        const owner = frames.find(f => !ownedByCaller(functionPackage(f.fn.name))) ?? frames[0];
+        const pkg = functionPackage(owner.fn.name);
+        const key = `${pkg}\n${site.fn.id}:${site.line}:${site.column}`;
+        let share = shares.get(key);
+        if (!share) {
+            share = {
+                package: pkg,
+                site: { functionId: site.fn.id, line: site.line, column: site.column },
+                values: new Array(types).fill(0)
+            };
+            shares.set(key, share);
+        }
+        for (let i = 0; i < types; i++) {
+            share.values[i] += sample.values[i] ?? 0;
+        }
+    }
+    return [...shares.values()];
+}
+
+/**
+ * The code inlined at a source line, as the innermost line of each
+ * location the line is a caller in, with what the samples through it
+ * allocated. Empty if nothing was inlined there.
+ */
+export const inlinedAt = (
+    profile: Profile,
+    site: { functionId: number; line: number; column: number }
+): Stack[] => {
+    const inlined = new Map<string, Stack>();
+    const types = profile.sampleTypes.length;
+    const isSite = (l: Line) => l.functionId === site.functionId && l.line === site.line && l.column === site.column;
+
+    for (const sample of profile.samples) {
+        const location = sample.locationIds
+            .map(id => profile.locations.get(id))
+            .find(loc => loc && loc.lines.slice(1).some(isSite));
+        const inner = location?.lines[0];
+        const fn = inner && profile.functions.get(inner.functionId);
+        if (!inner || !fn) {
+            continue;
+        }
+
+        const key = `${inner.functionId}:${inner.line}:${inner.column}`;
+        let stack = inlined.get(key);
+        if (!stack) {
+            stack = { frames: [{ fn, line: inner.line, column: inner.column, inlined: true }], values: new Array(types).fill(0) };
+            inlined.set(key, stack);
+        }
+        for (let i = 0; i < types; i++) {
+            stack.values[i] += sample.values[i] ?? 0;
+        }
+    }
+    return [...inlined.values()];
+}
+
+/**
+ * The difference of two profiles, as pprof -diff_base: base's samples
+ * with their values negated, merged with current's, so that each line's
+ * totals are what current allocated more, or less, than base.
+ */
+export const diffProfiles = (base: Profile, current: Profile): Profile => {
+    const negated: Profile = {
+        ...base,
+        samples: base.samples.map(sample => ({ ...sample, values: sample.values.map(v => -v) }))
+    };
+    return mergeProfiles([current, negated]);
+}
+
+// The profile with only the samples keep says to
+export const filterSamples = (profile: Profile, keep: (sample: Sample) => boolean): Profile => ({
+    ...profile,
+    samples: profile.samples.filter(keep)
+});
+
+/**
+ * The profile with only the samples that pass through a function focus
+ * matches, if set, and through none that ignore matches, as pprof's
+ * -focus and -ignore.
+ */
+export const filterProfile = (profile: Profile, focus?: RegExp, ignore?: RegExp): Profile =>
+    filterSamples(profile, sample => {
+        const names = sampleFrames(profile, sample).map(f => f.fn.name);
+        return (!focus || names.some(name => focus.test(name))) && (!ignore || !names.some(name => ignore.test(name)));
+    });
+
+/**
+ * The value of a sample's label, e.g. phase=parse from pprof.Do, or
+ * bytes=64 for the size the runtime records. Undefined if it has none.
+ */
+export const sampleLabel = (sample: Sample, key: string): string | undefined => {
+    const label = sample.labels.find(l => l.key === key);
+    if (!label) {
+        return undefined;
+    }
+    return label.str ?? `${label.num}${label.numUnit && label.numUnit !== key ? label.numUnit : ''}`;
+}
+
+// The label keys of the profile's samples, with the values each has
+export const profileLabels = (profile: Profile): Map<string, Set<string>> => {
+    const labels = new Map<string, Set<string>>();
+    for (const sample of profile.samples) {
+        for (const label of sample.labels) {
+            const values = labels.get(label.key) ?? new Set<string>();
+            values.add(sampleLabel(sample, label.key) ?? '');
+            labels.set(label.key, values);
+        }
+    }
+    return labels;
+}
+
+// The sum of all samples, by sample type, which pprof's percentages are of
+export const profileTotals = (profile: Profile): number[] => {
+    const totals = new Array(profile.sampleTypes.length).fill(0);
+    for (const sample of profile.samples) {
+        sample.values.forEach((value, i) => totals[i] += value);
+    }
+    return totals;
+}
+
+// Formats a value of the unit, such as bytes or count, as pprof does
+export const formatValue = (value: number, unit: string): string =>
+    unit === 'bytes' ? formatBytes(value) : value.toString();
+
+/**
+ * Formats bytes as pprof does, e.g. 512B, 1.50kB, 12MB.
+ */
+export const formatBytes = (bytes: number): string => {
+    // Differences of profiles can be negative
+    if (bytes < 0) {
+        return `-${formatBytes(-bytes)}`;
+    }
+    const units = ['B', 'kB', 'MB', 'GB', 'TB'];
+    let value = bytes;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    const rounded = unit === 0 ? value.toString() : value.toFixed(2).replace(/\.00$/, '');
+    return `${rounded}${units[unit]}`;
+}
+
+/**
+ * Merges profiles of the same kind into one, summing their samples, as
+ * pprof -proto a b does. Functions and locations are matched by name and
+ * source line, since addresses differ between builds.
+ */
+export const mergeProfiles = (profiles: Profile[]): Profile => {
+    if (profiles.length === 0) {
+        throw new Error('No profiles to merge');
+    }
+    if (profiles.length === 1) {
+        return profiles[0];
+    }
+
+    const sampleTypes = profiles[0].sampleTypes;
+    const kind = JSON.stringify(sampleTypes);
+    if (profiles.some(p => JSON.stringify(p.sampleTypes) !== kind)) {
+        throw new Error('Cannot merge profiles with different sample types');
+    }
+
+    const functions = new Map<number, ProfileFunction>();
+    const functionKeys = new Map<string, number>();
+    const locations = new Map<number, Location>();
+    const locationKeys = new Map<string, number>();
+    const samples: Sample[] = [];
+
+    for (const profile of profiles) {
+        const functionIds = new Map<number, number>();
+        for (const fn of profile.functions.values()) {
+            const key = `${fn.name}\n${fn.filename}\n${fn.startLine}`;
+            let id = functionKeys.get(key);
+            if (id === undefined) {
+                id = functions.size + 1;
+                functionKeys.set(key, id);
+                functions.set(id, { ...fn, id });
+            }
+            functionIds.set(fn.id, id);
+        }
+
+        const locationIds = new Map<number, number>();
+        for (const location of profile.locations.values()) {
+            const lines = location.lines.map(line => {
+                const functionId = functionIds.get(line.functionId);
+                if (functionId === undefined) {
+                    throw new Error(`Unknown function ${line.functionId} in profile`);
+                }
+                return { functionId, line: line.line, column: line.column };
+            });
+            // Without lines there is nothing but the address to go by
+            const key = lines.length > 0
+                ? lines.map(line => `${line.functionId}:${line.line}:${line.column}`).join(',')
+                : `@${location.address}`;
+            let id = locationKeys.get(key);
+            if (id === undefined) {
+                id = locations.size + 1;
+                locationKeys.set(key, id);
+                locations.set(id, { id, address: location.address, lines });
+            }
+            locationIds.set(location.id, id);
+        }
+
+        for (const sample of profile.samples) {
+            samples.push({
+                ...sample,
+                locationIds: sample.locationIds.map(id => {
+                    const merged = locationIds.get(id);
+                    if (merged === undefined) {
+                        throw new Error(`Unknown location ${id} in profile`);
+                    }
+                    return merged;
+                })
+            });
+        }
+    }
+
+    return { sampleTypes, samples, locations, functions, defaultSampleType: profiles[0].defaultSampleType };
+}
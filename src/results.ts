@@ -0,0 +1,147 @@
+// Parsing and aggregation of go test -bench output, the numbers printed
+// alongside the memory profile.
+
+/**
+ * One line of go test -bench output, such as
+ * BenchmarkFoo-8   1000000   1234 ns/op   56 B/op   2 allocs/op
+ */
+export interface BenchmarkRun {
+    // The name without the -GOMAXPROCS suffix, e.g. BenchmarkFoo/case
+    name: string;
+    iterations: number;
+    // Values by unit, e.g. 'ns/op', 'B/op', 'allocs/op'
+    metrics: Record<string, number>;
+}
+
+const runRegex = /^(Benchmark\S*?)(?:-\d+)?\s+(\d+)\s+(.+)$/;
+
+export const parseBenchmarkRuns = (stdout: string): BenchmarkRun[] => {
+    const runs: BenchmarkRun[] = [];
+    for (const line of stdout.split('\n')) {
+        const match = line.trim().match(runRegex);
+        if (!match) {
+            continue;
+        }
+
+        // The rest of the line is pairs of value and unit
+        const fields = match[3].trim().split(/\s+/);
+        const metrics: Record<string, number> = {};
+        for (let i = 0; i + 1 < fields.length; i += 2) {
+            const value = parseFloat(fields[i]);
+            if (!isNaN(value)) {
+                metrics[fields[i + 1]] = value;
+            }
+        }
+
+        runs.push({ name: match[1], iterations: parseInt(match[2]), metrics });
+    }
+    return runs;
+}
+
+/**
+ * Summary statistics of one metric across the runs of a benchmark.
+ */
+export interface Stats {
+    count: number;
+    mean: number;
+    median: number;
+    // Sample standard deviation, relative to the mean; 0 for a single run
+    relativeStddev: number;
+}
+
+export const summarize = (values: number[]): Stats => {
+    if (values.length === 0) {
+        throw new Error('No values to summarize');
+    }
+
+    const sorted = [...values].sort((a, b) => a - b);
+    const mid = Math.floor(sorted.length / 2);
+    const median = sorted.length % 2 === 1 ? sorted[mid] : (sorted[mid - 1] + sorted[mid]) / 2;
+    const mean = values.reduce((sum, v) => sum + v, 0) / values.length;
+
+    let relativeStddev = 0;
+    if (values.length > 1 && mean !== 0) {
+        const variance = values.reduce((sum, v) => sum + (v - mean) ** 2, 0) / (values.length - 1);
+        relativeStddev = Math.sqrt(variance) / mean;
+    }
+
+    return { count: values.length, mean, median, relativeStddev };
+}
+
+/**
+ * Summarizes a metric across the runs of the named benchmark, or undefined
+ * if no run reported it.
+ */
+export const summarizeMetric = (runs: BenchmarkRun[], name: string, unit: string): Stats | undefined => {
+    const values = runs
+        .filter(r => r.name === name && r.metrics[unit] !== undefined)
+        .map(r => r.metrics[unit]);
+    return values.length > 0 ? summarize(values) : undefined;
+}
+
+/**
+ * Where a panic happened, from the goroutine trace a panicking benchmark
+ * prints: the message, and the first frame in dir, the benchmark's package.
+ */
+export interface Panic {
+    message: string;
+    file: string;
+    line: number;
+}
+
+// A frame's location line in a goroutine trace, e.g. \t/src/foo/foo.go:12 +0x1d
+const frameRegex = /^\t(.+\.go):(\d+)(?: \+0x[0-9a-f]+)?$/;
+
+export const parsePanic = (output: string, dir: string): Panic | undefined => {
+    const lines = output.split('\n');
+    const start = lines.findIndex(line => line.startsWith('panic: '));
+    if (start < 0) {
+        return undefined;
+    }
+
+    const message = lines[start].slice('panic: '.length).trim();
+    // TODO: fall back to the first frame outside GOROOT, for a panic in a dependency
+    for (const line of lines.slice(start + 1)) {
+        const m = line.match(frameRegex);
+        if (m && m[1].startsWith(dir)) {
+            return { message, file: m[1], line: parseInt(m[2]) };
+        }
+    }
+    return undefined;
+}
+
+/**
+ * The allocations -benchmem counted for the named benchmark: allocs/op
+ * times iterations, summed over its runs. Undefined if no run reported
+ * allocs/op.
+ */
+export const countedAllocations = (runs: BenchmarkRun[], name: string): number | undefined => {
+    const counted = runs.filter(r => r.name === name && r.metrics['allocs/op'] !== undefined);
+    if (counted.length === 0) {
+        return undefined;
+    }
+    return counted.reduce((sum, r) => sum + r.metrics['allocs/op'] * r.iterations, 0);
+}
+
+// Units the testing package reports itself; any others come from b.ReportMetric
+const standardUnits = new Set(['ns/op', 'B/op', 'allocs/op', 'MB/s']);
+
+/**
+ * Summarizes the metrics the named benchmark reported with b.ReportMetric,
+ * such as allocs/msg, by unit.
+ */
+export const customMetrics = (runs: BenchmarkRun[], name: string): Map<string, Stats> => {
+    const units = new Set(runs
+        .filter(r => r.name === name)
+        .flatMap(r => Object.keys(r.metrics))
+        .filter(unit => !standardUnits.has(unit)));
+
+    const metrics = new Map<string, Stats>();
+    for (const unit of [...units].sort()) {
+        const stats = summarizeMetric(runs, name, unit);
+        if (stats) {
+            metrics.set(unit, stats);
+        }
+    }
+    return metrics;
+}
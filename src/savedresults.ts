@@ -0,0 +1,104 @@
+import * as vscode from 'vscode';
+import * as fs from 'fs';
+import * as path from 'path';
+import * as crypto from 'crypto';
+
+// Benchmark results persisted across sessions, so they are still there
+// after a window reload: what each run printed in workspaceState, and its
+// memory profiles in files under the workspace's storage directory.
+
+const resultsKey = 'goAllocations.results.v2';
+// Before profiles had files of their own, they were in workspaceState, base64 encoded
+const legacyResultsKey = 'goAllocations.results.v1';
+
+// The saved profiles take at most this much space; the oldest runs go first
+const maxSavedBytes = 64 * 1024 * 1024;
+
+/**
+ * What a run needs to show its results again, with its memory profiles:
+ * the benchmark's output, for the per-op numbers, and how it ran.
+ */
+export interface SavedResult {
+    // When it ran, as an ISO string
+    time: string;
+    flags: string[];
+    toolchain: string;
+    stdout: string;
+}
+
+interface StoredResult extends SavedResult {
+    // Of each profile's file; a run until stable has a profile per round
+    sizes: number[];
+}
+
+// A profile's file for a benchmark, as keyed by the tree
+const profileFile = (dir: string, key: string, index: number): string =>
+    path.join(dir, 'results', `${crypto.createHash('sha256').update(key).digest('hex').slice(0, 32)}-${index}.pb.gz`);
+
+const stored = (state: vscode.Memento): Record<string, StoredResult> =>
+    state.get<Record<string, StoredResult>>(resultsKey, {});
+
+const removeProfiles = async (dir: string, key: string, result: StoredResult | undefined): Promise<void> => {
+    for (let i = 0; i < (result?.sizes.length ?? 0); i++) {
+        await fs.promises.rm(profileFile(dir, key, i), { force: true });
+    }
+}
+
+// By benchmark, as keyed by the tree
+export const savedResults = (state: vscode.Memento): Map<string, SavedResult> =>
+    new Map(Object.entries(stored(state)));
+
+// The memory profiles saved with the benchmark's result, as written
+export const savedProfiles = (state: vscode.Memento, dir: string, key: string): Promise<Buffer[]> =>
+    Promise.all((stored(state)[key]?.sizes ?? []).map((_, i) => fs.promises.readFile(profileFile(dir, key, i))));
+
+/**
+ * Saves the result of the benchmark's latest run, with its profiles, or
+ * without any, removes what was saved, so results from an earlier run
+ * don't come back. Without a storage directory, as in a window with no
+ * folder open, nothing is saved.
+ */
+export const saveResult = async (
+    state: vscode.Memento,
+    dir: string | undefined,
+    key: string,
+    result: SavedResult | undefined,
+    profiles: Buffer[]
+): Promise<void> => {
+    if (!dir) {
+        return;
+    }
+    await removeProfiles(dir, key, stored(state)[key]);
+    const save = result !== undefined && profiles.length > 0;
+    if (save) {
+        await fs.promises.mkdir(path.join(dir, 'results'), { recursive: true });
+        for (const [i, profile] of profiles.entries()) {
+            await fs.promises.writeFile(profileFile(dir, key, i), profile);
+        }
+    }
+
+    // Read only now, so runs that finish together don't drop each other's
+    const results = { ...stored(state) };
+    delete results[key];
+    if (save) {
+        results[key] = { ...result, sizes: profiles.map(p => p.length) };
+    }
+
+    // Newest first, those that don't fit any more are evicted
+    const evicted: [string, StoredResult][] = [];
+    let total = 0;
+    for (const k of Object.keys(results).sort((a, b) => Date.parse(results[b].time) - Date.parse(results[a].time))) {
+        total += results[k].sizes.reduce((sum, size) => sum + size, 0);
+        if (total > maxSavedBytes) {
+            evicted.push([k, results[k]]);
+            delete results[k];
+        }
+    }
+    await state.update(resultsKey, results);
+    if (state.get(legacyResultsKey) !== undefined) {
+        await state.update(legacyResultsKey, undefined);
+    }
+    for (const [k, result] of evicted) {
+        await removeProfiles(dir, k, result);
+    }
+}
@@ -0,0 +1,62 @@
+import * as vscode from 'vscode';
+import * as path from 'path';
+import { TreeDataProvider, Item, AllocationItem } from './treedata';
+
+/**
+ * The stacks of one allocation site, in a panel of their own: the one last
+ * selected in the tree, or at the cursor in an editor. It keeps showing
+ * them until another site is picked, so stacks can be followed without
+ * expanding the tree.
+ */
+export class StacksPanel implements vscode.TreeDataProvider<Item> {
+    private onDidChangeTreeDataEmitter = new vscode.EventEmitter<Item | undefined>();
+    readonly onDidChangeTreeData: vscode.Event<Item | undefined> = this.onDidChangeTreeDataEmitter.event;
+
+    // Items come from the tree, which renders them as the view's settings say
+    private readonly treeData: TreeDataProvider;
+    private view: vscode.TreeView<Item> | undefined;
+    private allocation: AllocationItem | undefined;
+
+    constructor(treeData: TreeDataProvider) {
+        this.treeData = treeData;
+    }
+
+    setTreeView(view: vscode.TreeView<Item>): void {
+        this.view = view;
+        this.view.message = 'Select an allocation in the tree, or put the cursor on an allocating line.';
+    }
+
+    // Shows the site's stacks; the same site again leaves them as they are
+    show(allocation: AllocationItem): void {
+        if (allocation === this.allocation) {
+            return;
+        }
+        this.allocation = allocation;
+        if (this.view) {
+            const { functionName } = allocation.allocationData;
+            this.view.message = `${functionName.slice(functionName.lastIndexOf('/') + 1)} at ${path.basename(allocation.filePath)}:${allocation.lineNumber} · ${allocation.description ?? ''}`;
+        }
+        this.onDidChangeTreeDataEmitter.fire(undefined);
+    }
+
+    // After a change of the view's settings, or a run that replaced the site
+    refresh(): void {
+        this.onDidChangeTreeDataEmitter.fire(undefined);
+    }
+
+    getTreeItem(element: Item): vscode.TreeItem {
+        const item = this.treeData.getTreeItem(element);
+        // Open, since there's nothing else here to look at
+        if (item.contextValue === 'stack') {
+            item.collapsibleState = vscode.TreeItemCollapsibleState.Expanded;
+        }
+        return item;
+    }
+
+    getChildren(element?: Item): vscode.ProviderResult<Item[]> {
+        if (!element) {
+            return this.allocation ? this.treeData.stacksOf(this.allocation) : [];
+        }
+        return this.treeData.getChildren(element);
+    }
+}
@@ -0,0 +1,37 @@
+import * as vscode from 'vscode';
+import { BenchmarkItem } from './treedata';
+
+/**
+ * The latest run's headline in the status bar, e.g. BenchmarkFoo 128 B/op ·
+ * 3 allocs/op · vs baseline +12% B/op. Clicking it opens a menu for that
+ * benchmark. Hidden until a benchmark finishes.
+ */
+export class RunStatusBar implements vscode.Disposable {
+    private readonly item = vscode.window.createStatusBarItem('goAllocations.lastRun', vscode.StatusBarAlignment.Left, 50);
+    // The benchmark's latest results in a line, undefined if it has none
+    private readonly headline: (item: BenchmarkItem) => string | undefined;
+    // The benchmark shown, for the menu
+    benchmark: BenchmarkItem | undefined;
+
+    constructor(headline: (item: BenchmarkItem) => string | undefined) {
+        this.headline = headline;
+        this.item.name = 'Go Allocations: latest run';
+        this.item.command = 'goAllocations.statusBarMenu';
+    }
+
+    // Shows the benchmark's results; a run that failed leaves the last one shown
+    show(benchmark: BenchmarkItem): void {
+        const headline = this.headline(benchmark);
+        if (headline === undefined) {
+            return;
+        }
+        this.benchmark = benchmark;
+        this.item.text = `$(dashboard) ${benchmark.fullName} ${headline}`;
+        this.item.tooltip = `Latest run in Go Allocations Explorer: ${benchmark.fullName}\n${headline}\n\nClick to run again, show it in the tree, or hide the decorations`;
+        this.item.show();
+    }
+
+    dispose(): void {
+        this.item.dispose();
+    }
+}
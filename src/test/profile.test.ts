@@ -0,0 +1,56 @@
+import { test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import * as fs from 'fs';
+import * as path from 'path';
+import * as zlib from 'zlib';
+import { parseProfile, lineTotals } from '../profile';
+
+// join.pb.gz: go1.27 test -run='^$' -bench='^BenchmarkJoin$' -benchtime=1000x -memprofilerate=1 -memprofile
+const fixture = (name: string) => fs.readFileSync(path.resolve('src/test/fixtures', name));
+
+// Protobuf encoding, just enough to write profiles by hand
+const varint = (n: number): number[] => {
+    const bytes: number[] = [];
+    let v = BigInt.asUintN(64, BigInt(n));
+    do {
+        const b = Number(v & 0x7fn);
+        v >>= 7n;
+        bytes.push(v > 0n ? b | 0x80 : b);
+    } while (v > 0n);
+    return bytes;
+};
+const int = (field: number, n: number): number[] => [...varint(field * 8), ...varint(n)];
+const message = (field: number, bytes: number[]): number[] => [...varint(field * 8 + 2), ...varint(bytes.length), ...bytes];
+const string = (field: number, s: string): number[] => message(field, [...Buffer.from(s)]);
+
+test('parseProfile reads a go test -memprofile', () => {
+    const profile = parseProfile(fixture('join.pb.gz'));
+    assert.deepEqual(profile.sampleTypes.map(t => t.type), ['alloc_objects', 'alloc_space', 'inuse_objects', 'inuse_space']);
+    assert.equal(profile.defaultSampleType, 'alloc_space');
+
+    const join = lineTotals(profile, fn => fn.name === 'example.com/fx.BenchmarkJoin');
+    assert.equal(join.length, 1);
+    assert.equal(path.basename(join[0].fn.filename), 'fx_test.go');
+    assert.equal(join[0].line, 13);
+    assert.ok(join[0].cum[1] > 0);
+});
+
+test('parseProfile reads int64 values as two\'s complement', () => {
+    const profile = parseProfile(Buffer.from([
+        ...message(1, [...int(1, 1), ...int(2, 2)]),
+        // Packed values, then a label with a number
+        ...message(2, [...message(2, [...varint(-8), ...varint(2 ** 40)]), ...message(3, [...int(1, 3), ...int(3, -1)])]),
+        ...string(6, ''),
+        ...string(6, 'alloc_space'),
+        ...string(6, 'bytes'),
+        ...string(6, 'bucket')
+    ]));
+    assert.deepEqual(profile.samples[0].values, [-8, 2 ** 40]);
+    assert.equal(profile.samples[0].labels[0].key, 'bucket');
+    assert.equal(profile.samples[0].labels[0].num, -1);
+});
+
+test('parseProfile rejects a truncated profile', () => {
+    const data = zlib.gunzipSync(fixture('join.pb.gz'));
+    assert.throws(() => parseProfile(data.subarray(0, data.length - 3)), /Truncated profile/);
+});
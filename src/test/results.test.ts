@@ -0,0 +1,34 @@
+import { test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import { parseBenchmarkRuns, summarizeMetric } from '../results';
+
+test('parseBenchmarkRuns reads each result line, without the GOMAXPROCS suffix', () => {
+    const runs = parseBenchmarkRuns([
+        'goos: linux',
+        'BenchmarkJoin-8   \t 1000000\t      1206 ns/op\t       8 B/op\t       1 allocs/op',
+        'BenchmarkSub/size=10-8         \t    5000\t    250.5 ns/op\t  12.50 MB/s\t     128 B/op\t       2 allocs/op',
+        'BenchmarkJoin \t1000\t1176 ns/op',
+        'PASS'
+    ].join('\n'));
+    assert.deepEqual(runs.map(r => r.name), ['BenchmarkJoin', 'BenchmarkSub/size=10', 'BenchmarkJoin']);
+    assert.deepEqual(runs[0], { name: 'BenchmarkJoin', iterations: 1000000, metrics: { 'ns/op': 1206, 'B/op': 8, 'allocs/op': 1 } });
+    assert.equal(runs[1].metrics['MB/s'], 12.5);
+    assert.deepEqual(runs[2].metrics, { 'ns/op': 1176 });
+});
+
+test('parseBenchmarkRuns keeps b.ReportMetric units', () => {
+    const [run] = parseBenchmarkRuns('BenchmarkDecode-4  \t 200\t 5000 ns/op\t 3.000 allocs/msg\t 64 B/op');
+    assert.equal(run.metrics['allocs/msg'], 3);
+    assert.equal(run.metrics['B/op'], 64);
+});
+
+test('parseBenchmarkRuns skips lines that aren\'t results', () => {
+    const runs = parseBenchmarkRuns([
+        'BenchmarkJoinMany',
+        '    fx_test.go:19: logged',
+        '--- FAIL: BenchmarkFail',
+        'ok  \texample.com/fx\t0.011s'
+    ].join('\n'));
+    assert.deepEqual(runs, []);
+    assert.equal(summarizeMetric(runs, 'BenchmarkJoinMany', 'B/op'), undefined);
+});
@@ -0,0 +1,81 @@
+import { test } from 'node:test';
+import * as assert from 'node:assert/strict';
+import * as fs from 'fs';
+import * as path from 'path';
+import { parseTestEvents, eventOutput, eventOwner, testStatuses } from '../testjson';
+import { parseBenchmarkRuns, summarizeMetric } from '../results';
+
+// Output of go1.27 test -json -run='^$' -benchmem -benchtime=1000x, with
+// count3: -bench='^BenchmarkJoin$' -count=3
+// cpu: -bench='^BenchmarkJoin' -count=2 -cpu=1,2, where BenchmarkJoinMany calls b.Log
+// subfail: -bench='^Benchmark(Sub|Fail)$' -count=2, where BenchmarkSub has b.Run cases and BenchmarkFail calls b.Fatal
+const fixture = (name: string) => parseTestEvents(fs.readFileSync(path.resolve('src/test/fixtures', name), 'utf8'));
+
+test('eventOutput keeps every -count run of a benchmark', () => {
+    const runs = parseBenchmarkRuns(eventOutput(fixture('count3.jsonl'), 'BenchmarkJoin'));
+    assert.equal(runs.length, 3);
+    assert.deepEqual(runs.map(r => r.metrics['B/op']), [8, 8, 8]);
+    assert.equal(summarizeMetric(runs, 'BenchmarkJoin', 'allocs/op')?.count, 3);
+});
+
+test('eventOutput keeps every -cpu run, and only the named benchmark\'s', () => {
+    const events = fixture('cpu.jsonl');
+    const join = parseBenchmarkRuns(eventOutput(events, 'BenchmarkJoin'));
+    assert.deepEqual(join.map(r => r.name), ['BenchmarkJoin', 'BenchmarkJoin', 'BenchmarkJoin', 'BenchmarkJoin']);
+
+    const many = eventOutput(events, 'BenchmarkJoinMany');
+    assert.equal(parseBenchmarkRuns(many).length, 4);
+    assert.equal(many.split('\n').filter(line => line.includes('fx_test.go:19: logged')).length, 8);
+    assert.ok(!eventOutput(events, 'BenchmarkJoin').includes('logged'));
+});
+
+test('eventOutput leaves the package\'s own lines to the package', () => {
+    const output = eventOutput(fixture('count3.jsonl'), 'BenchmarkJoin');
+    assert.ok(!output.includes('goos:'));
+    assert.ok(!output.includes('PASS'));
+    assert.ok(!output.includes('ok  \texample.com/fx'));
+    assert.equal(parseBenchmarkRuns(eventOutput(fixture('count3.jsonl'))).length, 3);
+});
+
+test('eventOutput attributes later runs of a sub-benchmark to it', () => {
+    const events = fixture('subfail.jsonl');
+    assert.equal(parseBenchmarkRuns(eventOutput(events, 'BenchmarkSub/xx')).length, 2);
+    assert.equal(parseBenchmarkRuns(eventOutput(events, 'BenchmarkSub/xxxx')).length, 2);
+    assert.equal(parseBenchmarkRuns(eventOutput(events, 'BenchmarkSub')).length, 0);
+});
+
+test('eventOutput of a failed benchmark ends with its failure', () => {
+    const events = fixture('subfail.jsonl');
+    const output = eventOutput(events, 'BenchmarkFail');
+    assert.ok(output.includes('sub_test.go:19: boom'));
+    assert.ok(!output.includes('exit status 1'));
+    assert.equal(testStatuses(events).get('BenchmarkFail'), 'fail');
+});
+
+test('eventOwner gives each result line, with Test or without, to its benchmark', () => {
+    const owner = eventOwner();
+    let lines = 0;
+    for (const event of fixture('cpu.jsonl')) {
+        const name = owner(event);
+        const run = parseBenchmarkRuns(event.Output ?? '')[0];
+        if (run) {
+            assert.equal(name, run.name);
+            lines++;
+        }
+    }
+    assert.equal(lines, 8);
+});
+
+test('eventOutput leaves out other benchmarks\' output, with Test or without', () => {
+    const events = parseTestEvents([
+        { Action: 'output', Package: 'example.com/fx', Output: 'goos: linux\n' },
+        { Action: 'run', Package: 'example.com/fx', Test: 'BenchmarkA' },
+        { Action: 'output', Package: 'example.com/fx', Test: 'BenchmarkA', Output: 'BenchmarkA\n' },
+        { Action: 'output', Package: 'example.com/fx', Output: 'BenchmarkA-8 \t 10\t 100 ns/op\t 8 B/op\t 1 allocs/op\n' },
+        { Action: 'run', Package: 'example.com/fx', Test: 'BenchmarkB' },
+        { Action: 'output', Package: 'example.com/fx', Test: 'BenchmarkB', Output: 'BenchmarkB\n' },
+        { Action: 'output', Package: 'example.com/fx', Output: 'BenchmarkB-8 \t 10\t 200 ns/op\t 16 B/op\t 2 allocs/op\n' }
+    ].map(e => JSON.stringify(e)).join('\n'));
+    assert.deepEqual(parseBenchmarkRuns(eventOutput(events, 'BenchmarkA')).map(r => r.metrics['B/op']), [8]);
+    assert.deepEqual(parseBenchmarkRuns(eventOutput(events, 'BenchmarkB')).map(r => r.metrics['B/op']), [16]);
+});
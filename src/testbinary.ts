@@ -0,0 +1,161 @@
+import * as path from 'path';
+import * as fs from 'fs';
+import * as os from 'os';
+import * as crypto from 'crypto';
+import { runProcess } from './process';
+
+// go test flags that belong to the test binary, as -test.<name>, and take a value
+const testValueFlags = new Set([
+    'bench', 'benchtime', 'blockprofile', 'blockprofilerate', 'count', 'cpu', 'cpuprofile',
+    'list', 'memprofile', 'memprofilerate', 'mutexprofile', 'mutexprofilefraction',
+    'outputdir', 'parallel', 'run', 'shuffle', 'skip', 'timeout', 'trace'
+]);
+
+// Boolean go test flags that belong to the test binary
+const testBoolFlags = new Set(['benchmem', 'failfast', 'fullpath', 'short', 'v']);
+
+// Build flags that take a separate value, e.g. -tags foo
+const buildValueFlags = new Set([
+    'asmflags', 'exec', 'gccgoflags', 'gcflags', 'installsuffix', 'ldflags', 'mod',
+    'modfile', 'overlay', 'p', 'pgo', 'pkgdir', 'tags', 'toolexec'
+]);
+
+export interface SplitFlags {
+    // For go test -c
+    buildFlags: string[];
+    // For the test binary, with the test. prefix
+    testFlags: string[];
+}
+
+/**
+ * Splits go test flags into those for building the test binary and those
+ * for running it, as go test does.
+ */
+export const splitFlags = (flags: string[]): SplitFlags => {
+    const buildFlags: string[] = [];
+    const testFlags: string[] = [];
+
+    for (let i = 0; i < flags.length; i++) {
+        const flag = flags[i];
+        const match = flag.match(/^--?([\w.-]+)(=.*)?$/);
+        if (!match) {
+            throw new Error(`Unexpected argument in flags: ${flag}`);
+        }
+
+        const name = match[1].replace(/^test\./, '');
+        const hasValue = match[2] !== undefined;
+
+        if (testValueFlags.has(name) || testBoolFlags.has(name)) {
+            if (testValueFlags.has(name) && !hasValue) {
+                testFlags.push(`-test.${name}=${flags[++i]}`);
+                continue;
+            }
+            testFlags.push(`-test.${name}${match[2] ?? ''}`);
+            continue;
+        }
+
+        buildFlags.push(flag);
+        if (buildValueFlags.has(name) && !hasValue) {
+            buildFlags.push(flags[++i]);
+        }
+    }
+
+    return { buildFlags, testFlags };
+}
+
+// Environment variables that change what go test -c builds
+const buildEnvKeys = ['GOFLAGS', 'GOOS', 'GOARCH', 'GOWORK', 'GOEXPERIMENT', 'CGO_ENABLED', 'GOROOT', 'GOTOOLCHAIN'];
+
+// The files of a package go list reports that go into a build: Go and cgo
+// sources, assembly, syso objects and //go:embed files
+const sourceFields = [
+    'GoFiles', 'CgoFiles', 'CFiles', 'CXXFiles', 'MFiles', 'HFiles', 'FFiles', 'SFiles',
+    'SwigFiles', 'SwigCXXFiles', 'SysoFiles', 'EmbedFiles',
+    'TestGoFiles', 'XTestGoFiles', 'TestEmbedFiles', 'XTestEmbedFiles'
+];
+
+// A directory and file per line, for each package that isn't in the standard
+// library. The files of the generated test main are absolute.
+const sourceTemplate = `{{if not .Standard}}{{$dir := .Dir}}${sourceFields.map(f => `{{range .${f}}}{{$dir}}\t{{.}}\n{{end}}`).join('')}{{end}}`;
+
+/**
+ * A key for the test binary's sources: the names and contents of the files
+ * of the package and every non-standard package it imports, cgo and
+ * embedded files included, along with the build's flags and environment.
+ */
+export const sourceKey = async (
+    go: string,
+    packageDir: string,
+    buildFlags: string[],
+    env: NodeJS.ProcessEnv,
+    signal: AbortSignal
+): Promise<string> => {
+    const { stdout } = await runProcess(
+        go,
+        ['list', '-deps', '-test', '-f', sourceTemplate, ...buildFlags, '.'],
+        { cwd: packageDir, env, signal }
+    );
+
+    const hash = crypto.createHash('sha256');
+    hash.update(JSON.stringify([go, packageDir, buildFlags, buildEnvKeys.map(k => env[k] ?? '')]));
+
+    // TODO: packages in the module cache never change, there's no need to read them
+    const files = [...new Set(stdout.split('\n').filter(line => line.includes('\t')).map(line => {
+        const [dir, file] = line.split('\t');
+        return path.resolve(dir, file.trim());
+    }))].sort();
+    for (const file of files) {
+        hash.update(`${file}\n`);
+        hash.update(await fs.promises.readFile(file));
+    }
+    return hash.digest('hex').slice(0, 16);
+}
+
+const binaryDir = path.join(os.tmpdir(), 'go-allocations-bin');
+
+// Binaries not used for this long are removed when another is built
+const maxBinaryAgeMs = 24 * 60 * 60 * 1000;
+
+// Removes binaries, and builds that never finished, not used for a while
+const removeStaleBinaries = async (): Promise<void> => {
+    const entries = await fs.promises.readdir(binaryDir).catch(() => [] as string[]);
+    for (const entry of entries) {
+        const file = path.join(binaryDir, entry);
+        const stat = await fs.promises.stat(file).catch(() => undefined);
+        if (stat && Date.now() - stat.mtimeMs > maxBinaryAgeMs) {
+            await fs.promises.rm(file, { force: true });
+        }
+    }
+}
+
+/**
+ * Returns the test binary for the package, building it with go test -c
+ * unless one built from the same sources exists. A failed build rejects
+ * with its stderr, as go test would.
+ */
+export const testBinary = async (
+    go: string,
+    packageDir: string,
+    buildFlags: string[],
+    env: NodeJS.ProcessEnv,
+    signal: AbortSignal
+): Promise<string> => {
+    const key = await sourceKey(go, packageDir, buildFlags, env, signal);
+    const binary = path.join(binaryDir, `${path.basename(packageDir)}-${key}.test${process.platform === 'win32' ? '.exe' : ''}`);
+
+    if (fs.existsSync(binary)) {
+        // Marked as used, so it isn't removed as stale
+        const now = new Date();
+        await fs.promises.utimes(binary, now, now).catch(() => undefined);
+        return binary;
+    }
+
+    await fs.promises.mkdir(binaryDir, { recursive: true });
+    await removeStaleBinaries();
+
+    // Build to a temporary name, so a cancelled build never looks complete
+    const partial = `${binary}.${process.pid}.partial`;
+    await runProcess(go, ['test', '-c', '-o', partial, ...buildFlags], { cwd: packageDir, env, signal });
+    await fs.promises.rename(partial, binary);
+    return binary;
+}
@@ -0,0 +1,139 @@
+// Parsing of go test -json output, as described by go doc test2json.
+
+/**
+ * One event from go test -json. Output belongs to Test when set, else to
+ * the package as a whole.
+ */
+export interface TestEvent {
+    Time?: string;
+    // start, run, pause, cont, pass, bench, fail, output, skip, or
+    // build-output and build-fail for a package that doesn't compile
+    Action: string;
+    Package?: string;
+    ImportPath?: string;
+    Test?: string;
+    Output?: string;
+    Elapsed?: number;
+}
+
+export const parseTestEvents = (stdout: string): TestEvent[] => {
+    const events: TestEvent[] = [];
+    for (const line of stdout.split('\n')) {
+        // Anything else, such as a panic in go itself, isn't an event
+        if (!line.startsWith('{')) {
+            continue;
+        }
+        events.push(JSON.parse(line) as TestEvent);
+    }
+    return events;
+}
+
+/**
+ * Calls onEvent for each event as output arrives in chunks, which may end
+ * mid-line.
+ */
+export const eventStream = (onEvent: (event: TestEvent) => void): (chunk: string) => void => {
+    let pending = '';
+    return (chunk: string) => {
+        const lines = (pending + chunk).split('\n');
+        pending = lines.pop() ?? '';
+        for (const event of parseTestEvents(lines.join('\n'))) {
+            onEvent(event);
+        }
+    };
+}
+
+// The package's own closing lines, such as PASS, FAIL or ok  example.com/foo  0.01s
+const packageEndRegex = /^(PASS|FAIL|ok\s)/;
+
+/**
+ * Returns a function that, called on each event in order, says which test
+ * or benchmark it belongs to. A benchmark's first run reports Test, but
+ * the rest of its runs with -count or -cpu come without it, so output
+ * without Test belongs to the benchmark that ran last, until it ends or
+ * the package prints its closing lines.
+ */
+export const eventOwner = (): (event: TestEvent) => string | undefined => {
+    let running: string | undefined;
+    return (event: TestEvent) => {
+        if (event.Test) {
+            const owner = event.Test;
+            running = ['pass', 'fail', 'skip'].includes(event.Action) ? undefined : owner;
+            return owner;
+        }
+        if (event.Action === 'output' && packageEndRegex.test(event.Output ?? '')) {
+            running = undefined;
+        }
+        return running;
+    };
+}
+
+/**
+ * The output the events carry, as go test without -json would print it.
+ * With a name, only the output of that test or benchmark, so logs from
+ * others don't interleave with its results.
+ */
+export const eventOutput = (events: TestEvent[], name?: string): string => {
+    const owner = eventOwner();
+    return events
+        .filter(e => {
+            const test = owner(e);
+            return e.Action === 'output' && (name === undefined || test === name);
+        })
+        .map(e => e.Output ?? '')
+        .join('');
+}
+
+// Compiler output, which go test -json reports as events since Go 1.24
+export const buildOutput = (events: TestEvent[]): string =>
+    events
+        .filter(e => e.Action === 'build-output')
+        .map(e => e.Output ?? '')
+        .join('');
+
+/**
+ * What a skipped test or benchmark logged, which ends with the b.Skip
+ * message, e.g. "needs a network". Undefined if it logged nothing.
+ */
+export const skipMessage = (events: TestEvent[], name: string): string | undefined => {
+    const messages = eventOutput(events, name)
+        .split('\n')
+        .map(line => line.match(/^\s+[^\s:]+\.go:\d+: (.*)$/)?.[1])
+        .filter((message): message is string => message !== undefined);
+    return messages.length > 0 ? messages.join('\n') : undefined;
+}
+
+export type TestStatus = 'running' | 'pass' | 'fail' | 'skip';
+
+/**
+ * The status of each test or benchmark the events mention, by name: the
+ * last of run, pass, fail and skip. A benchmark that has started but not
+ * finished is running. Benchmarks that succeed may not report pass, so
+ * once the run is over, running means it passed.
+ */
+export const testStatuses = (events: TestEvent[]): Map<string, TestStatus> => {
+    const statuses = new Map<string, TestStatus>();
+    for (const event of events) {
+        if (!event.Test) {
+            continue;
+        }
+        switch (event.Action) {
+            case 'run':
+            case 'cont':
+                statuses.set(event.Test, 'running');
+                break;
+            case 'pass':
+            case 'fail':
+            case 'skip':
+                statuses.set(event.Test, event.Action);
+                break;
+            case 'output':
+                // Benchmarks don't always get a run event, output means it started
+                if (!statuses.has(event.Test)) {
+                    statuses.set(event.Test, 'running');
+                }
+                break;
+        }
+    }
+    return statuses;
+}
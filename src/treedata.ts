@@ -2,22 +2,35 @@ import * as vscode from 'vscode';
 import * as path from 'path';
 import * as fs from 'fs';
 import * as os from 'os';
-import { exec, spawn } from 'child_process';
-import { promisify } from 'util';
-import * as readline from 'readline';
-import { quote } from 'shell-quote';
-import { Sema } from 'async-sema';
-
-const execAsync = promisify(exec);
-
-export type Item = ModuleItem | PackageItem | BenchmarkItem | InformationItem | AllocationItem;
+import { parse, quote } from 'shell-quote';
+import {
+    ModuleCache, PackageCache, BenchmarkCache, DiscoveryStrategy, getDiscoveryStrategy,
+    readModuleName, listModuleName, prescanPackages, scanPackage, unsavedOverlays,
+    saveModules, clearSavedModules, restoreModule, findBenchmarkSymbols, goplsPackages, goTestListPackages,
+    ModuleRoot, findModuleRoots, isWithin, isExcluded, BuildError, parseBuildErrors, mergeProvisional, constraintTags, LoopStyle,
+    hasTestFiles
+} from './discovery';
+import { parseBenchmarkRuns, summarizeMetric, countedAllocations, customMetrics, Stats, parsePanic } from './results';
+import { runProcess } from './process';
+import { testEnv, goCommand, goEnv, goVersion, benchmarkExecution } from './env';
+import { sourceKey, splitFlags, testBinary } from './testbinary';
+import { sourceRoots, resolveSourcePath, SourceRoots } from './paths';
+import { Profile, parseProfile, defaultSampleIndex, lineTotals, functionTotals, formatValue, mergeProfiles, diffProfiles, stacksAt, inlinedAt, packageShares, filterProfile, filterSamples, sampleLabel, profileLabels, profileTotals, ProfileFunction, Stack, Frame, ValueType } from './profile';
+import { TestEvent, parseTestEvents, eventOutput, eventOwner, buildOutput, testStatuses, eventStream, skipMessage } from './testjson';
+import { SavedResult, savedResults, savedProfiles, saveResult } from './savedresults';
+import { loadProfile } from './helper';
+import { heatLevel, heatColor } from './heat';
+import { escapeAnalysis, EscapeFinding, InliningDecision, InliningNote } from './escape';
+import { disassemble } from './disasm';
+
+export type Item = ModuleItem | PackageItem | BenchmarkItem | InformationItem | ImportedProfileItem | DiffItem | AllocationItem | SmallSitesItem | FunctionItem | OwnerItem | LabelItem | StackItem | FrameItem | InlinedItem | HiddenFramesItem | BuildErrorItem | StatsItem | CpuItem | ExperimentItem;
 
 class InformationItem extends vscode.TreeItem {
     public readonly contextValue: 'information' = 'information';
 
     constructor(
         label: string,
-        iconType: 'error' | 'info' | 'none' = 'none'
+        iconType: 'error' | 'warning' | 'info' | 'loading~spin' | 'clock' | 'tools' | 'history' | 'none' = 'none'
     ) {
         super(label, vscode.TreeItemCollapsibleState.None);
 
@@ -27,11 +40,33 @@ class InformationItem extends vscode.TreeItem {
     }
 }
 
+// Module roots nested within root, whose packages belong to them rather than to root
+const nestedRoots = (root: ModuleRoot, roots: ModuleRoot[]): string[] =>
+    roots.filter(r => r.path !== root.path && isWithin(r.path, root.path)).map(r => r.path);
+
+// The tooltip's hint on items that open their line when clicked
+const viewSourceHint = 'Click to view the source code line';
+
+// A compile error, which navigates to its location when clicked
+class BuildErrorItem extends vscode.TreeItem {
+    public readonly contextValue: 'buildError' = 'buildError';
+    public readonly buildError: BuildError;
+
+    constructor(buildError: BuildError) {
+        super(`${path.basename(buildError.file)}:${buildError.line}: ${buildError.message}`, vscode.TreeItemCollapsibleState.None);
+        this.buildError = buildError;
+        this.iconPath = new vscode.ThemeIcon('error');
+        this.tooltip = `${buildError.file}:${buildError.line}:${buildError.column}\n${buildError.message}\n\n${viewSourceHint}`;
+    }
+
+    async navigateTo(): Promise<void> {
+        await navigateTo(this.buildError.file, this.buildError.line);
+    }
+}
+
 const getPackageLabel = (pkg: PackageCache): string => {
     // Get the workspace folder that contains this package
-    const workspaceFolder = vscode.workspace.workspaceFolders?.find(folder =>
-        pkg.path.startsWith(folder.uri.fsPath)
-    );
+    const workspaceFolder = vscode.workspace.getWorkspaceFolder(vscode.Uri.file(pkg.path));
 
     if (workspaceFolder) {
         const relativePath = path.relative(workspaceFolder.uri.fsPath, pkg.path);
@@ -46,34 +81,80 @@ const getPackageLabel = (pkg: PackageCache): string => {
     return pkg.name;
 }
 
+/**
+ * Which benchmarks the tree shows: all of them, or only those in the
+ * active editor's file, with their ancestors expanded. Packages with
+ * test files but no benchmarks are shown only when showEmpty is set.
+ */
+interface BenchmarkScope {
+    includes: (benchmark: BenchmarkCache) => boolean;
+    expand: boolean;
+    showEmpty: boolean;
+}
+
+const hasBenchmarks = (packages: PackageCache[]): boolean =>
+    packages.some(p => p.benchmarks.length > 0);
+
+const showsPackage = (pkg: PackageCache, scope: BenchmarkScope): boolean =>
+    pkg.benchmarks.some(scope.includes) || (scope.showEmpty && pkg.benchmarks.length === 0);
+
 class ModuleItem extends vscode.TreeItem {
     public readonly moduleName: string;
     public readonly modulePath: string;
+    public readonly goWork: string | undefined;
     public readonly contextValue: 'module' = 'module';
 
     constructor(
         moduleName: string,
-        modulePath: string
+        modulePath: string,
+        goWork: string | undefined,
+        collapsibleState: vscode.TreeItemCollapsibleState = vscode.TreeItemCollapsibleState.Collapsed
     ) {
-        super(moduleName, vscode.TreeItemCollapsibleState.Expanded);
+        super(moduleName, collapsibleState);
         this.moduleName = moduleName;
         this.modulePath = modulePath;
+        this.goWork = goWork;
+        if (goWork === 'off') {
+            this.tooltip = `Go module: ${moduleName}\nNot in go.work, runs with GOWORK=off`;
+        } else if (goWork) {
+            this.tooltip = `Go module: ${moduleName}\nWorkspace: ${goWork}`;
+        }
     }
 
-    getChildren(modules: ModuleCache[]): PackageItem[] {
+    // Called by the framework only when the module is expanded
+    getChildren(
+        modules: ModuleCache[],
+        packageItemCache: PackageItemCache,
+        discovering: boolean,
+        scope: BenchmarkScope
+    ): (PackageItem | InformationItem)[] {
         const module = modules.find(m => m.path === this.modulePath);
         if (!module) {
             throw new Error('Module not found in cache');
         }
 
+        if (module.packages.length === 0 && discovering) {
+            return [new InformationItem('Loading packages...', 'loading~spin')];
+        }
+
         const packages: PackageItem[] = [];
 
-        for (const pkg of module.packages) {
+        for (const pkg of module.packages.filter(p => showsPackage(p, scope))) {
+            const empty = pkg.benchmarks.length === 0 && !pkg.buildErrors?.length;
             const item = new PackageItem(
                 getPackageLabel(pkg),
                 pkg.path,
-                this
+                this,
+                empty ? vscode.TreeItemCollapsibleState.None
+                    : scope.expand ? vscode.TreeItemCollapsibleState.Expanded
+                        : vscode.TreeItemCollapsibleState.Collapsed
             );
+            if (pkg.buildErrors?.length) {
+                item.description = 'build failed';
+            } else if (empty) {
+                item.description = 'no benchmarks';
+            }
+            packageItemCache.set(item.filePath, item);
             packages.push(item);
         }
 
@@ -89,16 +170,22 @@ class PackageItem extends vscode.TreeItem {
     constructor(
         label: string,
         filePath: string,
-        parent: ModuleItem
+        parent: ModuleItem,
+        collapsibleState: vscode.TreeItemCollapsibleState = vscode.TreeItemCollapsibleState.Collapsed
     ) {
-        super(label, vscode.TreeItemCollapsibleState.Expanded);
+        super(label, collapsibleState);
         this.filePath = filePath;
         this.parent = parent;
         this.iconPath = new vscode.ThemeIcon('package');
         this.tooltip = `Go package: ${label}\nPath: ${filePath}`;
     }
 
-    getChildren(modules: ModuleCache[], benchmarkItemCache: BenchmarkItemCache): BenchmarkItem[] {
+    // Called by the framework only when the package is expanded
+    getChildren(
+        modules: ModuleCache[],
+        benchmarkItemCache: BenchmarkItemCache,
+        scope: BenchmarkScope
+    ): (BuildErrorItem | BenchmarkItem)[] {
         // Find the package in the modules structure
         const module = modules.find(m => m.packages.some(p => p.path === this.filePath));
         if (!module) {
@@ -112,94 +199,719 @@ class PackageItem extends vscode.TreeItem {
 
         const benchmarkItems: BenchmarkItem[] = [];
 
-        for (const benchmark of pkg.benchmarks) {
+        for (const benchmark of pkg.benchmarks.filter(scope.includes)) {
+            // A re-render keeps the items, with their results and any run in flight, so it doesn't run them again
+            const existing = benchmarkItemCache.find(this.filePath, benchmark.name);
+            if (existing && sameDeclaration(existing.benchmark, benchmark)) {
+                existing.rediscovered(benchmark, this);
+                benchmarkItems.push(existing);
+                continue;
+            }
             const item = new BenchmarkItem(benchmark, this);
             benchmarkItemCache.add(item);
             benchmarkItems.push(item);
         }
 
-        return benchmarkItems;
+        // Errors first, they are why the benchmarks won't run
+        const errorItems = (pkg.buildErrors ?? []).map(e => new BuildErrorItem(e));
+        return [...errorItems, ...benchmarkItems];
     }
 }
 
+// Whether a rediscovered benchmark is declared as before, so its item and badges still hold; it may have moved
+const sameDeclaration = (a: BenchmarkCache, b: BenchmarkCache): boolean =>
+    a.unsaved === b.unsaved &&
+    a.buildConstraint === b.buildConstraint &&
+    a.externalPackage === b.externalPackage &&
+    a.loopStyle === b.loopStyle &&
+    (a.subBenchmarks ?? []).join('\n') === (b.subBenchmarks ?? []).join('\n');
+
+const loopStyleDescriptions: Record<LoopStyle, string> = {
+    'b.Loop': 'for b.Loop() (setup runs once)',
+    'b.N': 'for b.N (setup runs once per round)'
+};
+
 const noAllocationsItem = new InformationItem('No allocations found', 'info');
-const routineRegex = /^ROUTINE\s*=+\s*(.+?)\s+in\s+(.+)$/;
-const lineRegex = /^\s*(\d+(?:\.\d+)?[KMGT]?B)?\s*(\d+(?:\.\d+)?[KMGT]?B)?\s*(\d+):\s*(.+)$/;
+// A -benchtime value: a duration such as 500ms or 1m30s, or an iteration count such as 100x
+export const benchtimeRegex = /^(\d+x|(\d+(\.\d*)?(ns|us|µs|ms|s|m|h))+)$/;
+
+const memprofilerate = 1024 * 64; // 64K
+
+// How much of a timed out run's output to show
+const maxTimeoutLines = 20;
+
+/**
+ * Overrides for a single run of a benchmark. Flags, if set, replace the
+ * default flags; -bench and -memprofile are always added.
+ */
+export interface RunOverrides {
+    benchtime?: string;
+    flags?: string[];
+    // GOMAXPROCS values to run with, each with a profile of its own; by default from the cpu setting, or none with flags
+    cpus?: number[];
+    // An alternate go executable, such as go1.23.4 from golang.org/dl
+    goExecutable?: string;
+    // Record every allocation, with -memprofilerate=1, rather than a sample
+    exact?: boolean;
+    // Merge the profile with those behind the current results, to reduce sampling noise
+    merge?: boolean;
+    // Build and run with the race detector
+    race?: boolean;
+    // Run with -short, regardless of the short setting
+    short?: boolean;
+    // Runtime variables such as GOGC, see parseRuntimeEnv
+    env?: Record<string, string>;
+    // GOEXPERIMENT values, e.g. arenas; runs with and without them, to compare
+    experiment?: string;
+    // Repeat with increasing -count until allocs/op is stable
+    untilStable?: boolean;
+}
+
+// The runtime's default, when no -memprofilerate is given
+const defaultMemprofilerate = 512 * 1024;
+
+// The -memprofilerate the flags set; the last one wins, as with the flag package
+const memprofileRateOf = (flags: string[]): number => {
+    let rate = defaultMemprofilerate;
+    for (const flag of flags) {
+        const match = flag.match(/^--?(?:test\.)?memprofilerate=(\d+)$/);
+        if (match) {
+            rate = parseInt(match[1]);
+        }
+    }
+    return rate;
+}
+
+// Says whether results are exact or sampled, so they're read accordingly
+const samplingItem = (rate: number): InformationItem => {
+    if (rate === 1) {
+        const item = new InformationItem('Exact', 'info');
+        item.description = 'every allocation recorded';
+        item.tooltip = 'Run with -memprofilerate=1: every allocation site is in the profile';
+        return item;
+    }
+    const item = new InformationItem('Sampled', 'info');
+    item.description = `about one per ${rate >= 1024 ? `${rate / 1024} KB` : `${rate} B`} allocated`;
+    item.tooltip = `Run with -memprofilerate=${rate}: byte counts are estimates, and small or rare allocation sites may be missing. Run in exact mode to see every allocation.`;
+    return item;
+}
+
+// Says the results are out of date with the source, and runs again when clicked
+const staleItem = (item: BenchmarkItem): InformationItem => {
+    const stale = new InformationItem('Stale', 'warning');
+    stale.description = 'source changed since this run, click to run again';
+    stale.tooltip = 'A file these results point into was edited after the run, so line numbers may be off';
+    stale.command = { command: 'goAllocations.runSingleBenchmark', title: 'Run again', arguments: [item] };
+    return stale;
+}
+
+// Below this share of the allocations -benchmem counted, sampling likely missed many
+const undersampledShare = 0.5;
+
+/**
+ * The allocations in a profile, for comparing with those -benchmem
+ * counted. The profile covers the whole run, ramp-up rounds and setup
+ * included, so it should have at least as many. Undefined if the profile
+ * doesn't count objects.
+ */
+const sampledAllocations = (profile: Profile): number | undefined => {
+    const index = profile.sampleTypes.findIndex(st => st.type === 'alloc_objects');
+    return index < 0 ? undefined : profileTotals(profile)[index];
+}
+
+/**
+ * Splits user-entered go test flags as a shell would. The flags are
+ * passed to go test as arguments, not to a shell, so anything beyond
+ * words and quoting is rejected.
+ */
+export const parseFlags = (input: string): string[] => {
+    const flags: string[] = [];
+    for (const entry of parse(input)) {
+        if (typeof entry !== 'string') {
+            throw new Error(`Unsupported shell syntax in flags: ${input}`);
+        }
+        if (/^--?(bench|memprofile)=/.test(entry)) {
+            throw new Error(`${entry} is set by the extension, remove it from the flags`);
+        }
+        flags.push(entry);
+    }
+    return flags;
+}
+// Variables that configure the Go runtime, which may be set for a run
+export const runtimeEnvKeys = ['GOGC', 'GOMEMLIMIT', 'GODEBUG'];
+
+/**
+ * Parses user-entered runtime variables, such as GOGC=off GODEBUG=gctrace=1,
+ * split as a shell would. Only runtimeEnvKeys are allowed.
+ */
+export const parseRuntimeEnv = (input: string): Record<string, string> => {
+    const env: Record<string, string> = {};
+    for (const entry of parse(input)) {
+        if (typeof entry !== 'string') {
+            throw new Error(`Unsupported shell syntax in variables: ${input}`);
+        }
+        const match = entry.match(/^(\w+)=(.*)$/);
+        if (!match) {
+            throw new Error(`Expected NAME=value, got ${entry}`);
+        }
+        if (!runtimeEnvKeys.includes(match[1])) {
+            throw new Error(`${match[1]} is not one of ${runtimeEnvKeys.join(', ')}`);
+        }
+        env[match[1]] = match[2];
+    }
+    return env;
+}
+
+// e.g. GOGC=off GODEBUG=gctrace=1, quoted as needed to paste into a shell
+const formatEnv = (env: Record<string, string>): string =>
+    Object.entries(env).map(([key, value]) => quote([`${key}=${value}`])).join(' ');
+
+// The least an allocation site shows with, in the view's sample type or as a percentage of the total
+export interface Threshold {
+    value: number;
+    percent: boolean;
+}
+
+const thresholdUnits: Record<string, number> = { '': 1, b: 1, kb: 1024, mb: 1024 ** 2, gb: 1024 ** 3 };
+
+/**
+ * Parses a threshold such as 4kB, 512, or 1%. Sizes are in bytes, as pprof
+ * formats them; a plain number is bytes or objects, as the sample type is.
+ * Empty means none.
+ */
+export const parseThreshold = (input: string): Threshold | undefined => {
+    if (!input.trim()) {
+        return undefined;
+    }
+    const match = input.trim().match(/^(\d+(?:\.\d+)?)\s*(%|[kmg]?b)?$/i);
+    if (!match) {
+        throw new Error(`Expected a size such as 4kB, a count, or a percentage such as 1%, got ${input}`);
+    }
+    const value = parseFloat(match[1]);
+    const unit = (match[2] ?? '').toLowerCase();
+    return unit === '%' ? { value, percent: true } : { value: value * thresholdUnits[unit], percent: false };
+}
+
+// Samples with a label, or with a label of a value
+export interface LabelFilter {
+    key: string;
+    value?: string;
+}
+
+// Parses key=value, or key for any value. Empty means none.
+export const parseLabelFilter = (input: string): LabelFilter | undefined => {
+    if (!input.trim()) {
+        return undefined;
+    }
+    const match = input.trim().match(/^([^=\s]+)(?:=(.*))?$/);
+    if (!match) {
+        throw new Error(`Expected key=value or key, got ${input}`);
+    }
+    return { key: match[1], value: match[2] };
+}
+
+// Thrown when the benchmark calls b.Skip, so there is nothing to show
+class SkippedError extends Error {
+    readonly reason: string | undefined;
+
+    constructor(name: string, reason: string | undefined) {
+        super(`${name} was skipped`);
+        this.reason = reason;
+    }
+}
+
 
 export class BenchmarkItem extends vscode.TreeItem {
-    public readonly contextValue: 'benchmarkItem' = 'benchmarkItem';
-    public readonly parent: PackageItem;
-    public readonly location: vscode.Location;
+    public contextValue: 'benchmarkItem' | 'unsavedBenchmarkItem' | 'queuedBenchmarkItem';
+    public parent: PackageItem;
+    public location: vscode.Location;
+    public readonly buildTags: string[];
+    public benchmark: BenchmarkCache;
+    // For a sub-benchmark (b.Run), the top-level benchmark that declares it
+    public readonly parentBenchmark: BenchmarkItem | undefined;
+    public readonly subName: string | undefined;
+    // Overrides for the next run only
+    public nextRun: RunOverrides | undefined;
+    // Set while a run is in flight, to cancel just this benchmark
+    private runController: AbortController | undefined;
+    // 1-based position in the run queue, while waiting for a turn
+    public queuePosition: number | undefined;
+    // The Go version that produced the latest results, e.g. go1.23.4
+    public toolchain: string | undefined;
+    // The go command and flags the latest results were built and run with
+    public build: { go: string; flags: string[] } | undefined;
+    // The children from the latest run, so re-rendering the item doesn't run it again
+    public results: BenchmarkChildItem[] | undefined;
+    // The results so far, while running
+    public progress: BenchmarkChildItem[] | undefined;
+    // Re-run on save in watch mode
+    public pinned = false;
+    // Run once, un-profiled, before the measured run; set as each run starts
+    public warmup = false;
+    // The latest results are from a run with the race detector
+    private race = false;
+    // The latest profile has far fewer allocations than -benchmem counted
+    private undersampled = false;
+    // The results are from a run in an earlier session
+    private restored = false;
+    // A file the results point into changed since the run
+    public stale = false;
+    // When the latest results came in, in ms since the epoch
+    public finishedAt: number | undefined;
+    // The latest run, to save for later sessions; undefined if it can't be shown again
+    public result: SavedResult | undefined;
+    // The latest run's memory profiles as written, until they're saved
+    public resultProfiles: Buffer[] = [];
+    // The latest run was skipped, with the b.Skip message if any. Skipped
+    // runs have no numbers, and aren't comparable with those that do.
+    public skipped: { reason: string | undefined } | undefined;
+    // Compile errors and panics from the latest run, for the Problems panel
+    public problems: Problem[] = [];
+    // The latest run's compile errors, which are the package's too
+    public buildErrors: BuildError[] | undefined;
+    // Runtime variables for the run in flight, from RunOverrides.env
+    private runEnv: Record<string, string> = {};
+    // The memory profiles behind the latest results, more than one if merged
+    private profiles: Profile[] = [];
+    // The flags, toolchain, environment and sources of the runs behind
+    // profiles; only runs with the same key are merged
+    private profilesKey: string | undefined;
+    // Called with the results so far while a run is in flight
+    private onProgress: ((items: BenchmarkChildItem[]) => void) | undefined;
+    private badgeDescription: string | undefined;
+    // The tooltip before any run, which the latest run's metrics are added to
+    private baseTooltip: string | undefined;
 
     constructor(
         benchmark: BenchmarkCache,
         parent: PackageItem,
+        parentBenchmark?: BenchmarkItem,
+        subName?: string
     ) {
-        super(benchmark.name, vscode.TreeItemCollapsibleState.Collapsed);
+        super(
+            subName ?? benchmark.name,
+            benchmark.unsaved ? vscode.TreeItemCollapsibleState.None : vscode.TreeItemCollapsibleState.Collapsed
+        );
+        this.contextValue = benchmark.unsaved ? 'unsavedBenchmarkItem' : 'benchmarkItem';
+        this.benchmark = benchmark;
         this.location = benchmark.location;
         this.parent = parent;
+        this.parentBenchmark = parentBenchmark;
+        this.subName = subName;
+        this.buildTags = constraintTags(benchmark.buildConstraint);
+
+        this.iconPath = new vscode.ThemeIcon(subName ? 'symbol-method' : 'symbol-function');
+        this.tooltip = `Click to run ${this.fullName} and discover allocations`;
+        if (benchmark.loopStyle) {
+            this.tooltip += `\nLoop style: ${loopStyleDescriptions[benchmark.loopStyle]}`;
+        }
 
-        this.iconPath = new vscode.ThemeIcon('symbol-function');
-        this.tooltip = `Click to run ${benchmark.name} and discover allocations`;
+        if (subName) {
+            return; // Badges are on the parent
+        }
+
+        if (benchmark.unsaved) {
+            this.iconPath = new vscode.ThemeIcon('circle-large-outline');
+            this.tooltip = `${benchmark.name} is not saved yet. Save the file to run it.`;
+            this.badgeDescription = 'unsaved';
+            this.description = this.badgeDescription;
+            return;
+        }
+
+        // Badges: the external test package, if any, and build tags
+        const badges: string[] = [];
+        if (benchmark.externalPackage) {
+            badges.push(benchmark.externalPackage);
+            this.tooltip += `\nTest package: ${benchmark.externalPackage}`;
+        }
+        if (benchmark.buildConstraint) {
+            badges.push(...this.buildTags.map(tag => `#${tag}`));
+            this.tooltip += `\nBuild constraint: ${benchmark.buildConstraint}`;
+        }
+        if (badges.length > 0) {
+            this.badgeDescription = badges.join(' ');
+            this.description = this.badgeDescription;
+        }
+    }
+
+    // The same declaration, found again, perhaps moved in its file or under a new package item
+    rediscovered(benchmark: BenchmarkCache, parent: PackageItem): void {
+        this.benchmark = benchmark;
+        this.location = benchmark.location;
+        this.parent = parent;
+    }
+
+    // Shows the item as waiting in the run queue, or not; fire a tree change to render it
+    setQueuePosition(position: number | undefined): void {
+        this.queuePosition = position;
+        this.contextValue = position === undefined ? 'benchmarkItem' : 'queuedBenchmarkItem';
+        this.updateDescription();
+    }
+
+    // Shows the item as pinned for watch mode, or not
+    setPinned(pinned: boolean): void {
+        this.pinned = pinned;
+        this.updateDescription();
+    }
+
+    // Marks the results as out of date with the source; a run clears it
+    setStale(): void {
+        this.stale = true;
+        this.updateDescription();
+    }
+
+    /**
+     * Adds the metrics the latest run reported with b.ReportMetric, such as
+     * allocs/msg, to the tooltip, replacing those of earlier runs.
+     */
+    private setCustomMetrics(stdout: string): void {
+        this.baseTooltip ??= typeof this.tooltip === 'string' ? this.tooltip : undefined;
+        const metrics = customMetrics(parseBenchmarkRuns(stdout), this.fullName);
+        const lines = [...metrics].map(([unit, stats]) =>
+            stats.count === 1
+                ? `${formatStat(stats.median)} ${unit}`
+                : `${formatStat(stats.median)} ${unit} (median of ${stats.count}, ±${(stats.relativeStddev * 100).toFixed(1)}%)`
+        );
+        this.tooltip = lines.length > 0
+            ? `${this.baseTooltip ?? ''}\n\nReported metrics:\n${lines.join('\n')}`
+            : this.baseTooltip;
+    }
+
+    // How the latest results compare to the baseline, e.g. +12% B/op; undefined without one
+    private baselineDelta: string | undefined;
+
+    setBaselineDelta(delta: string | undefined): void {
+        this.baselineDelta = delta;
+        this.updateDescription();
+    }
+
+    private updateDescription(): void {
+        const parts: string[] = [];
+        if (this.queuePosition !== undefined) {
+            parts.push(`queued #${this.queuePosition}`);
+        }
+        if (this.pinned) {
+            parts.push('pinned');
+        }
+        if (this.race) {
+            parts.push('race');
+        }
+        if (this.skipped) {
+            parts.push('skipped');
+        }
+        if (this.undersampled) {
+            parts.push('under-sampled');
+        }
+        if (this.restored) {
+            parts.push('from previous session');
+        }
+        if (this.stale) {
+            parts.push('stale');
+        }
+        if (this.badgeDescription) {
+            parts.push(this.badgeDescription);
+        }
+        if (this.baselineDelta) {
+            parts.push(`vs baseline ${this.baselineDelta}`);
+        }
+        this.description = parts.length > 0 ? parts.join(' ') : undefined;
+    }
+
+    // The name as reported by go test, e.g. BenchmarkFoo/case
+    get fullName(): string {
+        return this.subName ? `${this.benchmark.name}/${this.subName}` : this.benchmark.name;
+    }
+
+    // The -bench pattern selecting exactly this benchmark; each level of a sub-benchmark is matched separately
+    private benchPattern(): string {
+        const escape = (s: string) => s.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+        const levels = this.subName
+            ? [this.benchmark.name, this.subName]
+            : [this.benchmark.name];
+        return levels.map(level => `^${escape(level)}$`).join('/');
+    }
+
+    // Tags for -tags: those from settings, plus those the benchmark's file requires
+    private tags(): string[] {
+        const config = vscode.workspace.getConfiguration('goAllocations');
+        const configured = config.get<string[]>('buildTags', []);
+        return [...new Set([...configured, ...this.buildTags])];
+    }
+
+    /**
+     * The go test flags for a run, from settings and the benchmark's build
+     * constraint, besides -bench and -memprofile. Overrides of benchtime
+     * and exact take the place of the settings.
+     */
+    defaultFlags(overrides: RunOverrides = {}): string[] {
+        const config = vscode.workspace.getConfiguration('goAllocations');
+        const rate = overrides.exact ? 1 : memprofilerate;
+        const flags = ['-benchmem', '-run=^$', `-memprofilerate=${rate}`];
+
+        const tags = this.tags();
+        if (tags.length > 0) {
+            flags.push(`-tags=${tags.join(',')}`);
+        }
+
+        const benchtime = overrides.benchtime || config.get<string>('benchtime', '');
+        if (benchtime) {
+            flags.push(`-benchtime=${benchtime}`);
+        }
+
+        if (overrides.race) {
+            flags.push('-race');
+        }
+
+        if (overrides.short ?? config.get<boolean>('short', false)) {
+            flags.push('-short');
+        }
+
+        const count = Math.max(1, Math.floor(config.get<number>('count', 1)));
+        if (count > 1) {
+            flags.push(`-count=${count}`);
+        }
+        return flags;
     }
 
     get folderPath(): string {
         return this.parent.filePath;
     }
 
-    async getChildren(signal: AbortSignal): Promise<BenchmarkChildItem[]> {
+    // Environment for go commands: run against the same go.work the developer builds with
+    get env(): NodeJS.ProcessEnv {
+        const env = { ...goEnv(), ...testEnv(this.folderPath) };
+        const goWork = this.parent.parent.goWork;
+        return goWork ? { ...env, GOWORK: goWork } : env;
+    }
+
+    get running(): boolean {
+        return this.runController !== undefined;
+    }
+
+    // Cancels the run in flight, if any
+    cancel(): void {
+        this.runController?.abort();
+    }
+
+    /**
+     * Runs the benchmark and returns its results. Meanwhile, onProgress gets
+     * the numbers of each run as it completes, before the profile is ready.
+     */
+    async getChildren(signal: AbortSignal, onProgress?: (items: BenchmarkChildItem[]) => void): Promise<BenchmarkChildItem[]> {
         if (!this.folderPath) {
             return [];
         }
 
+        if (this.benchmark.unsaved) {
+            return [new InformationItem('Save the file to run this benchmark', 'info')];
+        }
+
+        // Cancelling everything, or just this run, or running out of time stops it
+        const controller = new AbortController();
+        this.runController = controller;
+        const timeoutSeconds = vscode.workspace.getConfiguration('goAllocations').get<number>('runTimeout', 600);
+        const timeout = timeoutSeconds > 0 ? AbortSignal.timeout(timeoutSeconds * 1000) : undefined;
+        const runSignal = AbortSignal.any(timeout ? [signal, controller.signal, timeout] : [signal, controller.signal]);
+
+        this.onProgress = onProgress;
+        try {
+            return await this.run(runSignal, timeout, timeoutSeconds);
+        } finally {
+            this.runController = undefined;
+            this.onProgress = undefined;
+        }
+    }
+
+    private async run(signal: AbortSignal, timeout: AbortSignal | undefined, timeoutSeconds: number): Promise<BenchmarkChildItem[]> {
         try {
             // Check if operation is cancelled before starting
             if (signal.aborted) {
                 throw new Error('Operation cancelled');
             }
 
-            // Create unique temporary file for memory profile
-            const tempDir = os.tmpdir();
-            const uniqueId = `${Date.now()}-${Math.random().toString(36).slice(2, 11)}-${process.pid}`;
-            const memprofilePath = path.join(tempDir, `go-allocations-memprofile-${uniqueId}.pb.gz`);
-            const benchmarkName = typeof this.label === 'string' ? this.label : this.label?.label || '';
-            const escapedBenchmarkName = quote([benchmarkName]);
-            const memprofilerate = 1024 * 64; // 64K
+            const overrides = this.nextRun;
+            this.nextRun = undefined;
+            const flags = overrides?.flags ?? this.defaultFlags(overrides);
+            const go = overrides?.goExecutable ?? goCommand();
+            this.build = { go, flags };
+            this.race = flags.includes('-race');
+            this.skipped = undefined;
+            this.undersampled = false;
+            this.restored = false;
+            this.stale = false;
+            this.result = undefined;
+            this.resultProfiles = [];
+            this.problems = [];
+            this.buildErrors = undefined;
+            this.updateDescription();
+            this.runEnv = overrides?.env ?? {};
+
+            // Results from different compilers differ, so record which one this is
+            const toolchain = await goVersion(go, this.folderPath, this.env, signal);
+            const toolchainItem = new InformationItem(toolchain, 'tools');
+            toolchainItem.tooltip = `Built and run with ${toolchain} (${go})`;
+            if (flags.some(flag => /^--?(test\.)?short(=true)?$/.test(flag))) {
+                toolchainItem.tooltip += '\nWith -short, so testing.Short() is true';
+            }
+            const execution = (await benchmarkExecution(signal)).description;
+            if (execution) {
+                toolchainItem.tooltip += `\nRun ${execution}`;
+            }
+
+            // The race detector adds allocations of its own, don't compare these with other runs
+            const raceItems: BenchmarkChildItem[] = [];
+            if (this.race) {
+                const raceItem = new InformationItem('Race detector', 'warning');
+                raceItem.description = 'not comparable with normal runs';
+                raceItem.tooltip = 'Built with -race, which changes escape analysis and adds allocations of its own';
+                raceItems.push(raceItem);
+            }
 
-            const cmd = `go test -bench=^${escapedBenchmarkName}$ -memprofile=${memprofilePath} -run=^$ -memprofilerate=${memprofilerate}`;
+            // Recorded with the results, since GOGC and the like change what a run measures
+            const envItems: BenchmarkChildItem[] = [];
+            if (Object.keys(this.runEnv).length > 0) {
+                const envItem = new InformationItem(formatEnv(this.runEnv), 'tools');
+                envItem.tooltip = `Run with ${Object.entries(this.runEnv).map(([k, v]) => `${k}=${v}`).join('\n')}`;
+                envItems.push(envItem);
+            }
 
-            try {
-                const { stdout, stderr } = await execAsync(
-                    cmd,
-                    {
-                        cwd: this.folderPath,
-                        signal: signal
+            const warmupItems = this.warmup ? [await this.warmupRun(go, flags, signal)] : [];
+
+            // Allocations differ by GOMAXPROCS, but one profile would mix them, so
+            // each -cpu value gets a run and a profile of its own
+            const cpus = overrides?.cpus ?? (overrides?.flags ? [] : this.cpus());
+            let results: BenchmarkChildItem[];
+            // TODO: check sampling and reported metrics at each -cpu value and experiment, too
+            let undersampledItems: BenchmarkChildItem[] = [];
+            if (overrides?.experiment) {
+                // TODO: compare at each -cpu value, too
+                results = [];
+                const runEnv = this.runEnv;
+                const profiles: Profile[] = [];
+                let base: ExperimentItem | undefined;
+                try {
+                    for (const experiment of ['', overrides.experiment]) {
+                        this.runEnv = experiment ? { ...runEnv, GOEXPERIMENT: experiment } : runEnv;
+                        const { stdout, memProfile } = await this.profile(go, flags, signal);
+                        const allocations = await this.parseMemoryProfile(memProfile, go, signal);
+                        const item = new ExperimentItem(experiment, [...this.statsItems(stdout), ...allocations], base);
+                        base ??= item;
+                        profiles.push(memProfile);
+                        results.push(item);
                     }
-                );
-
-                if (stderr) {
-                    console.error('Benchmark stderr:', stderr);
+                } finally {
+                    this.runEnv = runEnv;
                 }
-
-                // Check if operation was cancelled after benchmark completion
-                if (signal.aborted) {
-                    throw new Error('Operation cancelled');
+                // What the experiment allocates more, or less, line by line, as Compare profiles shows
+                const [defaultProfile, experimentProfile] = profiles;
+                const diff = await this.parseMemoryProfile(diffProfiles(defaultProfile, experimentProfile), go, signal, defaultProfile);
+                results.push(new DiffItem('Default', `GOEXPERIMENT=${overrides.experiment}`, diff));
+                this.profiles = [];
+                this.profilesKey = undefined;
+            } else if (cpus.length > 1) {
+                results = [];
+                for (const cpu of cpus) {
+                    if (overrides?.untilStable) {
+                        results.push(new CpuItem(cpu, await this.profileUntilStable(go, [...flags, `-cpu=${cpu}`], signal)));
+                        continue;
+                    }
+                    const { stdout, memProfile } = await this.profile(go, [...flags, `-cpu=${cpu}`], signal);
+                    const allocations = await this.parseMemoryProfile(memProfile, go, signal);
+                    results.push(new CpuItem(cpu, [...this.statsItems(stdout), ...allocations]));
                 }
-
-                // Parse the memory profile using pprof
-                const allocationData = await this.parseMemoryProfile(memprofilePath, signal);
-
-                return allocationData;
-            } finally {
-                // Clean up the memory profile file
-                try {
-                    await fs.promises.unlink(memprofilePath);
-                } catch (cleanupError) {
-                    console.warn('Could not clean up memory profile file:', cleanupError);
+                this.profiles = [];
+                this.profilesKey = undefined;
+            } else {
+                const cpuFlags = cpus.length === 1 ? [`-cpu=${cpus[0]}`] : [];
+                if (overrides?.untilStable) {
+                    results = await this.profileUntilStable(go, [...flags, ...cpuFlags], signal, toolchain);
+                } else {
+                    // Sources as built, since an edit during the run would be in the next one
+                    const env = { ...this.env, ...this.runEnv };
+                    const key = JSON.stringify([flags, cpuFlags, toolchain, this.runEnv, await sourceKey(go, this.folderPath, splitFlags(flags).buildFlags, env, signal)]);
+                    const merge = overrides?.merge === true && key === this.profilesKey;
+
+                    // TODO: save merged profiles, and the results of the other kinds of run
+                    const save = overrides?.merge ? undefined : async (file: string) => {
+                        this.resultProfiles = [await fs.promises.readFile(file)];
+                    };
+                    const { stdout, memProfile } = await this.profile(go, [...flags, ...cpuFlags], signal, save);
+                    undersampledItems = this.undersampledItems(stdout, memProfile, flags);
+                    this.setCustomMetrics(stdout);
+                    if (this.resultProfiles.length > 0) {
+                        this.result = {
+                            time: new Date().toISOString(),
+                            flags: [...flags, ...cpuFlags],
+                            toolchain,
+                            stdout
+                        };
+                    }
+                    this.profiles = merge ? [...this.profiles, memProfile] : [memProfile];
+                    this.profilesKey = key;
+                    const allocations = await this.parseMemoryProfile(mergeProfiles(this.profiles), go, signal);
+                    const notMergedItems = overrides?.merge && !merge ? [this.notMergedItem()] : [];
+                    results = [...notMergedItems, ...this.mergedItems(), ...this.statsItems(stdout), ...allocations];
                 }
             }
+            this.toolchain = toolchain;
+
+            // The per-op numbers summarize the run. Sub-benchmarks come next, each
+            // runnable on its own; the parent's allocations include theirs.
+            const stats = results.filter(item => item instanceof StatsItem);
+            const rest = results.filter(item => !(item instanceof StatsItem));
+            return [toolchainItem, ...envItems, ...raceItems, ...warmupItems, samplingItem(memprofileRateOf(flags)), ...undersampledItems, ...stats, ...this.subBenchmarkItems(), ...rest];
         } catch (error) {
+            if (timeout?.aborted) {
+                return this.timedOutItems(error, timeoutSeconds);
+            }
+            if (signal.aborted) {
+                return [new InformationItem('Cancelled', 'info')];
+            }
+            if (error instanceof SkippedError) {
+                this.skipped = { reason: error.reason };
+                this.updateDescription();
+                const skippedItem = new InformationItem('Skipped', 'info');
+                skippedItem.description = error.reason?.split('\n').pop();
+                skippedItem.tooltip = error.reason ?? `${this.fullName} called b.Skip`;
+                return [skippedItem];
+            }
             console.error('Error getting allocation data:', error);
+
+            // A compile error is more useful as a list of locations than as one opaque message
+            const { stderr, events } = error as { stderr?: string; events?: TestEvent[] };
+            const buildErrors = stderr ? parseBuildErrors(stderr, this.folderPath) : [];
+            if (buildErrors.length > 0) {
+                this.buildErrors = buildErrors;
+                this.problems = buildErrors.map(e => ({ ...e, source: 'go build' }));
+                return [
+                    new InformationItem('Build failed', 'error'),
+                    ...buildErrors.map(e => new BuildErrorItem(e))
+                ];
+            }
+
+            // A panic points at a line, with the trace for context
+            const output = events ? eventOutput(events) : '';
+            const panic = parsePanic(output, this.folderPath);
+            if (panic) {
+                const location = { file: panic.file, line: panic.line, column: 1, message: `panic: ${panic.message}` };
+                this.problems = [{ ...location, source: this.fullName }];
+                const lines = output.split('\n').filter(line => line.trim());
+                return [
+                    new InformationItem('Panicked', 'error'),
+                    new BuildErrorItem(location),
+                    ...lines.slice(0, maxTimeoutLines).map(line => new InformationItem(line))
+                ];
+            }
+
+            // The benchmark's own output says why it failed, without other benchmarks' logs
+            if (events && testStatuses(events).get(this.fullName) === 'fail') {
+                const lines = eventOutput(events, this.fullName).split('\n').filter(line => line.trim());
+                return [
+                    new InformationItem('Failed', 'error'),
+                    ...lines.slice(-maxTimeoutLines).map(line => new InformationItem(line))
+                ];
+            }
+
             const msg = error instanceof Error ? error.message : String(error);
             return [
                 new InformationItem(
@@ -210,174 +922,733 @@ export class BenchmarkItem extends vscode.TreeItem {
         }
     }
 
-    private async parseMemoryProfile(memprofilePath: string, signal: AbortSignal): Promise<BenchmarkChildItem[]> {
+    /**
+     * Runs the benchmark once with the flags, returning its output and its
+     * memory profile. Save, if set, gets the profile's file before it's
+     * removed, to keep it as written.
+     */
+    private async profile(
+        go: string,
+        flags: string[],
+        signal: AbortSignal,
+        save?: (file: string) => Promise<void>
+    ): Promise<{ stdout: string; memProfile: Profile }> {
+        // Create unique temporary file for memory profile
+        const tempDir = os.tmpdir();
+        const uniqueId = `${Date.now()}-${Math.random().toString(36).slice(2, 11)}-${process.pid}`;
+        const memprofilePath = path.join(tempDir, `go-allocations-memprofile-${uniqueId}.pb.gz`);
+
         try {
-            // Check if operation was cancelled before parsing
+            const { stdout, stderr, events } = await this.runTest(go, memprofilePath, flags, signal);
+
+            if (stderr) {
+                console.error('Benchmark stderr:', stderr);
+            }
+
+            // Check if operation was cancelled after benchmark completion
             if (signal.aborted) {
                 throw new Error('Operation cancelled');
             }
 
-            // Use streaming approach for memory efficiency
-            const results = await new Promise<BenchmarkChildItem[]>((resolve, reject) => {
-                const items: BenchmarkChildItem[] = [];
-                let currentFunction = '';
-                let currentFile = '';
-                let inFunction = false;
-                let stderr = '';
+            // A skipped benchmark's profile is empty, not a benchmark without allocations
+            if (testStatuses(events).get(this.fullName) === 'skip') {
+                throw new SkippedError(this.fullName, skipMessage(events, this.fullName));
+            }
 
-                const moduleName = this.parent.parent.moduleName;
-                const cmd = 'go';
-                const args = ['tool', 'pprof', `-list=${moduleName}`, memprofilePath];
+            const memProfile = await loadProfile(memprofilePath, signal);
+            await save?.(memprofilePath);
+            return { stdout, memProfile };
+        } finally {
+            // Clean up the memory profile file
+            try {
+                await fs.promises.unlink(memprofilePath);
+            } catch (cleanupError) {
+                console.warn('Could not clean up memory profile file:', cleanupError);
+            }
+        }
+    }
 
-                const child = spawn(cmd, args, {
-                    cwd: this.folderPath,
-                    signal,
-                    stdio: ['ignore', 'pipe', 'pipe']
-                });
+    /**
+     * Shows the results of a run in an earlier session, as saved from
+     * result with its profiles, until the benchmark runs again.
+     */
+    async restore(saved: SavedResult, profiles: Buffer[], signal: AbortSignal): Promise<BenchmarkChildItem[]> {
+        this.profiles = profiles.map(parseProfile);
+        this.profilesKey = undefined;
+        const allocations = await this.parseMemoryProfile(mergeProfiles(this.profiles), goCommand(), signal);
+        this.toolchain = saved.toolchain;
+        // TODO: the go command, for a run with another toolchain
+        this.build = { go: goCommand(), flags: saved.flags };
+        this.result = saved;
+        this.restored = true;
+        this.updateDescription();
+        this.setCustomMetrics(saved.stdout);
+
+        const time = new Date(saved.time);
+        const restoredItem = new InformationItem('From previous session', 'history');
+        restoredItem.description = time.toLocaleString();
+        restoredItem.tooltip = `Run at ${time.toLocaleString()} with ${saved.toolchain} and ${quote(saved.flags)}, before the window reloaded. Run again for current results.`;
+        return [restoredItem, samplingItem(memprofileRateOf(saved.flags)), ...this.statsItems(saved.stdout), ...this.subBenchmarkItems(), ...allocations];
+    }
 
-                const rl = readline.createInterface({
-                    input: child.stdout,
-                    crlfDelay: Infinity
-                });
+    /**
+     * Runs the benchmark a single iteration without a memory profile, so the
+     * measured run starts with warm file caches and a built test binary.
+     */
+    private async warmupRun(go: string, flags: string[], signal: AbortSignal): Promise<InformationItem> {
+        const warmupFlags = flags.filter(flag => !/^--?(test\.)?(benchtime|count)=/.test(flag));
+        const start = Date.now();
+        await this.runTest(go, undefined, [...warmupFlags, '-benchtime=1x'], signal);
+
+        const item = new InformationItem('Warmed up', 'clock');
+        item.description = `${((Date.now() - start) / 1000).toFixed(1)}s`;
+        item.tooltip = 'Ran once with -benchtime=1x before the measured run, which alone is reported';
+        return item;
+    }
 
-                // Capture stderr output
-                child.stderr?.on('data', (data) => {
-                    stderr += data.toString();
-                });
+    /**
+     * Runs the benchmark with increasing -count until allocs/op varies by no
+     * more than the stableThreshold setting, or stableMaxCount runs are done.
+     * The numbers are over all runs. With the toolchain, the result is kept
+     * to save, with each round's profile.
+     */
+    private async profileUntilStable(go: string, flags: string[], signal: AbortSignal, toolchain?: string): Promise<BenchmarkChildItem[]> {
+        const config = vscode.workspace.getConfiguration('goAllocations');
+        const threshold = config.get<number>('stableThreshold', 2) / 100;
+        const maxCount = Math.max(2, Math.floor(config.get<number>('stableMaxCount', 20)));
+        const base = flags.filter(flag => !/^--?(test\.)?count=/.test(flag));
+
+        let stdout = '';
+        const profiles: Profile[] = [];
+        const written: Buffer[] = [];
+        const save = toolchain === undefined ? undefined : async (file: string) => {
+            written.push(await fs.promises.readFile(file));
+        };
+        let total = 0;
+        let stats: Stats | undefined;
+
+        // Each round doubles the runs so far
+        for (let count = Math.min(3, maxCount); count > 0; count = Math.min(total, maxCount - total)) {
+            const result = await this.profile(go, [...base, `-count=${count}`], signal, save);
+            stdout += result.stdout;
+            profiles.push(result.memProfile);
+            total += count;
+
+            stats = summarizeMetric(parseBenchmarkRuns(stdout), this.fullName, 'allocs/op');
+            if (!stats || stats.relativeStddev <= threshold) {
+                break;
+            }
+        }
 
-                rl.on('line', (line) => {
-                    const trimmedLine = line.trim();
+        // Every round's allocations, for less sampling noise
+        this.profiles = profiles;
+        this.profilesKey = undefined;
+        const merged = mergeProfiles(profiles);
+        const allocations = await this.parseMemoryProfile(merged, go, signal);
+        const undersampledItems = this.undersampledItems(stdout, merged, flags);
+        this.setCustomMetrics(stdout);
+        if (toolchain !== undefined) {
+            this.result = { time: new Date().toISOString(), flags: base, toolchain, stdout };
+            this.resultProfiles = written;
+        }
 
-                    // Check if this is a function header
-                    const functionMatch = trimmedLine.match(routineRegex);
-                    if (functionMatch) {
-                        currentFunction = functionMatch[1];
-                        currentFile = functionMatch[2];
-                        inFunction = true;
-                        return;
-                    }
+        const stable = stats !== undefined && stats.relativeStddev <= threshold;
+        const item = new InformationItem(
+            stable ? `Stable after ${total} runs` : `Not stable after ${total} runs`,
+            stable ? 'info' : 'error'
+        );
+        if (stats) {
+            item.description = `allocs/op ±${(stats.relativeStddev * 100).toFixed(1)}%`;
+        }
+        item.tooltip = `Repeated until allocs/op varied by at most ${(threshold * 100).toFixed(1)}%, up to ${maxCount} runs`;
+        return [item, ...undersampledItems, ...this.statsItems(stdout), ...allocations];
+    }
 
-                    // Check if we're in a function and this is a line with allocation data
-                    if (inFunction && trimmedLine && !trimmedLine.includes('Total:') && !trimmedLine.includes('ROUTINE')) {
-                        const lineMatch = trimmedLine.match(lineRegex);
-                        if (lineMatch) {
-                            const flatBytes = lineMatch[1] || '0B';
-                            const cumulativeBytes = lineMatch[2] || '0B';
-                            const lineNumber = parseInt(lineMatch[3]);
-                            const codeLine = lineMatch[4];
-
-                            if (lineNumber > 0 && (flatBytes !== '0B' || cumulativeBytes !== '0B')) {
-                                const functionName = this.shortFunctionName(currentFunction);
-
-                                const allocationItem = new AllocationItem(
-                                    `${codeLine.trim()}`,
-                                    currentFile,
-                                    lineNumber,
-                                    {
-                                        flatBytes: flatBytes,
-                                        cumulativeBytes: cumulativeBytes,
-                                        functionName: functionName
-                                    }
-                                );
-                                items.push(allocationItem);
-                            }
-                        }
-                    }
+    /**
+     * Runs go test for the benchmark. Unless disabled, the test binary is
+     * built once with go test -c and reused until its sources change.
+     * Without a memprofilePath, no profile is written.
+     *
+     * The run reports go test -json events; stdout is the benchmark's own
+     * output from them, as go test would print it without -json.
+     */
+    private async runTest(
+        go: string,
+        memprofilePath: string | undefined,
+        flags: string[],
+        signal: AbortSignal
+    ): Promise<{ stdout: string; stderr: string; events: TestEvent[] }> {
+        try {
+            const { stdout, stderr } = await this.runTestJSON(go, memprofilePath, flags, signal);
+            const events = parseTestEvents(stdout);
+            return { stdout: eventOutput(events, this.fullName), stderr, events };
+        } catch (error) {
+            // A failed run has events too, and since Go 1.24 compile errors are among them
+            const failed = error as { stdout?: string; stderr?: string; events?: TestEvent[] };
+            if (failed.stdout) {
+                failed.events = parseTestEvents(failed.stdout);
+                failed.stdout = eventOutput(failed.events, this.fullName);
+                failed.stderr = `${failed.stderr ?? ''}${buildOutput(failed.events)}`;
+            }
+            throw error;
+        }
+    }
 
-                    // Reset when we hit an empty line or new function
-                    if (trimmedLine === '' || trimmedLine.includes('ROUTINE')) {
-                        inFunction = false;
-                    }
-                });
+    private async runTestJSON(go: string, memprofilePath: string | undefined, flags: string[], signal: AbortSignal) {
+        const env = { ...this.env, ...this.runEnv };
+        const reuse = vscode.workspace.getConfiguration('goAllocations').get<boolean>('reuseTestBinary', true);
+        const { prefix, priority } = await benchmarkExecution(signal);
+        const onStdout = this.onProgress ? this.progressStream(this.onProgress) : undefined;
+
+        // taskset and perflock take the command to run as their arguments
+        const exec = (command: string, args: string[]) => prefix.length > 0
+            ? runProcess(prefix[0], [...prefix.slice(1), command, ...args], { cwd: this.folderPath, env, signal, priority, onStdout })
+            : runProcess(command, args, { cwd: this.folderPath, env, signal, priority, onStdout });
+
+        if (!reuse) {
+            // TODO: perflock then holds the lock while go test builds, too
+            const profileFlags = memprofilePath ? [`-memprofile=${memprofilePath}`] : [];
+            const args = ['test', '-json', `-bench=${this.benchPattern()}`, ...profileFlags, ...flags];
+            return exec(go, args);
+        }
 
-                rl.on('close', () => {
-                    resolve(items);
-                });
+        const { buildFlags, testFlags } = splitFlags(flags);
+        const binary = await testBinary(go, this.folderPath, buildFlags, env, signal);
 
-                // Handle process spawn errors (e.g., command not found)
-                child.on('error', (error) => {
-                    reject(error);
-                });
+        // go test runs the binary in the package directory, so do we, and
+        // through test2json as go test -json does; its -test.v must come last
+        const profileFlags = memprofilePath ? [`-test.memprofile=${memprofilePath}`] : [];
+        const args = [`-test.bench=${this.benchPattern()}`, ...profileFlags, ...testFlags, '-test.v=test2json'];
+        return exec(go, ['tool', 'test2json', '-t', binary, ...args]);
+    }
 
-                child.on('close', (code) => {
-                    if (stderr.includes('no matches found for regexp')) {
-                        resolve([noAllocationsItem]);
-                        return;
-                    }
+    /**
+     * Follows the events of a run in flight, reporting the numbers so far
+     * whenever a run of this benchmark or one of its sub-benchmarks ends.
+     */
+    private progressStream(onProgress: (items: BenchmarkChildItem[]) => void): (chunk: string) => void {
+        const events: TestEvent[] = [];
+        const owner = eventOwner();
+        let reported = 0;
+
+        return eventStream(event => {
+            events.push(event);
+            const name = owner(event);
+            if (event.Action !== 'output' || !name || (name !== this.fullName && !name.startsWith(`${this.fullName}/`))) {
+                return;
+            }
 
-                    // If process exited with non-zero code and we have stderr, treat as error
-                    if (code !== 0 && stderr.trim()) {
-                        reject(new Error(`pprof exit code ${code}: ${stderr.trim()}`));
-                        return;
-                    }
+            // A result line ends with a newline, its name is printed before it runs
+            const runs = parseBenchmarkRuns(eventOutput(events))
+                .filter(r => r.name === this.fullName || r.name.startsWith(`${this.fullName}/`));
+            if (runs.length === reported) {
+                return;
+            }
+            reported = runs.length;
+
+            const running = new InformationItem('Running...', 'loading~spin');
+            running.description = `${runs.length} ${runs.length === 1 ? 'result' : 'results'} so far`;
+            const subRuns = runs.filter(r => r.name !== this.fullName).map(r => {
+                const item = new InformationItem(r.name.slice(this.fullName.length + 1));
+                item.description = ['B/op', 'allocs/op', 'MB/s']
+                    .filter(unit => r.metrics[unit] !== undefined)
+                    .map(unit => `${r.metrics[unit]} ${unit}`)
+                    .join(', ');
+                return item;
+            });
+            onProgress([running, ...this.statsItems(eventOutput(events, this.fullName)), ...subRuns]);
+        });
+    }
 
-                    // If we get here, the process completed successfully
-                    // The readline interface will handle resolving with the parsed items
-                });
+    // GOMAXPROCS values to run with, from the cpu setting, e.g. 1,4,8
+    cpus(): number[] {
+        const configured = vscode.workspace.getConfiguration('goAllocations').get<string>('cpu', '');
+        return configured.split(',')
+            .map(c => c.trim())
+            .filter(Boolean)
+            .map(c => {
+                const cpu = parseInt(c);
+                if (isNaN(cpu) || cpu < 1) {
+                    throw new Error(`Invalid goAllocations.cpu value: ${c}`);
+                }
+                return cpu;
             });
+    }
 
-            // If no allocation data found, show a message
-            if (results.length === 0) {
-                results.push(noAllocationsItem);
-            }
+    // The timeout, then what the run printed before it was killed
+    private timedOutItems(error: unknown, timeoutSeconds: number): BenchmarkChildItem[] {
+        const { stdout = '', stderr = '' } = error as { stdout?: string; stderr?: string };
+        const timedOut = new InformationItem(`Timed out after ${timeoutSeconds}s`, 'error');
+        timedOut.tooltip = 'The run was killed; increase goAllocations.runTimeout if it needs longer';
+
+        // Any -count runs that completed still have numbers
+        // TODO: the memory profile is only written at exit, so there are no allocations to show
+        const lines = `${stdout}${stderr}`.split('\n').filter(line => line.trim());
+        const output = lines.slice(-maxTimeoutLines).map(line => new InformationItem(line));
+        return [timedOut, ...this.statsItems(stdout), ...output];
+    }
 
-            return results;
-        } catch (error) {
-            console.error('Error parsing memory profile:', error);
-            const msg = error instanceof Error ? error.message : String(error);
-            return [
-                new InformationItem(
-                    `${msg}`,
-                    'error'
-                )
-            ];
+    /**
+     * Warns if the profile has far fewer allocations than -benchmem counted,
+     * as when sampling passes over many small ones, and offers a run in
+     * exact mode, which records them all.
+     */
+    private undersampledItems(stdout: string, profile: Profile, flags: string[]): BenchmarkChildItem[] {
+        if (memprofileRateOf(flags) === 1) {
+            return [];
+        }
+        const counted = countedAllocations(parseBenchmarkRuns(stdout), this.fullName);
+        const sampled = sampledAllocations(profile);
+        if (!counted || sampled === undefined || sampled >= counted * undersampledShare) {
+            return [];
         }
+        this.undersampled = true;
+        this.updateDescription();
+
+        const item = new InformationItem('Under-sampled', 'warning');
+        item.description = `profile has ${formatPercent(sampled, counted)} of the allocations counted, click to run exact`;
+        item.tooltip = `-benchmem counted ${Math.round(counted)} allocations (allocs/op × iterations), but the profile estimates ${Math.round(sampled)}. ` +
+            'Sampling likely missed many allocations, so sites may be missing and byte counts off. Click to run in exact mode.';
+        item.command = { command: 'goAllocations.runExact', title: 'Run in exact mode', arguments: [this] };
+        return [item];
     }
 
-    // Display helper: last path segment after '/', then after first '.'
-    private shortFunctionName = (fullName: string): string => {
-        const slash = fullName.lastIndexOf('/');
-        const afterSlash = slash >= 0 ? fullName.slice(slash + 1) : fullName;
-        const firstDot = afterSlash.indexOf('.');
-        return firstDot >= 0 ? afterSlash.slice(firstDot + 1) : afterSlash;
+    /**
+     * B/op and allocs/op from -benchmem, aggregated over the -count runs,
+     * and MB/s for benchmarks that call b.SetBytes, to weigh allocations
+     * against throughput.
+     */
+    private statsItems(stdout: string): StatsItem[] {
+        const runs = parseBenchmarkRuns(stdout);
+        const items: StatsItem[] = [];
+        for (const unit of ['B/op', 'allocs/op', 'MB/s']) {
+            const stats = summarizeMetric(runs, this.fullName, unit);
+            if (stats) {
+                items.push(new StatsItem(unit, stats));
+            }
+        }
+        return items;
     }
 
-    async navigateTo(): Promise<void> {
-        await navigateTo(this.location.uri.fsPath, this.location.range.start.line + 1);
+    private subBenchmarkItems(): BenchmarkItem[] {
+        if (this.subName) {
+            return [];
+        }
+        return (this.benchmark.subBenchmarks ?? []).map(name =>
+            new BenchmarkItem(this.benchmark, this.parent, this, name)
+        );
     }
-}
 
-type BenchmarkChildItem = InformationItem | AllocationItem;
+    // Says how many profiles the allocations merge, if more than one
+    private mergedItems(): InformationItem[] {
+        if (this.profiles.length < 2) {
+            return [];
+        }
+        const item = new InformationItem(`Merged ${this.profiles.length} profiles`, 'info');
+        item.tooltip = 'Allocations are summed over the profiles of this and earlier runs, as pprof -proto does';
+        return [item];
+    }
+
+    // A run to merge that differs from those before it, which would mix allocations from different builds
+    private notMergedItem(): InformationItem {
+        const item = new InformationItem('Not merged', 'warning');
+        item.description = 'flags, toolchain, environment or sources changed';
+        item.tooltip = 'Profiles are only merged with those of earlier runs built and run the same way from the same sources, so these allocations are from this run alone';
+        return item;
+    }
+
+    // With a diff's base, the profile is the difference from it
+    private async parseMemoryProfile(profile: Profile, go: string, signal: AbortSignal, diffBase?: Profile): Promise<BenchmarkChildItem[]> {
+        try {
+            // Check if operation was cancelled before parsing
+            if (signal.aborted) {
+                throw new Error('Operation cancelled');
+            }
+
+            // -trimpath builds record module paths rather than files, for dependencies' frames too
+            const missing = [...profile.functions.values()].some(unresolvedFile);
+            const roots = missing ? await sourceRoots(go, this.folderPath, this.env, signal) : undefined;
+            const resolvePath = (file: string) => roots ? resolveSourcePath(file, roots) : file;
+
+            return allocationItems(profile, {
+                include: this.inModule,
+                resolvePath,
+                setup: (functionName, file, line) => this.isSetupLine(functionName, file, line),
+                diff: diffBase !== undefined,
+                total: diffBase && profileTotals(diffBase)
+            });
+        } catch (error) {
+            console.error('Error parsing memory profile:', error);
+            const msg = error instanceof Error ? error.message : String(error);
+            return [
+                new InformationItem(
+                    `${msg}`,
+                    'error'
+                )
+            ];
+        }
+    }
+
+    private inModule = (fn: ProfileFunction): boolean => fn.name.includes(this.parent.parent.moduleName);
+
+
+    /**
+     * Whether an allocation is in the benchmark's setup, i.e. its body before the loop.
+     * No flags need to change with the loop style, but the setup allocations
+     * mean different things: with b.Loop the function body runs once, so
+     * setup is allocated once; with b.N it runs once per round, as the
+     * testing package ramps up b.N, so setup is allocated several times.
+     */
+    private isSetupLine(functionName: string, filePath: string, lineNumber: number): LoopStyle | undefined {
+        const { loopStyle, loopLine } = this.benchmark;
+        if (!loopStyle || loopLine === undefined || functionName !== this.benchmark.name) {
+            return undefined;
+        }
+        if (path.resolve(filePath) !== path.resolve(this.location.uri.fsPath)) {
+            return undefined;
+        }
+
+        const line = lineNumber - 1; // 0-based, like the location
+        return line > this.location.range.start.line && line < loopLine ? loopStyle : undefined;
+    }
+
+    async navigateTo(): Promise<void> {
+        await navigateTo(this.location.uri.fsPath, this.location.range.start.line + 1);
+    }
+}
+
+// How allocationItems shows a profile
+interface AllocationOptions {
+    // Which functions' lines show, such as the module's
+    include: (fn: ProfileFunction) => boolean;
+    // Maps file names in the profile to files
+    resolvePath: (file: string) => string;
+    // Whether a line is in a benchmark's setup, before its loop
+    setup?: (functionName: string, file: string, line: number) => LoopStyle | undefined;
+    // Set if the profile is the difference of two, whose values are deltas
+    diff?: boolean;
+    // What percentages are of, if not the profile's total, such as a diff's base
+    total?: number[];
+    // Files edited since the profile was taken, whose lines may have moved
+    staleFiles?: Set<string>;
+}
+
+/**
+ * The lines of the included functions that allocate, as pprof -list would
+ * show them. It doesn't run anything, so the view can call it again with
+ * a filtered profile.
+ */
+const allocationItems = (profile: Profile, options: AllocationOptions): BenchmarkChildItem[] => {
+    const { include, resolvePath } = options;
+    const totals = lineTotals(profile, include)
+        .filter(t => t.line > 0 && t.cum.some(v => v !== 0))
+        // By function then line, as pprof lists them
+        .sort((a, b) => a.fn.name.localeCompare(b.fn.name) || a.line - b.line || a.column - b.column);
+
+    // If no allocation data found, show a message
+    if (totals.length === 0) {
+        return [noAllocationsItem];
+    }
+
+    const allocationSource: AllocationSource = {
+        profile,
+        total: options.total ?? profileTotals(profile),
+        options
+    };
+
+    // For grouping by function, which sums lines as pprof -top does
+    const functions = new Map(functionTotals(profile, include).map(f => [f.fn.id, f]));
+    // For grouping by package, what each line's calls allocated in each package
+    const packages = new Map<string, { package: string; values: number[] }[]>();
+    for (const share of packageShares(profile, include)) {
+        const key = `${share.site.functionId}:${share.site.line}:${share.site.column}`;
+        packages.set(key, [...packages.get(key) ?? [], { package: share.package, values: share.values }]);
+    }
+
+    // Go's profiles have no columns yet; in those that do, they tell apart sites on one line
+    const hasColumns = totals.some(t => t.column > 0);
+    const sources = new Map<string, string[] | undefined>();
+    return totals.map(t => {
+        const file = resolvePath(t.fn.filename);
+        if (!sources.has(file)) {
+            sources.set(file, fs.existsSync(file) ? fs.readFileSync(file, 'utf8').split('\n') : undefined);
+        }
+        // The line number tells apart sites with the same code, such as two appends
+        const source = sources.get(file)?.[t.line - 1]?.trim();
+        const position = hasColumns ? `${t.line}:${t.column}` : `${t.line}`;
+        const code = source ? `${position}: ${source}` : `${path.basename(file)}:${position}`;
+
+        const functionName = shortFunctionName(t.fn.name);
+        const fn = functions.get(t.fn.id);
+        return new AllocationItem(code, file, t.line, {
+            sampleTypes: profile.sampleTypes,
+            defaultSampleIndex: defaultSampleIndex(profile),
+            flat: t.flat,
+            cum: t.cum,
+            functionName,
+            column: t.column,
+            function: {
+                name: t.fn.name,
+                startLine: t.fn.startLine,
+                flat: fn?.flat ?? t.flat,
+                cum: fn?.cum ?? t.cum
+            },
+            packages: packages.get(`${t.fn.id}:${t.line}:${t.column}`) ?? [],
+            setup: options.setup?.(functionName, file, t.line),
+            // Up to the benchmark, leaving out the testing package that calls it
+            stacks: () => stacksAt(profile, { functionId: t.fn.id, line: t.line, column: t.column }, fn => fn.name.startsWith('testing.')),
+            inlined: () => inlinedAt(profile, { functionId: t.fn.id, line: t.line, column: t.column }),
+            source: allocationSource
+        });
+    });
+}
+
+// A heap profile opened from a file, such as one from CI, rather than from a run
+class ImportedProfileItem extends vscode.TreeItem {
+    public readonly contextValue: 'importedProfile' = 'importedProfile';
+    public readonly filePath: string;
+    public readonly children: BenchmarkChildItem[];
+
+    constructor(filePath: string, children: BenchmarkChildItem[]) {
+        super(path.basename(filePath), vscode.TreeItemCollapsibleState.Expanded);
+        this.filePath = filePath;
+        this.children = children;
+        this.description = 'heap profile';
+        this.iconPath = new vscode.ThemeIcon('file-binary');
+        this.tooltip = `Opened from ${filePath}`;
+    }
+}
+
+// The difference of two profiles, such as two runs of a benchmark
+class DiffItem extends vscode.TreeItem {
+    public readonly contextValue: 'profileDiff' = 'profileDiff';
+    public readonly children: BenchmarkChildItem[];
+
+    constructor(base: string, current: string, children: BenchmarkChildItem[]) {
+        super(current, vscode.TreeItemCollapsibleState.Expanded);
+        this.children = children;
+        this.description = `vs ${base}`;
+        this.iconPath = new vscode.ThemeIcon('diff');
+        this.tooltip = `What ${current} allocated more, or less, than ${base}, as pprof -diff_base\nPercentages are of ${base}'s total`;
+    }
+}
+
+// A profile to compare, from a run or a file
+export interface RecentProfile {
+    // e.g. BenchmarkFoo at 10:42:07
+    label: string;
+    source: AllocationSource;
+}
+
+// The most profiles to keep for comparing
+const maxRecentProfiles = 20;
+
+// Display helper: last path segment after '/', then after first '.'
+const shortFunctionName = (fullName: string): string => {
+    const slash = fullName.lastIndexOf('/');
+    const afterSlash = slash >= 0 ? fullName.slice(slash + 1) : fullName;
+    const firstDot = afterSlash.indexOf('.');
+    return firstDot >= 0 ? afterSlash.slice(firstDot + 1) : afterSlash;
+}
+
+type BenchmarkChildItem = BenchmarkItem | InformationItem | AllocationItem | FunctionItem | BuildErrorItem | StatsItem | CpuItem | ExperimentItem | DiffItem;
+
+// Runs that vary more than this, relative to the mean, are flagged as noisy
+const noisyRelativeStddev = 0.05;
+
+const formatStat = (value: number): string =>
+    Number.isInteger(value) ? value.toString() : value.toFixed(1);
+
+// How long ago, roughly, e.g. 2m ago
+const formatAgo = (ms: number): string => {
+    const seconds = Math.round(ms / 1000);
+    if (seconds < 60) {
+        return `${seconds}s ago`;
+    }
+    const minutes = Math.round(seconds / 60);
+    if (minutes < 60) {
+        return `${minutes}m ago`;
+    }
+    const hours = Math.round(minutes / 60);
+    return hours < 24 ? `${hours}h ago` : `${Math.round(hours / 24)}d ago`;
+}
+
+// The results of a benchmark at one GOMAXPROCS, when run with several -cpu values
+class CpuItem extends vscode.TreeItem {
+    public readonly contextValue: 'cpu' = 'cpu';
+    public readonly cpu: number;
+    public readonly children: BenchmarkChildItem[];
+
+    constructor(cpu: number, children: BenchmarkChildItem[]) {
+        super(`GOMAXPROCS=${cpu}`, vscode.TreeItemCollapsibleState.Expanded);
+        this.cpu = cpu;
+        this.children = children;
+        this.iconPath = new vscode.ThemeIcon('server-process');
+
+        const stats = children.filter(item => item instanceof StatsItem);
+        if (stats.length > 0) {
+            this.description = stats.map(item => item.label).join(', ');
+        }
+    }
+}
+
+// The results of a benchmark with or without a GOEXPERIMENT, side by side
+class ExperimentItem extends vscode.TreeItem {
+    public readonly contextValue: 'experiment' = 'experiment';
+    // Empty for the default configuration
+    public readonly experiment: string;
+    public readonly children: BenchmarkChildItem[];
+
+    // With the default's run, to show how each number changed from it
+    constructor(experiment: string, children: BenchmarkChildItem[], base?: ExperimentItem) {
+        super(experiment ? `GOEXPERIMENT=${experiment}` : 'Default', vscode.TreeItemCollapsibleState.Expanded);
+        this.experiment = experiment;
+        this.children = children;
+        this.iconPath = new vscode.ThemeIcon(experiment ? 'beaker' : 'circle-outline');
+        this.tooltip = experiment
+            ? `Built and run with GOEXPERIMENT=${experiment}`
+            : 'Built and run without the experiment, to compare';
+
+        const baseStats = new Map((base?.children ?? [])
+            .filter((item): item is StatsItem => item instanceof StatsItem)
+            .map(item => [item.unit, item.stats.median]));
+        const stats = children.filter((item): item is StatsItem => item instanceof StatsItem);
+        if (stats.length > 0) {
+            this.description = stats.map(item => {
+                const from = baseStats.get(item.unit);
+                return from === undefined ? item.label : `${item.label} (${formatStatDelta(item.stats.median, from)})`;
+            }).join(', ');
+        }
+        if (baseStats.size > 0) {
+            this.tooltip += '\nChanges are from the default';
+        }
+    }
+}
+
+// A benchmark-reported metric, such as B/op, summarized over -count runs
+class StatsItem extends vscode.TreeItem {
+    public readonly contextValue: 'stats' = 'stats';
+    public readonly unit: string;
+    public readonly stats: Stats;
+
+    constructor(unit: string, stats: Stats) {
+        super(`${formatStat(stats.median)} ${unit}`, vscode.TreeItemCollapsibleState.None);
+        this.unit = unit;
+        this.stats = stats;
+
+        if (unit === 'MB/s') {
+            this.tooltip = 'Throughput, from the bytes per op the benchmark sets with b.SetBytes';
+        }
+        if (stats.count === 1) {
+            this.iconPath = new vscode.ThemeIcon('dashboard');
+            return;
+        }
+
+        const variation = `±${(stats.relativeStddev * 100).toFixed(1)}%`;
+        const noisy = stats.relativeStddev > noisyRelativeStddev;
+        this.description = `median of ${stats.count}, mean ${formatStat(stats.mean)} ${variation}`;
+        this.iconPath = new vscode.ThemeIcon(noisy ? 'warning' : 'dashboard');
+        this.tooltip = `${unit} over ${stats.count} runs\nMedian: ${formatStat(stats.median)}\nMean: ${formatStat(stats.mean)}\nStandard deviation: ${variation} of the mean`;
+        if (noisy) {
+            this.tooltip += '\n\nThe runs vary a lot, consider a longer benchtime or more runs before acting on this number';
+        }
+    }
+}
 
-class AllocationItem extends vscode.TreeItem {
+export class AllocationItem extends vscode.TreeItem {
     public readonly filePath: string;
     public readonly lineNumber: number;
     public readonly allocationData: AllocationData;
     public readonly contextValue: 'allocationLine' = 'allocationLine';
-
+    // Set when grouped by package: the part of the line's allocations in one package
+    public readonly share?: { package: string; values: number[] };
+    // The line's values in the benchmark's baseline, null if it didn't allocate there; undefined without one
+    public baseline: { flat: number[]; cum: number[] } | null | undefined;
     constructor(
         label: string,
         filePath: string,
         lineNumber: number,
-        allocationData: AllocationData
+        allocationData: AllocationData,
+        share?: { package: string; values: number[] }
     ) {
-        super(label, vscode.TreeItemCollapsibleState.None);
+        // Expands to the stacks that allocate here
+        super(label, vscode.TreeItemCollapsibleState.Collapsed);
         this.filePath = filePath;
         this.lineNumber = lineNumber;
         this.allocationData = allocationData;
-        this.iconPath = this.getImageUri('memory.goblue.64.png');
-        this.description = `${allocationData.flatBytes} flat, ${allocationData.cumulativeBytes} cumulative`;
-        this.tooltip = this.getTooltip();
+        this.share = share;
+        this.render(allocationView());
+    }
+
+    // The file changed since the profile was taken, so the line may have moved
+    get stale(): boolean {
+        return this.allocationData.source.options.staleFiles?.has(path.resolve(this.filePath)) ?? false;
+    }
+
+    /**
+     * Shows the values of the view's sample type, such as alloc_space, or
+     * the profile's default if it has no such type.
+     */
+    render(view: AllocationView): void {
+        const { sampleTypes } = this.allocationData;
+        const index = sampleIndex(this.allocationData, view);
+        const { unit } = sampleTypes[index];
+        const flat = formatValue(this.allocationData.flat[index], unit);
+        const cum = formatValue(this.allocationData.cum[index], unit);
+        const total = this.allocationData.source.total[index];
+        const shown = view.attribution === 'flat' ? this.allocationData.flat[index] : this.allocationData.cum[index];
+
+        this.description = view.attribution === 'flat' ? `${flat} flat` : `${cum} cumulative`;
+        // Hot lines stand out in the heat colors; the rest keep the gopher
+        const heat = heatLevel(shown, total);
+        this.iconPath = heat === 'low' ? this.getImageUri('memory.goblue.64.png') : new vscode.ThemeIcon('flame', heatColor(heat));
+        if (this.allocationData.source.options.diff) {
+            // As pprof -diff_base: what the newer profile allocated more, or less
+            this.description = `${formatDelta(shown, unit)} ${view.attribution === 'flat' ? 'flat' : 'cumulative'}`;
+            this.iconPath = new vscode.ThemeIcon(
+                shown > 0 ? 'arrow-up' : shown < 0 ? 'arrow-down' : 'dash',
+                new vscode.ThemeColor(shown > 0 ? 'charts.red' : shown < 0 ? 'charts.green' : 'disabledForeground')
+            );
+        }
+        if (this.share) {
+            this.description = `${formatValue(this.share.values[index], unit)} in ${this.share.package}`;
+        }
+        this.description += ` · ${formatPercent(this.share ? this.share.values[index] : shown, total)}`;
+        if (this.baseline !== undefined && !this.share) {
+            const base = this.baseline && (view.attribution === 'flat' ? this.baseline.flat[index] : this.baseline.cum[index]);
+            this.description += base === null ? ' · new' : ` · Δ ${formatDelta(shown - base, unit)}`;
+        }
+        if (this.allocationData.setup) {
+            this.description += ' (setup)';
+        }
+        if (this.stale) {
+            this.description += ' · stale';
+        }
+        this.tooltip = this.getTooltip(
+            sampleTypes[index],
+            `${flat} (${formatPercent(this.allocationData.flat[index], total)} of the total)`,
+            `${cum} (${formatPercent(this.allocationData.cum[index], total)} of the total)`
+        );
+        if (this.share) {
+            this.tooltip += `\nIn ${this.share.package}: ${formatValue(this.share.values[index], unit)}, allocated there by this line's calls`;
+        }
+        if (this.stale) {
+            this.tooltip += `\n\n${path.basename(this.filePath)} changed since the run, the line may have moved. Run again to refresh.`;
+        }
     }
 
-    private getTooltip(): string {
-        return [
-            'Click to view the source code line\n',
+    private getTooltip(sampleType: ValueType, flat: string, cum: string): string {
+        const lines = [
+            `${viewSourceHint}\n`,
             `Function: ${this.allocationData.functionName}`,
-            `Flat allocation: ${this.allocationData.flatBytes}`,
-            `Cumulative allocation: ${this.allocationData.cumulativeBytes}`,
+            `Flat ${sampleType.type}: ${flat}, allocated at this line`,
+            `Cumulative ${sampleType.type}: ${cum}, allocated at this line or in what it calls`,
             `Location: ${path.basename(this.filePath)}:${this.lineNumber}`
-        ].join('\n');
+        ];
+        if (this.allocationData.setup) {
+            lines.push(`Setup, before the loop: ${loopStyleDescriptions[this.allocationData.setup]}`);
+        }
+        return lines.join('\n');
     }
 
     private getImageUri(imageName: string): vscode.Uri {
@@ -387,26 +1658,375 @@ class AllocationItem extends vscode.TreeItem {
     async navigateTo(): Promise<void> {
         await navigateTo(this.filePath, this.lineNumber);
     }
+
+    /**
+     * Opens the site with the stack that allocated the most there in a
+     * peek, each frame with its source, rather than leaving for the caller.
+     */
+    async peekStack(view: AllocationView): Promise<void> {
+        await navigateTo(this.filePath, this.lineNumber);
+        const index = sampleIndex(this.allocationData, view);
+        const [stack] = this.allocationData.stacks().sort((a, b) => b.values[index] - a.values[index]);
+        // Frames without source, such as <autogenerated>, can't be shown
+        const locations = (stack?.frames ?? [])
+            .map(frame => ({ file: this.allocationData.source.options.resolvePath(frame.fn.filename), line: frame.line }))
+            .filter(({ file }) => fs.existsSync(file))
+            .map(({ file, line }) => new vscode.Location(vscode.Uri.file(file), new vscode.Position(Math.max(0, line - 1), 0)));
+        if (locations.length === 0) {
+            return;
+        }
+        const position = new vscode.Position(this.lineNumber - 1, 0);
+        await vscode.commands.executeCommand('editor.action.peekLocations', vscode.Uri.file(this.filePath), position, locations, 'peek');
+    }
+}
+
+// All the allocation sites in one function, when grouped by function
+class FunctionItem extends vscode.TreeItem {
+    public readonly contextValue: 'allocationFunction' = 'allocationFunction';
+    public readonly filePath: string;
+    public readonly allocationData: AllocationData;
+    public readonly children: AllocationItem[] = [];
+
+    // From the function's first site; each has the function's totals
+    constructor(first: AllocationItem) {
+        super(first.allocationData.functionName, vscode.TreeItemCollapsibleState.Collapsed);
+        this.filePath = first.filePath;
+        this.allocationData = first.allocationData;
+        this.iconPath = new vscode.ThemeIcon('symbol-function');
+        this.render(allocationView());
+    }
+
+    render(view: AllocationView): void {
+        const { sampleTypes, function: fn } = this.allocationData;
+        const index = sampleIndex(this.allocationData, view);
+        const sampleType = sampleTypes[index];
+        const flat = formatValue(fn.flat[index], sampleType.unit);
+        const cum = formatValue(fn.cum[index], sampleType.unit);
+
+        const shown = view.attribution === 'flat' ? fn.flat[index] : fn.cum[index];
+        this.description = view.attribution === 'flat' ? `${flat} flat` : `${cum} cumulative`;
+        this.description += ` · ${formatPercent(shown, this.allocationData.source.total[index])}`;
+        this.tooltip = [
+            'Click to view the function\n',
+            `Function: ${fn.name}`,
+            `Flat ${sampleType.type}: ${flat}, allocated in this function`,
+            `Cumulative ${sampleType.type}: ${cum}, allocated in this function or in what it calls`,
+            `Sites: ${this.children.length}`
+        ].join('\n');
+    }
+
+    async navigateTo(): Promise<void> {
+        // TODO: profiles without a start line, such as some from older Go versions
+        await navigateTo(this.filePath, this.allocationData.function.startLine || this.children[0].lineNumber);
+    }
+}
+
+// One of several stacks that allocate at a line
+class StackItem extends vscode.TreeItem {
+    public readonly contextValue: 'stack' = 'stack';
+    public readonly children: (FrameItem | HiddenFramesItem)[];
+
+    constructor(label: string, value: string, children: (FrameItem | HiddenFramesItem)[]) {
+        super(label, vscode.TreeItemCollapsibleState.Collapsed);
+        this.children = children;
+        this.description = value;
+        this.iconPath = new vscode.ThemeIcon('layers');
+        this.tooltip = children.map(frame => `${frame.label}  ${frame.description ?? ''}`).join('\n');
+    }
+}
+
+// Code the compiler inlined at an allocation's line, where the allocation really is
+class InlinedItem extends vscode.TreeItem {
+    public readonly contextValue: 'inlined' = 'inlined';
+    public readonly filePath: string;
+    public readonly lineNumber: number;
+
+    constructor(frame: Frame, filePath: string, value: string) {
+        super(`Inlined from ${shortFunctionName(frame.fn.name)}`, vscode.TreeItemCollapsibleState.None);
+        this.filePath = filePath;
+        this.lineNumber = frame.line;
+        this.description = `${path.basename(filePath)}:${frame.line} · ${value}`;
+        this.iconPath = new vscode.ThemeIcon('symbol-event');
+        this.tooltip = `Click to view the inlined code\n\n${frame.fn.name} was inlined here, so the profile counts its allocations at this line as well as at ${path.basename(filePath)}:${frame.line}`;
+    }
+
+    async navigateTo(): Promise<void> {
+        await navigateTo(this.filePath, this.lineNumber);
+    }
+}
+
+// Consecutive frames outside the workspace, such as the runtime's, when hidden
+class HiddenFramesItem extends vscode.TreeItem {
+    public readonly contextValue: 'hiddenFrames' = 'hiddenFrames';
+    public readonly children: FrameItem[];
+
+    constructor(children: FrameItem[]) {
+        super(`(${children.length} hidden frame${children.length === 1 ? '' : 's'})`, vscode.TreeItemCollapsibleState.Collapsed);
+        this.children = children;
+        this.iconPath = new vscode.ThemeIcon('ellipsis');
+        this.tooltip = children.map(frame => frame.label).join('\n');
+    }
+}
+
+// A call in an allocation's stack
+class FrameItem extends vscode.TreeItem {
+    public readonly contextValue: 'frame' = 'frame';
+    public readonly filePath: string;
+    public readonly lineNumber: number;
+
+    // site is whether this is the frame of the allocation item it's under
+    constructor(frame: Frame, filePath: string, site: boolean) {
+        super(shortFunctionName(frame.fn.name), vscode.TreeItemCollapsibleState.None);
+        this.filePath = filePath;
+        this.lineNumber = frame.line;
+        this.description = `${path.basename(filePath)}:${frame.line}${frame.inlined ? ' (inlined)' : ''}`;
+        this.iconPath = new vscode.ThemeIcon(site ? 'debug-stackframe-focused' : 'debug-stackframe');
+        this.tooltip = `${viewSourceHint}\n\n${frame.fn.name}\n${filePath}:${frame.line}`;
+        if (frame.inlined) {
+            this.tooltip += '\nInlined into the frame below';
+        }
+    }
+
+    async navigateTo(): Promise<void> {
+        await navigateTo(this.filePath, this.lineNumber);
+    }
+}
+
+// The allocation sites whose allocations are in one package, when grouped by package
+class OwnerItem extends vscode.TreeItem {
+    public readonly contextValue: 'allocationPackage' = 'allocationPackage';
+    public readonly packagePath: string;
+    public readonly children: AllocationItem[] = [];
+
+    constructor(packagePath: string) {
+        super(packagePath, vscode.TreeItemCollapsibleState.Collapsed);
+        this.packagePath = packagePath;
+        this.iconPath = new vscode.ThemeIcon('package');
+    }
+
+    // The total of the children's shares
+    total(index: number): number {
+        return this.children.reduce((sum, child) => sum + (child.share?.values[index] ?? 0), 0);
+    }
+
+    render(view: AllocationView): void {
+        const first = this.children[0];
+        if (!first) {
+            return;
+        }
+        const index = sampleIndex(first.allocationData, view);
+        const sampleType = first.allocationData.sampleTypes[index];
+        const total = formatValue(this.total(index), sampleType.unit);
+        this.description = `${total} · ${formatPercent(this.total(index), first.allocationData.source.total[index])}`;
+        this.tooltip = `${total} ${sampleType.type} allocated in ${this.packagePath}, via ${this.children.length} line${this.children.length === 1 ? '' : 's'}`;
+    }
+}
+
+// The allocation sites below the threshold, in one item so they don't bury the rest
+class SmallSitesItem extends vscode.TreeItem {
+    public readonly contextValue: 'smallSites' = 'smallSites';
+    public readonly children: AllocationItem[];
+
+    constructor(children: AllocationItem[], total: string, percent: string, threshold: string) {
+        super(`${children.length} small site${children.length === 1 ? '' : 's'} (${total})`, vscode.TreeItemCollapsibleState.Collapsed);
+        this.children = children;
+        this.description = percent;
+        this.iconPath = new vscode.ThemeIcon('fold');
+        this.tooltip = `Allocation sites below ${threshold}, see goAllocations.threshold`;
+    }
+}
+
+// The allocations of the samples with one value of a label, when grouped by label
+class LabelItem extends vscode.TreeItem {
+    public readonly contextValue: 'allocationLabel' = 'allocationLabel';
+    public readonly children: AllocationItem[];
+    // Of the whole profile, by sample type
+    private readonly profileTotal: number[];
+
+    // An undefined value is for the samples without the label
+    constructor(key: string, value: string | undefined, children: AllocationItem[], profileTotal: number[]) {
+        super(value === undefined ? `(no ${key})` : `${key}=${value}`, vscode.TreeItemCollapsibleState.Collapsed);
+        this.children = children;
+        this.profileTotal = profileTotal;
+        this.iconPath = new vscode.ThemeIcon('tag');
+        this.tooltip = value === undefined
+            ? `Allocations in samples without the label ${key}`
+            : `Allocations in samples with the label ${key}=${value}`;
+    }
+
+    // The children's profile is the samples with the label, so its total is the group's
+    render(view: AllocationView): void {
+        const data = this.children[0].allocationData;
+        const index = sampleIndex(data, view);
+        const total = data.source.total[index];
+        this.description = `${formatValue(total, data.sampleTypes[index].unit)} · ${formatPercent(total, this.profileTotal[index])}`;
+    }
 }
 
+// Whether the function's file needs mapping to one on disk, see resolveSourcePath
+const unresolvedFile = (fn: ProfileFunction): boolean =>
+    // Wrappers the compiler generates have no file, e.g. <autogenerated>
+    !fn.filename.startsWith('<') && (!path.isAbsolute(fn.filename) || !fs.existsSync(fn.filename));
+
+/**
+ * Opens the file at the line. Files outside the workspace, such as those of
+ * dependencies in GOMODCACHE or of the standard library, open read-only,
+ * since they are shared by every module that uses them.
+ */
 const navigateTo = async (filePath: string, lineNumber: number): Promise<void> => {
-    const document = await vscode.workspace.openTextDocument(vscode.Uri.file(filePath));
+    if (!fs.existsSync(filePath)) {
+        throw new Error(`${filePath} not found. A dependency's source may need go mod download.`);
+    }
+    const uri = vscode.Uri.file(filePath);
+    const document = await vscode.workspace.openTextDocument(uri);
     const editor = await vscode.window.showTextDocument(document);
+    if (!vscode.workspace.getWorkspaceFolder(uri)) {
+        await vscode.commands.executeCommand('workbench.action.files.setActiveEditorReadonlyInSession');
+    }
     const position = new vscode.Position(lineNumber - 1, 0); // Convert to 0-based line number
     editor.selection = new vscode.Selection(position, position);
     editor.revealRange(new vscode.Range(position, position), vscode.TextEditorRevealType.InCenter);
 }
 
+// How allocations show their values; the profile has them all
+export interface AllocationView {
+    // e.g. alloc_space
+    sampleType: string;
+    // Allocated at the line itself, or at it and below, as pprof means them
+    attribution: 'flat' | 'cumulative';
+    // Each line on its own, or grouped under their function, the package that allocated, or a label's values
+    groupBy: 'line' | 'function' | 'package' | 'label';
+    // Whether stacks collapse frames outside the workspace, such as the runtime's and the standard library's
+    hideExternalFrames: boolean;
+    // Regular expressions for function names, as pprof's -focus and -ignore; empty for none
+    focus: string;
+    ignore: string;
+    // Sites below it, by the shown value, are folded into one item; see parseThreshold
+    threshold: string;
+    // Only samples with the label, see parseLabelFilter
+    labelFilter: string;
+    // For grouping by label
+    labelKey: string;
+}
+
+export const allocationView = (): AllocationView => {
+    const config = vscode.workspace.getConfiguration('goAllocations');
+    return {
+        sampleType: config.get<string>('sampleType', 'alloc_space'),
+        attribution: config.get<'flat' | 'cumulative'>('attribution', 'flat'),
+        groupBy: config.get<'line' | 'function' | 'package' | 'label'>('groupBy', 'line'),
+        hideExternalFrames: config.get<boolean>('hideExternalFrames', false),
+        focus: config.get<string>('focus', ''),
+        ignore: config.get<string>('ignore', ''),
+        threshold: config.get<string>('threshold', ''),
+        labelFilter: config.get<string>('labelFilter', ''),
+        labelKey: config.get<string>('labelKey', '')
+    };
+}
+
+// A change in a value, e.g. +1.50kB or -3
+const formatDelta = (value: number, unit: string): string =>
+    `${value > 0 ? '+' : ''}${formatValue(value, unit)}`;
+
+// A per-op number's change from another, e.g. +12.5%, or +2 from 0
+const formatStatDelta = (value: number, base: number): string => {
+    const delta = value - base;
+    const sign = delta >= 0 ? '+' : '';
+    return base === 0 ? `${sign}${formatStat(delta)}` : `${sign}${(delta / base * 100).toFixed(1)}%`;
+}
+
+// A share of the benchmark's total, as pprof shows them, e.g. 42% or 0.3%
+const formatPercent = (value: number, total: number): string => {
+    if (total === 0) {
+        return '0%';
+    }
+    const percent = value / total * 100;
+    return percent < 10 ? `${percent.toFixed(1).replace(/\.0$/, '')}%` : `${Math.round(percent)}%`;
+}
+
+// The view's sample type, or the profile's default if it has no such type
+const sampleIndex = (data: AllocationData, view: AllocationView): number => {
+    const found = data.sampleTypes.findIndex(st => st.type === view.sampleType);
+    return found >= 0 ? found : data.defaultSampleIndex;
+}
+
 interface AllocationData {
-    flatBytes: string;
-    cumulativeBytes: string;
+    // The profile's, such as alloc_space in bytes; flat and cum have a value for each
+    sampleTypes: ValueType[];
+    defaultSampleIndex: number;
+    flat: number[];
+    cum: number[];
+    functionName: string;
+    // Set if the profile has columns, which tell allocations on one line apart
+    column: number;
+    // What the line allocated in each package, itself or in what it calls
+    packages: { package: string; values: number[] }[];
+    // The function the line is in, with its totals over all its lines
+    function: {
+        name: string;
+        startLine: number;
+        flat: number[];
+        cum: number[];
+    };
+    // Set if the allocation is in the benchmark's setup, before its loop
+    setup?: LoopStyle;
+    // The stacks of the samples through this line, from the profile when expanded
+    stacks: () => Stack[];
+    // The code inlined at this line that allocated, which the profile attributes to it too
+    inlined: () => Stack[];
+    source: AllocationSource;
+}
+
+// An allocation site in one benchmark's results
+export interface SiteAllocation {
+    benchmark: BenchmarkItem;
+    allocation: AllocationItem;
+    // e.g. GOMAXPROCS=4, for a run with several -cpu values
+    run?: string;
+}
+
+// A function's allocations in the results, for its lens in the editor
+export interface FunctionAllocations {
+    // As in the profile, e.g. example.com/m/pkg.(*T).M
+    name: string;
+    startLine: number;
+    // One for each benchmark
+    sites: SiteAllocation[];
+}
+
+// A line's allocations across the benchmarks that reach it, for the module-wide report
+export interface TopSite {
+    filePath: string;
+    lineNumber: number;
     functionName: string;
+    // The sum over benchmarks of the bytes per op each allocates here
+    bytesPerOp: number;
+    // One for each benchmark, the most allocating first
+    sites: SiteAllocation[];
+}
+
+// The profile a benchmark's allocations came from, shared by them all
+export interface AllocationSource {
+    profile: Profile;
+    // By sample type, for percentages
+    total: number[];
+    // For the allocations of another profile, such as this one filtered
+    options: AllocationOptions;
 }
 
 class BenchmarkItemCache extends Map<string, BenchmarkItem> {
+    // Called with each item added, which is new to the tree
+    private readonly onAdd: (item: BenchmarkItem) => void;
+
+    constructor(onAdd: (item: BenchmarkItem) => void) {
+        super();
+        this.onAdd = onAdd;
+    }
+
     add(item: BenchmarkItem): void {
-        const key = this.getKey(item.parent.filePath, item.label as string);
+        const key = this.getKey(item.parent.filePath, item.fullName);
         this.set(key, item);
+        this.onAdd(item);
     }
 
     find(packagePath: string, benchmarkName: string): BenchmarkItem | undefined {
@@ -414,379 +2034,2185 @@ class BenchmarkItemCache extends Map<string, BenchmarkItem> {
         return this.get(key);
     }
 
+    deletePackage(packagePath: string): void {
+        for (const [key, item] of this) {
+            if (item.parent.filePath === packagePath) {
+                this.delete(key);
+            }
+        }
+    }
+
+    // Drops the package's items for benchmarks it no longer declares, keeping the rest with their results
+    deleteMissing(packagePath: string, names: Set<string>): void {
+        for (const [key, item] of this) {
+            if (item.parent.filePath === packagePath && !names.has(item.benchmark.name)) {
+                this.delete(key);
+            }
+        }
+    }
+
     private getKey(packagePath: string, benchmarkName: string): string {
         const p = path.resolve(packagePath);
         return `${p}::${benchmarkName}`;
     }
 }
 
-interface PackageCache {
-    name: string;
-    path: string;
-    benchmarks: BenchmarkCache[];
+// PackageItems by package path, so a single package can be refreshed
+class PackageItemCache extends Map<string, PackageItem> { }
+
+const pinnedKey = 'goAllocations.pinnedBenchmarks';
+// Benchmarks whose warmup differs from the goAllocations.warmup setting
+const warmupKey = 'goAllocations.warmupBenchmarks';
+
+// A run to repeat: what was run, no items meaning all benchmarks, and by
+// pinKey, the flags and -cpu values each benchmark ran with
+interface LastRun {
+    items?: Item[];
+    overrides: RunOverrides;
+    pinned: Map<string, { flags: string[]; cpus: number[] }>;
 }
 
-interface BenchmarkCache {
-    name: string;
-    location: vscode.Location;
+// Identifies a benchmark across refreshes and sessions
+const pinKey = (item: BenchmarkItem): string => `${path.resolve(item.folderPath)}\n${item.fullName}`;
+
+// A benchmark's results that its later runs compare to
+interface Baseline {
+    // By baselineKey
+    lines: Map<string, { flat: number[]; cum: number[] }>;
+    // Medians by statsKey
+    stats: Map<string, number>;
+    // When it was set, e.g. 10:42:07
+    time: string;
 }
 
-interface ModuleCache {
-    name: string;
-    path: string;
-    packages: PackageCache[];
+// A line in a baseline, in one of its runs, such as GOMAXPROCS=4, if it
+// has several; by name, since function ids differ across profiles
+const baselineKey = (functionName: string, line: number, column: number, run?: string): string =>
+    `${run ?? ''}:${functionName}:${line}:${column}`;
+
+// A per-op number in a baseline, such as B/op, in one of its runs if it has several
+const statsKey = (unit: string, run?: string): string => `${run ?? ''}:${unit}`;
+
+// The per-op numbers among a benchmark's results, including those of each -cpu value or experiment
+const runStats = (children: BenchmarkChildItem[]): { stats: StatsItem; run?: string }[] => {
+    const stats: { stats: StatsItem; run?: string }[] = [];
+    for (const child of children) {
+        if (child instanceof StatsItem) {
+            stats.push({ stats: child });
+        }
+        if (child instanceof CpuItem || child instanceof ExperimentItem) {
+            const run = child.label as string;
+            stats.push(...child.children
+                .filter((c): c is StatsItem => c instanceof StatsItem)
+                .map(s => ({ stats: s, run })));
+        }
+    }
+    return stats;
+}
+
+// The allocation sites among a benchmark's results, including those of each -cpu value or experiment
+const runAllocations = (children: BenchmarkChildItem[]): { allocation: AllocationItem; run?: string }[] => {
+    const allocations: { allocation: AllocationItem; run?: string }[] = [];
+    for (const child of children) {
+        if (child instanceof AllocationItem) {
+            allocations.push({ allocation: child });
+        }
+        if (child instanceof CpuItem || child instanceof ExperimentItem) {
+            const run = child.label as string;
+            allocations.push(...child.children
+                .filter((c): c is AllocationItem => c instanceof AllocationItem)
+                .map(allocation => ({ allocation, run })));
+        }
+    }
+    return allocations;
+}
+
+// A compile error, panic or regression for the Problems panel, and what reported it
+interface Problem extends BuildError {
+    source: string;
+    // Errors unless set, regressions are warnings
+    severity?: 'warning';
+}
+
+// The notification for a batch of runs, see updateProgress
+interface BatchProgress {
+    message: string;
+    // Set once the notification shows
+    progress?: vscode.Progress<{ message?: string }>;
+    end: () => void;
+}
+
+interface QueuedRun {
+    item: BenchmarkItem;
+    overrides: RunOverrides | undefined;
+    done: () => void;
+    finished: Promise<void>;
 }
 
 export class TreeDataProvider implements vscode.TreeDataProvider<Item> {
     public _onDidChangeTreeData: vscode.EventEmitter<Item | undefined | null | void> = new vscode.EventEmitter<Item | undefined | null | void>();
     readonly onDidChangeTreeData: vscode.Event<Item | undefined | null | void> = this._onDidChangeTreeData.event;
 
+    // A benchmark has new results, from a run or restored
+    private _onDidFinishRun = new vscode.EventEmitter<BenchmarkItem>();
+    readonly onDidFinishRun: vscode.Event<BenchmarkItem> = this._onDidFinishRun.event;
+
     // Cache for discovered modules and their packages
     private modules: ModuleCache[] = [];
-    private benchmarkItems: BenchmarkItemCache = new BenchmarkItemCache();
+    private benchmarkItems: BenchmarkItemCache = new BenchmarkItemCache(item => this.showBenchmarkState(item));
+    private packageItems: PackageItemCache = new PackageItemCache();
     private loadingPromise: Promise<void> | null = null;
+    private discovering = false;
+
+    private readonly workspaceState: vscode.Memento;
+    // Where results are saved for later sessions, if the workspace has somewhere
+    private readonly storageDir: string | undefined;
+
+    // Whether to hide packages that have test files but no benchmarks
+    private hideEmptyPackages: boolean;
+
+    constructor(workspaceState: vscode.Memento, storageDir: string | undefined) {
+        this.workspaceState = workspaceState;
+        this.storageDir = storageDir;
+        this.hideEmptyPackages = vscode.workspace.getConfiguration('goAllocations').get<boolean>('hideEmptyPackages', true);
+        this.pinned = new Set(workspaceState.get<string[]>(pinnedKey, []));
+        this.previousResults = savedResults(workspaceState);
+        this.allocationView = allocationView();
+        // Results change with the tree, and the notes made from them with it
+        this.onDidChangeTreeData(() => this.inliningNotes.clear());
+    }
 
-    constructor() { }
+    // By pinKey, the results saved by the last session, until restored or run again
+    private previousResults: Map<string, SavedResult>;
 
-    private abortController: AbortController = new AbortController();
-    abortSignal(): AbortSignal {
-        return this.abortController.signal;
+    private allocationView: AllocationView;
+
+    /**
+     * Shows allocations with another sample type or attribution. Profiles
+     * have them all, so results re-render without running again.
+     */
+    setAllocationView(view: AllocationView): void {
+        this.allocationView = view;
+        for (const item of this.benchmarkItems.values()) {
+            if (item.results) {
+                this._onDidChangeTreeData.fire(item);
+            }
+        }
+        for (const item of this.importedProfiles) {
+            this._onDidChangeTreeData.fire(item);
+        }
     }
 
-    cancelAll(): void {
-        this.abortController.abort();
-        this.abortController = new AbortController();
+    // Profiles opened from files, and diffs, at the top of the tree
+    private importedProfiles: (ImportedProfileItem | DiffItem)[] = [];
+
+    // Newest first, for comparing
+    private recent: RecentProfile[] = [];
+
+    // By pinKey, what later runs of each benchmark compare to
+    // TODO: keep baselines across sessions
+    private baselines = new Map<string, Baseline>();
+
+    /**
+     * Makes the benchmark's results what its later runs compare to, until
+     * cleared or replaced.
+     */
+    setBaseline(item: BenchmarkItem): void {
+        if (!item.results) {
+            throw new Error(`Run ${item.fullName} first, to have results for a baseline.`);
+        }
+        // Each run's lines, from the profile its sites share
+        const lines = new Map<string, { flat: number[]; cum: number[] }>();
+        const sources = new Set<AllocationSource>();
+        for (const { allocation, run } of this.benchmarkAllocations(item)) {
+            const { source } = allocation.allocationData;
+            if (sources.has(source)) {
+                continue;
+            }
+            sources.add(source);
+            for (const t of lineTotals(source.profile, source.options.include)) {
+                lines.set(baselineKey(t.fn.name, t.line, t.column, run), { flat: t.flat, cum: t.cum });
+            }
+        }
+        const stats = new Map(runStats(item.results).map(({ stats, run }) => [statsKey(stats.unit, run), stats.stats.median]));
+        this.baselines.set(pinKey(item), { lines, stats, time: new Date().toLocaleTimeString() });
+        item.setBaselineDelta(this.baselineDelta(item));
+        this._onDidChangeTreeData.fire(item);
+    }
+
+    clearBaseline(item: BenchmarkItem): void {
+        this.baselines.delete(pinKey(item));
+        item.setBaselineDelta(undefined);
+        this._onDidChangeTreeData.fire(item);
+    }
+
+    // Marks the results' allocations with their values in the baseline, if the benchmark has one
+    private withBaseline(item: BenchmarkItem, children: BenchmarkChildItem[]): BenchmarkChildItem[] {
+        const baseline = this.baselines.get(pinKey(item));
+        for (const { allocation, run } of runAllocations(children)) {
+            const { function: fn, column } = allocation.allocationData;
+            allocation.baseline = baseline ? baseline.lines.get(baselineKey(fn.name, allocation.lineNumber, column, run)) ?? null : undefined;
+        }
+        return children;
+    }
+
+    /**
+     * Shows whether the benchmark is pinned and how it compares to its
+     * baseline, on a new item, and its sub-benchmarks' after a run.
+     */
+    private showBenchmarkState(item: BenchmarkItem): void {
+        item.setPinned(this.pinned.has(pinKey(item)));
+        item.setBaselineDelta(this.baselineDelta(item));
+        for (const sub of item.results?.filter((child): child is BenchmarkItem => child instanceof BenchmarkItem) ?? []) {
+            this.showBenchmarkState(sub);
+        }
+    }
+
+    // e.g. +12% B/op, -2 allocs/op, for the benchmark's description
+    private baselineDelta(item: BenchmarkItem): string | undefined {
+        const baseline = this.baselines.get(pinKey(item));
+        if (!baseline) {
+            return undefined;
+        }
+        if (!item.results) {
+            return `from ${baseline.time}`;
+        }
+        const deltas: string[] = [];
+        // Time varies too much run to run for a delta to mean much, and throughput is time too
+        for (const { stats, run } of runStats(item.results)) {
+            const base = baseline.stats.get(statsKey(stats.unit, run));
+            if (base === undefined || stats.unit === 'ns/op' || stats.unit === 'MB/s') {
+                continue;
+            }
+            deltas.push(`${run ? `${run} ` : ''}${formatStatDelta(stats.stats.median, base)} ${stats.unit}`);
+        }
+        return deltas.length > 0 ? deltas.join(', ') : `from ${baseline.time}`;
+    }
+
+    /**
+     * Warnings on the benchmark's declaration for each per-op number that
+     * grew past its baseline by more than goAllocations.regressionThreshold.
+     */
+    private regressions(item: BenchmarkItem): Problem[] {
+        const baseline = this.baselines.get(pinKey(item));
+        if (!baseline || !item.results) {
+            return [];
+        }
+        // TODO: budgets, as fixed limits rather than a baseline
+        const threshold = vscode.workspace.getConfiguration('goAllocations').get<number>('regressionThreshold', 10);
+        const file = item.location.uri.fsPath;
+        const { line, character } = item.location.range.start;
+
+        const problems: Problem[] = [];
+        for (const { stats, run } of runStats(item.results)) {
+            const base = baseline.stats.get(statsKey(stats.unit, run));
+            if (base === undefined || !['B/op', 'allocs/op'].includes(stats.unit)) {
+                continue;
+            }
+            const current = stats.stats.median;
+            const percent = base === 0 ? (current > 0 ? Infinity : 0) : (current - base) / base * 100;
+            if (percent <= threshold) {
+                continue;
+            }
+            const growth = base === 0 ? 'up from 0' : `+${percent.toFixed(1)}%`;
+            problems.push({
+                file,
+                line: line + 1,
+                column: character + 1,
+                message: `${item.fullName}${run ? ` at ${run}` : ''}: ${formatStat(current)} ${stats.unit}, ${growth} over the baseline of ${formatStat(base)} from ${baseline.time}, more than ${threshold}%`,
+                source: 'go allocations',
+                severity: 'warning'
+            });
+        }
+        return problems;
+    }
+
+    private addRecent(label: string, items: BenchmarkChildItem[]): void {
+        const sources = new Set(items
+            .filter((item): item is AllocationItem => item instanceof AllocationItem)
+            .map(item => item.allocationData.source));
+        for (const source of sources) {
+            this.recent = [{ label, source }, ...this.recent].slice(0, maxRecentProfiles);
+        }
+    }
+
+    // The profiles of the latest runs and opened files, newest first
+    recentProfiles(): RecentProfile[] {
+        return this.recent;
+    }
+
+    /**
+     * Shows what current allocated more, or less, than base, line by line,
+     * at the top of the tree.
+     */
+    showDiff(base: RecentProfile, current: RecentProfile): void {
+        const profile = diffProfiles(base.source.profile, current.source.profile);
+        const options = { ...current.source.options, diff: true, total: base.source.total };
+        const item = new DiffItem(base.label, current.label, allocationItems(profile, options));
+        this.importedProfiles = [...this.importedProfiles, item];
+        this._onDidChangeTreeData.fire();
+    }
+
+    /**
+     * Shows a heap profile from a file, such as one from CI or go test
+     * -memprofile, as a run's would show, without running anything.
+     */
+    async openProfile(filePath: string): Promise<void> {
+        const profile = await loadProfile(filePath, this.abortSignal());
+        const functions = [...profile.functions.values()];
+
+        // The workspace's functions, or, for a profile of other code, all but the runtime's
+        const names = this.modules.map(m => m.name);
+        const inWorkspace = (fn: ProfileFunction) => names.some(name => fn.name.startsWith(`${name}.`) || fn.name.startsWith(`${name}/`));
+        const include = functions.some(inWorkspace) ? inWorkspace : (fn: ProfileFunction) => !fn.name.startsWith('runtime.');
+
+        // A profile from elsewhere may have paths from another machine, or a -trimpath build
+        const missing = functions.some(unresolvedFile);
+        const dir = this.modules[0]?.path ?? vscode.workspace.workspaceFolders?.[0]?.uri.fsPath;
+        let roots: SourceRoots | undefined;
+        if (missing && dir) {
+            try {
+                roots = await sourceRoots(goCommand(), dir, goEnv(), this.abortSignal());
+            } catch (error) {
+                // TODO: map paths from another machine by their module-relative suffix
+                console.warn(`Can't find sources for ${filePath}:`, error);
+            }
+        }
+        const resolvePath = (file: string) => roots ? resolveSourcePath(file, roots) : file;
+
+        const item = new ImportedProfileItem(filePath, allocationItems(profile, { include, resolvePath }));
+        this.importedProfiles = [...this.importedProfiles.filter(p => !(p instanceof ImportedProfileItem) || p.filePath !== filePath), item];
+        this.addRecent(path.basename(filePath), item.children);
+        this._onDidChangeTreeData.fire();
+    }
+
+    closeProfile(item: Item): void {
+        this.importedProfiles = this.importedProfiles.filter(p => p !== item);
+        this._onDidChangeTreeData.fire();
+    }
+
+    private abortController: AbortController = new AbortController();
+    abortSignal(): AbortSignal {
+        return this.abortController.signal;
+    }
+
+    cancelAll(): void {
+        for (const run of [...this.queue]) {
+            this.cancelQueued(run.item);
+        }
+        // Runs in flight wind down on their own, outside any batch that follows
+        for (const item of this.runningItems.keys()) {
+            this.cancelledRuns.add(item);
+        }
+        this.abortController.abort();
+        this.abortController = new AbortController();
+        this.batch?.end();
+        this.batch = undefined;
+        this.batchDone = 0;
+        this.updateRunningContext();
+    }
+
+    // Benchmarks with a run in flight, and their results to come; menus show
+    // a stop action while there are any
+    private runningItems = new Map<BenchmarkItem, Promise<BenchmarkChildItem[]>>();
+
+    private updateRunningContext(): void {
+        vscode.commands.executeCommand('setContext', 'goAllocations.running', this.runningItems.size > 0);
+        this.updateProgress();
+    }
+
+    // One notification for the runs in flight and queued, with a cancel button
+    private batch: BatchProgress | undefined;
+    // Runs finished since the notification appeared
+    private batchDone = 0;
+    // Runs in flight when everything was cancelled, until they end
+    private cancelledRuns = new Set<BenchmarkItem>();
+
+    private updateProgress(): void {
+        const running = [...this.runningItems.keys()].filter(item => !this.cancelledRuns.has(item)).map(item => item.fullName);
+        const remaining = this.queue.length;
+
+        if (running.length === 0 && remaining === 0) {
+            this.batch?.end();
+            this.batch = undefined;
+            this.batchDone = 0;
+            return;
+        }
+
+        const parts = [running.length > 0 ? running.join(', ') : 'Starting'];
+        if (remaining > 0) {
+            parts.push(`${remaining} remaining`);
+        }
+        if (this.batchDone > 0) {
+            parts.push(`${this.batchDone} done`);
+        }
+        const message = parts.join(' · ');
+
+        if (this.batch) {
+            this.batch.message = message;
+            this.batch.progress?.report({ message });
+            return;
+        }
+
+        let end!: () => void;
+        const ended = new Promise<void>(resolve => end = resolve);
+        const batch: BatchProgress = { message, end };
+        this.batch = batch;
+        vscode.window.withProgress(
+            {
+                location: vscode.ProgressLocation.Notification,
+                title: 'Running benchmarks',
+                cancellable: true
+            },
+            (progress, token) => {
+                // Aborting kills the go test processes
+                token.onCancellationRequested(() => this.cancelAll());
+                batch.progress = progress;
+                progress.report({ message: batch.message });
+                return ended;
+            }
+        );
+    }
+
+    // When set, the tree only shows benchmarks in the most recently active Go file
+    private currentFileScope = false;
+    private scopeFile: string | undefined;
+
+    setCurrentFileScope(enabled: boolean, editor: vscode.TextEditor | undefined): void {
+        this.currentFileScope = enabled;
+        this.scopeFile = undefined;
+        this.setActiveEditor(editor);
+        this._onDidChangeTreeData.fire();
+    }
+
+    /**
+     * Follows the active editor when scoped to the current file. Editors that
+     * aren't Go files, such as the output panel, leave the scope as it was.
+     */
+    setActiveEditor(editor: vscode.TextEditor | undefined): void {
+        const document = editor?.document;
+        if (!document || document.uri.scheme !== 'file' || document.languageId !== 'go') {
+            return;
+        }
+
+        const file = path.resolve(document.uri.fsPath);
+        if (file === this.scopeFile) {
+            return;
+        }
+        this.scopeFile = file;
+        if (this.currentFileScope) {
+            this._onDidChangeTreeData.fire();
+        }
+    }
+
+    private scope(): BenchmarkScope {
+        if (!this.currentFileScope) {
+            return { includes: () => true, expand: false, showEmpty: !this.hideEmptyPackages };
+        }
+        const file = this.scopeFile;
+        return {
+            includes: (benchmark) => file !== undefined && path.resolve(benchmark.location.uri.fsPath) === file,
+            expand: true,
+            showEmpty: false
+        };
+    }
+
+    setHideEmptyPackages(hide: boolean): void {
+        if (hide === this.hideEmptyPackages) {
+            return;
+        }
+        this.hideEmptyPackages = hide;
+        this._onDidChangeTreeData.fire();
+    }
+
+    /**
+     * The number of packages left out of the tree for having no benchmarks.
+     */
+    hiddenPackageCount(): number {
+        if (this.scope().showEmpty) {
+            return 0;
+        }
+        return this.modules.reduce((count, m) => count + m.packages.filter(p => p.benchmarks.length === 0).length, 0);
+    }
+
+    /**
+     * Refresh the tree view by clearing all cached data and reloading packages.
+     * This destroys the existing tree view and builds a new one, just like on initial load.
+     */
+    refresh(): void {
+        this.cancelAll();
+
+        // A refresh means rediscover everything, don't restore from the last session
+        clearSavedModules(this.workspaceState).catch(error => {
+            console.warn('Could not clear saved discovery:', error);
+        });
+
+        // Reset all cache state
+        this.modules = [];
+        this.benchmarkItems = new BenchmarkItemCache(item => this.showBenchmarkState(item));
+        this.packageItems = new PackageItemCache();
+        this.loadingPromise = null;
+
+        // Fire tree data change event to refresh the view
+        this._onDidChangeTreeData.fire();
+    }
+
+    async handleSelection(e: vscode.TreeViewSelectionChangeEvent<Item>): Promise<void> {
+        // Navigate on a click, not when adding to a multiple selection
+        if (e.selection.length !== 1) {
+            return;
+        }
+
+        const selectedItem = e.selection[0];
+        if (selectedItem instanceof AllocationItem && vscode.workspace.getConfiguration('goAllocations').get<string>('clickAction', 'navigate') === 'peekStack') {
+            await selectedItem.peekStack(this.allocationView);
+            return;
+        }
+        if (selectedItem instanceof AllocationItem || selectedItem instanceof FunctionItem ||
+            selectedItem instanceof FrameItem || selectedItem instanceof InlinedItem || selectedItem instanceof BuildErrorItem) {
+            await selectedItem.navigateTo();
+            return;
+        }
+    };
+
+    getTreeItem(element: Item): vscode.TreeItem {
+        if (element instanceof AllocationItem || element instanceof FunctionItem || element instanceof OwnerItem ||
+            element instanceof LabelItem) {
+            element.render(this.allocationView);
+        }
+        return element;
+    }
+
+    getParent(element: Item): vscode.ProviderResult<Item> {
+        if (!element) {
+            return undefined; // Root level
+        }
+
+        if (element instanceof ModuleItem) {
+            return undefined; // Module is at root level
+        }
+
+        if (element instanceof PackageItem) {
+            return element.parent;
+        }
+
+        if (element instanceof BenchmarkItem) {
+            return element.parentBenchmark ?? element.parent;
+        }
+
+        if (element instanceof AllocationItem) {
+            return undefined;
+        }
+
+        return undefined;
+    }
+
+    async getChildren(element?: Item): Promise<Item[]> {
+        if (!element) {
+            // If not loaded, start loading
+            if (!this.loadingPromise) {
+                // Start loading in the background and store the promise
+                this.loadingPromise = this.loadModules(vscode.workspace.workspaceFolders ?? []).catch(error => {
+                    console.error('Error loading packages:', error);
+                });
+                // The last session's results show as soon as their benchmarks do, without expanding them
+                this.loadingPromise.then(() => this.restoreSavedResults()).catch(error => {
+                    console.error('Could not restore results:', error);
+                });
+            }
+
+            // Always include instructional text at the top
+            const instruction = new InformationItem(
+                'Click a benchmark below to discover allocations'
+            );
+
+            if (this.modules.length === 0 && this.discovering) {
+                return [instruction, ...this.importedProfiles, new InformationItem('Discovering benchmarks...', 'loading~spin')];
+            }
+
+            // Return currently discovered modules immediately (even if loading is still in progress)
+            const scope = this.scope();
+            const modules = this.modules.filter(m => m.packages.some(p => showsPackage(p, scope)));
+            if (this.currentFileScope && !this.scopeFile) {
+                return [new InformationItem('Open a Go test file to see its benchmarks', 'info')];
+            }
+            if (this.currentFileScope && this.scopeFile && modules.length === 0) {
+                return [new InformationItem(`No benchmarks in ${path.basename(this.scopeFile)}`, 'info')];
+            }
+            const moduleItems = modules.map(module => this.moduleItem(module));
+
+            return [instruction, ...this.importedProfiles, ...moduleItems];
+        }
+
+        if (element instanceof ModuleItem) {
+            return element.getChildren(this.modules, this.packageItems, this.discovering, this.scope());
+        }
+
+        if (element instanceof PackageItem) {
+            return element.getChildren(this.modules, this.benchmarkItems, this.scope());
+        }
+
+        if (element instanceof BenchmarkItem) {
+            const children = this.grouped(this.thresholded(this.filtered(this.withBaseline(element, await this.runBenchmarkChildren(element)))));
+            return element.stale ? [staleItem(element), ...children] : children;
+        }
+
+        if (element instanceof CpuItem || element instanceof ExperimentItem ||
+            element instanceof ImportedProfileItem || element instanceof DiffItem) {
+            return this.grouped(this.thresholded(this.filtered(element.children)));
+        }
+
+        if (element instanceof FunctionItem || element instanceof OwnerItem || element instanceof SmallSitesItem || element instanceof LabelItem ||
+            element instanceof StackItem || element instanceof HiddenFramesItem) {
+            return element.children;
+        }
+
+        if (element instanceof AllocationItem) {
+            return this.stackItems(element);
+        }
+
+        return Promise.resolve([]);
+    }
+
+    /**
+     * Results with their allocations recomputed from their profiles, with
+     * only the samples the view's focus, ignore and label filters keep. The
+     * profiles have every sample, so nothing runs again.
+     */
+    private filtered(items: BenchmarkChildItem[]): BenchmarkChildItem[] {
+        const { focus, ignore, labelFilter } = this.allocationView;
+        if ((!focus && !ignore && !labelFilter) || !items.some(item => item instanceof AllocationItem)) {
+            return items;
+        }
+
+        const results = items.filter(item => !(item instanceof AllocationItem));
+        const first = items.findIndex(item => item instanceof AllocationItem);
+        let focusRegex: RegExp | undefined;
+        let ignoreRegex: RegExp | undefined;
+        let label: LabelFilter | undefined;
+        try {
+            focusRegex = focus ? new RegExp(focus) : undefined;
+            ignoreRegex = ignore ? new RegExp(ignore) : undefined;
+            label = parseLabelFilter(labelFilter);
+        } catch (error) {
+            const msg = error instanceof Error ? error.message : String(error);
+            results.splice(first, 0, new InformationItem(`Invalid filter: ${msg}`, 'error'));
+            return results;
+        }
+        const filterProfiles = (profile: Profile): Profile => {
+            const filtered = filterProfile(profile, focusRegex, ignoreRegex);
+            if (!label) {
+                return filtered;
+            }
+            const { key, value } = label;
+            return filterSamples(filtered, sample => {
+                const v = sampleLabel(sample, key);
+                return v !== undefined && (value === undefined || v === value);
+            });
+        };
+
+        const filterItem = new InformationItem(
+            [focus && `Focus: ${focus}`, ignore && `Ignore: ${ignore}`, labelFilter && `Label: ${labelFilter}`].filter(Boolean).join(', '),
+            'info'
+        );
+        filterItem.tooltip = 'Only allocations in stacks through a function matching focus, none matching ignore, and with the label, as pprof -focus, -ignore and -tagfocus';
+        const allocations: BenchmarkChildItem[] = [filterItem];
+        const sources = new Set<AllocationSource>();
+        for (const item of items) {
+            if (item instanceof AllocationItem && !sources.has(item.allocationData.source)) {
+                const { source } = item.allocationData;
+                sources.add(source);
+                const kept = allocationItems(filterProfiles(source.profile), source.options);
+                allocations.push(...(kept.some(a => a instanceof AllocationItem) ? kept : [new InformationItem('No allocations match the filters', 'info')]));
+            }
+        }
+        results.splice(first, 0, ...allocations);
+        return results;
+    }
+
+    // The allocations in every benchmark's results so far, with the -cpu or experiment run they're from, if any
+    private resultAllocations(): SiteAllocation[] {
+        return [...this.benchmarkItems.values()].flatMap(benchmark => this.benchmarkAllocations(benchmark));
+    }
+
+    /**
+     * The lines that allocate the most over every benchmark's results so
+     * far, at most count of them. Profiles of benchmarks run for different
+     * b.N can't be compared as they are, so each site is its share of its
+     * profile's bytes, times its benchmark's B/op.
+     */
+    topSites(count: number): TopSite[] {
+        const lines = new Map<string, TopSite & { perBenchmark: Map<BenchmarkItem, { site: SiteAllocation; bytesPerOp: number }> }>();
+        for (const site of this.resultAllocations()) {
+            // TODO: runs with several -cpu values or experiments, which have B/op for each
+            const bytesPerOp = site.benchmark.results?.find((child): child is StatsItem => child instanceof StatsItem && child.unit === 'B/op')?.stats.median;
+            const { sampleTypes, flat, source, functionName } = site.allocation.allocationData;
+            const index = sampleTypes.findIndex(st => st.type === 'alloc_space');
+            if (bytesPerOp === undefined || index < 0 || flat[index] <= 0 || source.total[index] <= 0) {
+                continue;
+            }
+            const { filePath, lineNumber } = site.allocation;
+            const key = `${path.resolve(filePath)}:${lineNumber}`;
+            const line = lines.get(key) ?? { filePath, lineNumber, functionName, bytesPerOp: 0, sites: [], perBenchmark: new Map() };
+            // A benchmark's runs each count once, by the most of them
+            const perOp = flat[index] / source.total[index] * bytesPerOp;
+            const shown = line.perBenchmark.get(site.benchmark);
+            if (!shown || perOp > shown.bytesPerOp) {
+                line.perBenchmark.set(site.benchmark, { site, bytesPerOp: perOp });
+            }
+            lines.set(key, line);
+        }
+
+        const top: TopSite[] = [...lines.values()].map(({ perBenchmark, ...line }) => {
+            const ranked = [...perBenchmark.values()].sort((a, b) => b.bytesPerOp - a.bytesPerOp);
+            return { ...line, bytesPerOp: ranked.reduce((sum, r) => sum + r.bytesPerOp, 0), sites: ranked.map(r => r.site) };
+        });
+        return top.sort((a, b) => b.bytesPerOp - a.bytesPerOp).slice(0, count);
+    }
+
+    // Every allocation site in the results so far, stale or not, to search by name
+    allAllocations(): SiteAllocation[] {
+        return this.resultAllocations();
+    }
+
+    /**
+     * The allocation sites in the results so far whose files haven't changed
+     * since, for hovers and diagnostics; stale lines may have moved.
+     */
+    currentAllocations(): SiteAllocation[] {
+        return this.resultAllocations().filter(({ allocation }) =>
+            !allocation.stale);
+    }
+
+    /**
+     * The functions in a file that allocate in the results so far, with one
+     * site for each benchmark that they allocate in; each site has its
+     * function's totals.
+     */
+    functionsIn(filePath: string): FunctionAllocations[] {
+        const file = path.resolve(filePath);
+        const functions = new Map<string, FunctionAllocations>();
+        for (const site of this.currentAllocations()) {
+            if (path.resolve(site.allocation.filePath) !== file) {
+                continue;
+            }
+            const { name, startLine } = site.allocation.allocationData.function;
+            const fn = functions.get(name) ?? { name, startLine, sites: [] };
+            if (!fn.sites.some(s => s.benchmark === site.benchmark)) {
+                fn.sites.push(site);
+            }
+            functions.set(name, fn);
+        }
+        return [...functions.values()];
+    }
+
+    // When the oldest of the results came in; edits before it no longer move any line
+    oldestFinishedAt(): number | undefined {
+        const times = [...this.benchmarkItems.values()].filter(item => item.results).map(item => item.finishedAt ?? 0);
+        return times.length > 0 ? Math.min(...times) : undefined;
+    }
+
+    // All the allocation sites in the results so far, for decorations that follow edits, and whether their file changed since
+    decoratedAllocations(): (SiteAllocation & { stale: boolean })[] {
+        return this.resultAllocations().map(site => ({ ...site, stale: site.allocation.stale }));
+    }
+
+    // The allocation sites in one benchmark's results, including those of each -cpu value or experiment
+    private benchmarkAllocations(benchmark: BenchmarkItem): SiteAllocation[] {
+        return runAllocations(benchmark.results ?? []).map(site => ({ benchmark, ...site }));
+    }
+
+    // By file, the benchmarks whose results point into it and not yet
+    // stale for it, with their allocation sites there
+    private resultFiles = new Map<string, Map<BenchmarkItem, AllocationItem[]>>();
+
+    // Indexes the benchmark's latest results by the files they point into, and returns those
+    private indexResultFiles(item: BenchmarkItem): string[] {
+        for (const items of this.resultFiles.values()) {
+            items.delete(item);
+        }
+        const files = new Map<string, AllocationItem[]>([[path.resolve(item.location.uri.fsPath), []]]);
+        for (const { allocation } of this.benchmarkAllocations(item)) {
+            const file = path.resolve(allocation.filePath);
+            files.set(file, [...(files.get(file) ?? []), allocation]);
+        }
+        for (const [file, allocations] of files) {
+            const items = this.resultFiles.get(file) ?? new Map<BenchmarkItem, AllocationItem[]>();
+            this.resultFiles.set(file, items.set(item, allocations));
+        }
+        return [...files.keys()];
+    }
+
+    /**
+     * Marks results as stale when a file they point into changes after the
+     * run: the benchmark's own, or one an allocation site is in. Their line
+     * numbers may no longer match the source.
+     */
+    markStale(uri: vscode.Uri): void {
+        const file = path.resolve(uri.fsPath);
+        const items = this.resultFiles.get(file);
+        // Each edit calls this, once stale for the file a benchmark is left out
+        for (const [item, allocations] of items ?? []) {
+            // The run checks for edits when it's done
+            if (item.running) {
+                continue;
+            }
+            items?.delete(item);
+            for (const allocation of allocations) {
+                const options = allocation.allocationData.source.options;
+                options.staleFiles = (options.staleFiles ?? new Set<string>()).add(file);
+            }
+            item.setStale();
+            this._onDidChangeTreeData.fire(item);
+        }
+    }
+
+    // The versions of the open files, to tell later which were edited since
+    private documentVersions(): Map<string, number> {
+        return new Map(vscode.workspace.textDocuments.map(d => [path.resolve(d.uri.fsPath), d.version]));
+    }
+
+    /**
+     * Marks the benchmark's results stale for each of the files that changed
+     * since the time: edited from the version it had, if open then, or
+     * written after.
+     */
+    private async markChangedSince(files: string[], time: number, versions: Map<string, number>): Promise<void> {
+        const current = this.documentVersions();
+        for (const file of files) {
+            const edited = versions.has(file) && current.has(file) && versions.get(file) !== current.get(file);
+            const stat = edited ? undefined : await fs.promises.stat(file).catch(() => undefined);
+            if (edited || (stat && stat.mtimeMs > time)) {
+                this.markStale(vscode.Uri.file(file));
+            }
+        }
+    }
+
+    // The label keys of the samples in the results so far, for grouping by label
+    labelKeys(): string[] {
+        const keys = new Set<string>();
+        for (const { allocation } of this.resultAllocations()) {
+            profileLabels(allocation.allocationData.source.profile).forEach((_, key) => keys.add(key));
+        }
+        return [...keys].sort();
+    }
+
+    /**
+     * Every benchmark whose results so far allocate at a line, most first
+     * by the view's sample type and attribution, across packages and modules.
+     */
+    allocationsAt(filePath: string, lineNumber: number): SiteAllocation[] {
+        // TODO: keep an index by line, rather than scanning all results
+        const file = path.resolve(filePath);
+        const view = this.allocationView;
+        const shown = ({ allocation }: SiteAllocation) => {
+            const index = sampleIndex(allocation.allocationData, view);
+            return view.attribution === 'flat' ? allocation.allocationData.flat[index] : allocation.allocationData.cum[index];
+        };
+        const found = this.currentAllocations()
+            .filter(({ allocation }) => allocation.lineNumber === lineNumber && path.resolve(allocation.filePath) === file);
+        for (const { allocation } of found) {
+            allocation.render(view);
+        }
+        return found.sort((a, b) => shown(b) - shown(a));
+    }
+
+    /**
+     * Results with the allocation sites below the view's threshold, by the
+     * value they show, folded into one item after the rest.
+     */
+    private thresholded(items: BenchmarkChildItem[]): BenchmarkChildItem[] {
+        let parsed: Threshold | undefined;
+        try {
+            parsed = parseThreshold(this.allocationView.threshold);
+        } catch (error) {
+            console.error('Invalid goAllocations.threshold:', error);
+            return items;
+        }
+        if (!parsed) {
+            return items;
+        }
+        const threshold = parsed;
+
+        const shown = (item: AllocationItem, index: number) =>
+            this.allocationView.attribution === 'flat' ? item.allocationData.flat[index] : item.allocationData.cum[index];
+        const isSmall = (item: BenchmarkChildItem): item is AllocationItem => {
+            if (!(item instanceof AllocationItem)) {
+                return false;
+            }
+            const index = sampleIndex(item.allocationData, this.allocationView);
+            const min = threshold.percent ? item.allocationData.source.total[index] * threshold.value / 100 : threshold.value;
+            // Diffs have decreases too
+            return Math.abs(shown(item, index)) < min;
+        };
+
+        const small = items.filter(isSmall);
+        if (small.length === 0) {
+            return items;
+        }
+        const index = sampleIndex(small[0].allocationData, this.allocationView);
+        const total = small.reduce((sum, item) => sum + shown(item, index), 0);
+        const unit = small[0].allocationData.sampleTypes[index].unit;
+        const label = threshold.percent ? `${threshold.value}%` : formatValue(threshold.value, unit);
+        const percent = formatPercent(total, small[0].allocationData.source.total[index]);
+        const smallItem = new SmallSitesItem(small, formatValue(total, unit), percent, label);
+
+        // After the last site that shows
+        const rest = items.filter(item => !isSmall(item));
+        const last = rest.map(item => item instanceof AllocationItem).lastIndexOf(true);
+        const at = last >= 0 ? last + 1 : items.indexOf(small[0]);
+        return [...rest.slice(0, at), smallItem, ...rest.slice(at)];
+    }
+
+    /**
+     * Results with their allocations as the view groups them: each line on
+     * its own, or under an item for its function, where its first line was,
+     * or under the packages that allocated, most first, where the first
+     * allocation was.
+     */
+    private grouped(items: BenchmarkChildItem[]): Item[] {
+        if (this.allocationView.groupBy === 'package') {
+            return this.groupedByPackage(items);
+        }
+        if (this.allocationView.groupBy === 'label') {
+            return this.groupedByLabel(items);
+        }
+        if (this.allocationView.groupBy !== 'function') {
+            return items;
+        }
+        const functions = new Map<string, FunctionItem>();
+        const grouped: Item[] = [];
+        for (const item of items) {
+            if (!(item instanceof AllocationItem)) {
+                grouped.push(item);
+                continue;
+            }
+            let fn = functions.get(item.allocationData.function.name);
+            if (!fn) {
+                fn = new FunctionItem(item);
+                functions.set(item.allocationData.function.name, fn);
+                grouped.push(fn);
+            }
+            fn.children.push(item);
+        }
+        return grouped;
+    }
+
+    // Allocations recomputed for each value of the view's label key, as pprof -tagfocus would
+    private groupedByLabel(items: BenchmarkChildItem[]): Item[] {
+        const key = this.allocationView.labelKey;
+        const first = items.findIndex(item => item instanceof AllocationItem);
+        if (!key || first < 0) {
+            return items;
+        }
+
+        const groups: Item[] = [];
+        const sources = new Set<AllocationSource>();
+        for (const item of items) {
+            if (!(item instanceof AllocationItem) || sources.has(item.allocationData.source)) {
+                continue;
+            }
+            const { source } = item.allocationData;
+            sources.add(source);
+
+            const values = [...profileLabels(source.profile).get(key) ?? []].sort();
+            for (const value of [...values, undefined]) {
+                const profile = filterSamples(source.profile, sample => sampleLabel(sample, key) === value);
+                const allocations = allocationItems(profile, source.options).filter((a): a is AllocationItem => a instanceof AllocationItem);
+                if (allocations.length > 0) {
+                    groups.push(new LabelItem(key, value, allocations, source.total));
+                }
+            }
+        }
+        if (groups.length === 0) {
+            // TODO: Go's heap profiles don't carry pprof.Do labels yet, say so
+            groups.push(new InformationItem(`No samples have the label ${key}`, 'info'));
+        }
+        const rest = items.filter(item => !(item instanceof AllocationItem));
+        return [...rest.slice(0, first), ...groups, ...rest.slice(first)];
+    }
+
+    private groupedByPackage(items: BenchmarkChildItem[]): Item[] {
+        const owners = new Map<string, OwnerItem>();
+        let index = 0;
+        for (const item of items) {
+            if (!(item instanceof AllocationItem)) {
+                continue;
+            }
+            index = sampleIndex(item.allocationData, this.allocationView);
+            for (const share of item.allocationData.packages) {
+                let owner = owners.get(share.package);
+                if (!owner) {
+                    owner = new OwnerItem(share.package);
+                    owners.set(share.package, owner);
+                }
+                // TODO: show only the stacks that allocate in this package
+                owner.children.push(new AllocationItem(item.label as string, item.filePath, item.lineNumber, item.allocationData, share));
+            }
+        }
+        const sorted = [...owners.values()].sort((a, b) => b.total(index) - a.total(index));
+        for (const owner of sorted) {
+            owner.children.sort((a, b) => (b.share?.values[index] ?? 0) - (a.share?.values[index] ?? 0));
+        }
+
+        const first = items.findIndex(item => item instanceof AllocationItem);
+        if (first < 0) {
+            return items;
+        }
+        const rest = items.filter(item => !(item instanceof AllocationItem));
+        return [...rest.slice(0, first), ...sorted, ...rest.slice(first)];
+    }
+
+    /**
+     * The stacks that allocate at a line, most first by the view's sample
+     * type, after any code inlined there. A line with one stack shows its
+     * frames directly, unless always.
+     */
+    private stackItems(item: AllocationItem, always = false): Item[] {
+        const data = item.allocationData;
+        const index = sampleIndex(data, this.allocationView);
+        const { unit } = data.sampleTypes[index];
+        const inlined = data.inlined()
+            .sort((a, b) => b.values[index] - a.values[index])
+            .map(stack => new InlinedItem(stack.frames[0], data.source.options.resolvePath(stack.frames[0].fn.filename), formatValue(stack.values[index], unit)));
+        const stacks = data.stacks().sort((a, b) => b.values[index] - a.values[index]);
+
+        const frames = (stack: Stack) => this.hideExternal(stack.frames.map(frame => {
+            const file = data.source.options.resolvePath(frame.fn.filename);
+            const site = frame.line === item.lineNumber && path.resolve(file) === path.resolve(item.filePath);
+            return new FrameItem(frame, file, site);
+        }));
+        if (stacks.length === 1 && !always) {
+            return [...inlined, ...frames(stacks[0])];
+        }
+        return [...inlined, ...stacks.map((stack, i) =>
+            new StackItem(`Stack ${i + 1} of ${stacks.length}`, formatValue(stack.values[index], unit), frames(stack))
+        )];
+    }
+
+    // Every stack that allocates at a line, for the stacks panel, which shows even one as such
+    stacksOf(item: AllocationItem): Item[] {
+        return this.stackItems(item, true);
+    }
+
+    // Frames with runs outside the workspace folded into one item, if the view hides them
+    private hideExternal(frames: FrameItem[]): (FrameItem | HiddenFramesItem)[] {
+        if (!this.allocationView.hideExternalFrames) {
+            return frames;
+        }
+        const shown: (FrameItem | HiddenFramesItem)[] = [];
+        let hidden: FrameItem[] = [];
+        const flush = () => {
+            if (hidden.length > 0) {
+                shown.push(new HiddenFramesItem(hidden));
+                hidden = [];
+            }
+        };
+        for (const frame of frames) {
+            // TODO: a workspace that has the module cache or GOROOT in it
+            if (vscode.workspace.getWorkspaceFolder(vscode.Uri.file(frame.filePath))) {
+                flush();
+                shown.push(frame);
+            } else {
+                hidden.push(frame);
+            }
+        }
+        flush();
+        return shown;
+    }
+
+    private async loadModules(workspaceFolders: readonly vscode.WorkspaceFolder[]): Promise<void> {
+        const signal = this.abortSignal();
+
+        if (workspaceFolders.length === 0) {
+            this._onDidChangeTreeData.fire();
+            return;
+        }
+
+        this.discovering = true;
+        try {
+            // A folder may hold several modules, via go.work
+            const roots: ModuleRoot[] = [];
+            for (const workspaceFolder of workspaceFolders) {
+                // Remotely, the extension runs on the remote host, where its folders are files too;
+                // other schemes are virtual, with no disk for go to run on
+                if (workspaceFolder.uri.scheme !== 'file') {
+                    console.warn(`Skipping ${workspaceFolder.uri}, which is not on disk`);
+                    continue;
+                }
+                roots.push(...await findModuleRoots(workspaceFolder.uri.fsPath));
+            }
+
+            // Fast first pass: scan _test.go files directly, so the tree is usable
+            // before gopls has finished indexing the workspace.
+            for (const root of roots) {
+                if (signal.aborted) {
+                    throw new Error('Operation cancelled');
+                }
+
+                try {
+                    if (!(await this.restoreSavedModule(root))) {
+                        await this.prescanModule(root, nestedRoots(root, roots));
+                    }
+                } catch (error) {
+                    if (signal.aborted) {
+                        throw error;
+                    }
+                    // The pre-scan is best effort, verification below is authoritative
+                    console.warn('Pre-scan failed:', error);
+                }
+            }
+
+            const strategy = getDiscoveryStrategy();
+            console.log(`Using ${strategy} strategy for benchmark discovery`);
+
+            // Get all benchmark symbols once for the entire workspace
+            let allBenchmarkSymbols: vscode.SymbolInformation[] = [];
+            if (strategy !== 'goTestList') {
+                console.log('Searching for benchmark functions via workspace symbols...');
+                allBenchmarkSymbols = await findBenchmarkSymbols();
+                console.log(`Found ${allBenchmarkSymbols.length} benchmark functions total`);
+            }
+
+            // Process each module with the filtered symbols
+            for (const root of roots) {
+                if (signal.aborted) {
+                    throw new Error('Operation cancelled');
+                }
+
+                try {
+                    await this.verifyModule(root, nestedRoots(root, roots), strategy, allBenchmarkSymbols);
+                } catch (error) {
+                    if (signal.aborted) {
+                        throw error;
+                    }
+                    console.error('Error processing module:', error);
+                    throw error; // Don't silently continue if discovery fails
+                }
+            }
+
+            console.log('Discovery completed');
+            this.saveDiscovery();
+        } catch (error) {
+            if (signal.aborted) {
+                console.log('Package loading cancelled');
+                throw error;
+            }
+        } finally {
+            this.discovering = false;
+            this._onDidChangeTreeData.fire();
+        }
+    }
+
+    private async verifyModule(
+        root: ModuleRoot,
+        nested: string[],
+        strategy: DiscoveryStrategy,
+        allBenchmarkSymbols: vscode.SymbolInformation[]
+    ): Promise<void> {
+        const signal = this.abortSignal();
+
+        try {
+            if (signal.aborted) {
+                throw new Error('Operation cancelled');
+            }
+
+            const rootPath = root.path;
+
+            // Get the module name for this root (still need go list for this)
+            const moduleName = await listModuleName(rootPath, signal);
+            if (!moduleName) {
+                return; // Skip if not a valid module
+            }
+
+            // Create module entry, or refine the one created by the pre-scan
+            let module = this.modules.find(m => m.path === rootPath);
+            if (!module) {
+                module = {
+                    name: moduleName,
+                    path: rootPath,
+                    goWork: root.goWork,
+                    packages: []
+                };
+                this.modules.push(module);
+            }
+
+            let verified: PackageCache[] = [];
+            if (strategy !== 'goTestList') {
+                verified = await goplsPackages(rootPath, nested, allBenchmarkSymbols, signal);
+                console.log(`Found ${verified.length} packages via gopls in ${moduleName}`);
+            }
+
+            // When gopls is unavailable or misconfigured, it finds nothing; ask the go command instead
+            if (strategy === 'goTestList' || (strategy === 'auto' && !hasBenchmarks(verified))) {
+                verified = await goTestListPackages(rootPath, nested, signal);
+                console.log(`Found ${verified.length} packages via go test -list in ${moduleName}`);
+            }
+
+            // gopls may not have indexed the workspace yet; an empty answer is
+            // not evidence that the pre-scan was wrong.
+            // TODO: retry verification once gopls reports it is ready
+            if (!hasBenchmarks(verified) && hasBenchmarks(module.packages)) {
+                console.log(`No benchmarks verified for ${moduleName}, keeping pre-scan results`);
+                return;
+            }
+
+            // Replace the pre-scan results with the verified packages
+            module.name = moduleName;
+            module.goWork = root.goWork;
+            // Only this module's items; other modules keep theirs
+            for (const pkg of [...module.packages, ...verified]) {
+                this.benchmarkItems.deletePackage(pkg.path);
+                this.packageItems.delete(pkg.path);
+            }
+            module.packages = mergeProvisional(verified, module.packages);
+            for (const pkg of verified) {
+                console.log(`Verified package ${pkg.name} with ${pkg.benchmarks.length} benchmarks`);
+            }
+            this._onDidChangeTreeData.fire();
+        } catch (error) {
+            if (signal.aborted) {
+                console.log('Package discovery cancelled');
+                throw error;
+            }
+            console.error('Package discovery failed:', error);
+            throw error; // Let the caller handle the error
+        }
+    }
+
+    /**
+     * Keeps the module cache in step with a multi-root workspace, as folders
+     * are added and removed.
+     */
+    async updateWorkspaceFolders(e: vscode.WorkspaceFoldersChangeEvent): Promise<void> {
+        if (!this.loadingPromise) {
+            return; // Nothing discovered yet, initial load will see the current folders
+        }
+
+        for (const folder of e.removed) {
+            const root = folder.uri.fsPath;
+            // TODO: go.work modules outside the folder, such as use ../other
+            const removed = this.modules.filter(m => isWithin(m.path, root));
+            for (const module of removed) {
+                for (const pkg of module.packages) {
+                    this.benchmarkItems.deletePackage(pkg.path);
+                    this.packageItems.delete(pkg.path);
+                }
+            }
+            this.modules = this.modules.filter(m => !removed.includes(m));
+        }
+        this._onDidChangeTreeData.fire();
+
+        if (e.added.length > 0) {
+            const previous = this.loadingPromise;
+            this.loadingPromise = previous
+                .then(() => this.loadModules(e.added))
+                .catch(error => {
+                    console.error('Error loading packages:', error);
+                });
+            await this.loadingPromise;
+        } else {
+            this.saveDiscovery();
+        }
+    }
+
+    /**
+     * Populates the module cache from the previous session, if it was saved.
+     * Returns false if there was nothing to restore.
+     */
+    private async restoreSavedModule(root: ModuleRoot): Promise<boolean> {
+        const module = await restoreModule(this.workspaceState, root.path);
+        if (!module) {
+            return false;
+        }
+
+        this.modules.push(module);
+        console.log(`Restored ${module.packages.length} packages in ${module.name} from the previous session`);
+        this._onDidChangeTreeData.fire();
+        return true;
+    }
+
+    private saveDiscovery(): void {
+        saveModules(this.workspaceState, this.modules).catch(error => {
+            console.warn('Could not save discovery:', error);
+        });
+    }
+
+    /**
+     * Populates the module cache from a regex scan of _test.go files, without
+     * invoking go or gopls. Results are provisional until verified by
+     * verifyModule.
+     */
+    private async prescanModule(root: ModuleRoot, nested: string[]): Promise<void> {
+        const signal = this.abortSignal();
+
+        const moduleName = await readModuleName(root.path);
+        if (!moduleName) {
+            return; // Not a module root, leave it to verification
+        }
+
+        const packages = await prescanPackages(root.path, nested, signal);
+        this.modules.push({
+            name: moduleName,
+            path: root.path,
+            goWork: root.goWork,
+            packages
+        });
+
+        console.log(`Pre-scan found ${packages.length} packages in ${moduleName}`);
+        this._onDidChangeTreeData.fire();
+    }
+
+    private pendingUpdates = new Map<string, NodeJS.Timeout>();
+
+    /**
+     * Updates the package for an edited, unsaved test file, debounced
+     * so that typing doesn't rescan on every keystroke.
+     */
+    scheduleUpdatePackage(uri: vscode.Uri): void {
+        const key = uri.fsPath;
+        clearTimeout(this.pendingUpdates.get(key));
+        this.pendingUpdates.set(key, setTimeout(() => {
+            this.pendingUpdates.delete(key);
+            this.updatePackage(uri).catch(error => {
+                console.warn('Could not update package:', error);
+            });
+        }, 500));
+    }
+
+    /**
+     * Incrementally updates the package containing a changed _test.go file,
+     * rather than re-running discovery for the whole module.
+     */
+    async updatePackage(uri: vscode.Uri): Promise<void> {
+        if (!this.loadingPromise) {
+            return; // Nothing discovered yet, initial load will pick it up
+        }
+        await this.loadingPromise;
+
+        const packageDir = path.dirname(uri.fsPath);
+
+        // The innermost module containing the package
+        const module = this.modules
+            .filter(m => isWithin(packageDir, m.path))
+            .sort((a, b) => b.path.length - a.path.length)[0];
+        if (!module || isExcluded(path.relative(module.path, packageDir))) {
+            return;
+        }
+
+        const scanned = await scanPackage(packageDir, module.path, unsavedOverlays());
+        const index = module.packages.findIndex(p => p.path === packageDir);
+        const existing = index >= 0 ? module.packages[index] : undefined;
+
+        const hasTests = await hasTestFiles(packageDir);
+
+        if (existing && hasTests) {
+            // Keep the verified name, just replace the benchmarks; those still declared keep their items
+            this.benchmarkItems.deleteMissing(packageDir, new Set(scanned.benchmarks.map(b => b.name)));
+            const unchanged = scanned.benchmarks.length === existing.benchmarks.length &&
+                scanned.benchmarks.every((b, i) => b.name === existing.benchmarks[i].name && sameDeclaration(existing.benchmarks[i], b));
+            existing.benchmarks = scanned.benchmarks;
+            // Most typing only moves the benchmarks, which their items follow without a re-render
+            if (unchanged) {
+                for (const benchmark of scanned.benchmarks) {
+                    const benchmarkItem = this.benchmarkItems.find(packageDir, benchmark.name);
+                    benchmarkItem?.rediscovered(benchmark, benchmarkItem.parent);
+                }
+                this.saveDiscovery();
+                return;
+            }
+            const item = this.packageItems.get(packageDir);
+            this._onDidChangeTreeData.fire(item);
+            this.saveDiscovery();
+            return;
+        }
+
+        if (existing) {
+            module.packages.splice(index, 1);
+            this.packageItems.delete(packageDir);
+            this.benchmarkItems.deletePackage(packageDir);
+        } else if (hasTests) {
+            module.packages.push(scanned);
+        } else {
+            return; // A deleted test file, in a package we never saw
+        }
+
+        // TODO: fire only for the ModuleItem, rather than the whole tree
+        this._onDidChangeTreeData.fire();
+        this.saveDiscovery();
+    }
+
+    /**
+     * Queues all benchmarks, and waits for their runs.
+     */
+    async runAllBenchmarks(): Promise<void> {
+        this.lastRun = { overrides: {}, pinned: new Map() };
+        await this.runLast(this.allBenchmarkItems());
+    }
+
+    // The most recent run asked for, to repeat it
+    private lastRun: LastRun | undefined;
+
+    /**
+     * Repeats the most recent run with the same target, and each benchmark
+     * with the flags it ran with then.
+     */
+    async rerunLast(): Promise<void> {
+        const last = this.lastRun;
+        if (!last) {
+            throw new Error('Nothing has been run yet');
+        }
+        if (!last.items) {
+            await this.runLast(this.allBenchmarkItems());
+            return;
+        }
+        // A refresh since replaces the items
+        const items = last.items.map(item => this.currentItem(item));
+        await this.runLast(this.benchmarksOf(items));
+    }
+
+    // The item in the tree now for one from before a refresh; itself if it's gone
+    private currentItem(item: Item): Item {
+        if (item instanceof BenchmarkItem) {
+            // Sub-benchmark items only exist in their parent's results
+            const [name] = item.fullName.split('/');
+            const top = this.lookupBenchmarkItem(item.folderPath, name);
+            const current = name === item.fullName ? top : top?.results?.find((child): child is BenchmarkItem =>
+                child instanceof BenchmarkItem && child.fullName === item.fullName);
+            return current ?? item;
+        }
+        if (item instanceof PackageItem) {
+            return this.packageItems.get(item.filePath) ?? item;
+        }
+        return item;
+    }
+
+    /**
+     * Runs the benchmarks of the latest run, with its overrides, once each.
+     * Each has the flags, and the -cpu values defaults run with, it first
+     * ran with in it, so a repeat is identical even if settings change.
+     */
+    private async runLast(benchmarkItems: BenchmarkItem[]): Promise<void> {
+        const last = this.lastRun;
+        if (!last) {
+            return;
+        }
+        const pin = (item: BenchmarkItem): RunOverrides => {
+            const key = pinKey(item);
+            const pinned = last.pinned.get(key) ?? {
+                flags: last.overrides.flags ?? item.defaultFlags(last.overrides),
+                cpus: last.overrides.cpus ?? (last.overrides.flags ? [] : item.cpus())
+            };
+            last.pinned.set(key, pinned);
+            return { ...last.overrides, ...pinned };
+        };
+        // A benchmark run on its own shows why it can't run, unsaved say
+        const runnable = benchmarkItems.length === 1 ? benchmarkItems : benchmarkItems.filter(item => !item.benchmark.unsaved);
+        await Promise.all(runnable.map(item => this.enqueue(item, pin(item))));
+    }
+
+    // The benchmarks of items in the tree, once each, whether they are benchmarks or beneath a package or module
+    private benchmarksOf(items: Item[]): BenchmarkItem[] {
+        const benchmarkItems = new Set<BenchmarkItem>();
+        for (const item of items) {
+            if (item instanceof BenchmarkItem) {
+                benchmarkItems.add(item);
+            } else if (item instanceof PackageItem || item instanceof ModuleItem) {
+                this.benchmarkItemsBeneath(item).forEach(b => benchmarkItems.add(b));
+            }
+            // Other items, such as allocations, aren't runnable
+        }
+        return [...benchmarkItems];
     }
 
-    clearBenchmarkRunState(item: BenchmarkItem): void {
-        this._onDidChangeTreeData.fire(item);
+    /**
+     * Queues the benchmarks of a multiple selection in the tree, once each,
+     * whether selected directly or beneath a selected package or module,
+     * with the overrides. A single item runs as runWith would.
+     */
+    async runSelected(items: Item[], overrides: RunOverrides = {}): Promise<void> {
+        if (items.length === 1) {
+            await this.runWith(items[0], overrides);
+            return;
+        }
+        this.lastRun = { items, overrides, pinned: new Map() };
+        await this.runLast(this.benchmarksOf(items));
     }
 
     /**
-     * Refresh the tree view by clearing all cached data and reloading packages.
-     * This destroys the existing tree view and builds a new one, just like on initial load.
+     * The flags a run of the benchmark, package or module would use. For a
+     * package or module, those of its first benchmark.
      */
-    refresh(): void {
-        this.cancelAll();
-
-        // Reset all cache state
-        this.modules = [];
-        this.benchmarkItems = new BenchmarkItemCache();
-        this.loadingPromise = null;
+    defaultFlags(item: Item): string[] {
+        if (item instanceof BenchmarkItem) {
+            return item.defaultFlags();
+        }
+        // TODO: benchmarks in a package may need different -tags
+        const first = this.benchmarkItemsBeneath(item)[0];
+        if (!first) {
+            throw new Error(`No benchmarks in ${item.label}`);
+        }
+        return first.defaultFlags();
+    }
 
-        // Fire tree data change event to refresh the view
-        this._onDidChangeTreeData.fire();
+    /**
+     * Runs a benchmark, or each benchmark the tree shows in a package or
+     * module, once with the overrides. Each goes through the run queue.
+     */
+    async runWith(item: Item, overrides: RunOverrides = {}): Promise<void> {
+        const benchmarkItems = item instanceof BenchmarkItem ? [item] : this.benchmarkItemsBeneath(item);
+        this.lastRun = { items: [item], overrides, pinned: new Map() };
+        await this.runLast(benchmarkItems);
     }
 
-    async handleSelection(e: vscode.TreeViewSelectionChangeEvent<Item>): Promise<void> {
-        if (e.selection.length === 0) {
-            return;
+    private benchmarkItemsBeneath(item: Item): BenchmarkItem[] {
+        const scope = this.scope();
+        if (item instanceof PackageItem) {
+            return this.packageBenchmarkItems(item).filter(b => scope.includes(b.benchmark));
         }
-
-        const selectedItem = e.selection[0];
-        if (selectedItem instanceof AllocationItem) {
-            await selectedItem.navigateTo();
-            return;
+        if (item instanceof ModuleItem) {
+            const module = this.modules.find(m => m.path === item.modulePath);
+            if (!module) {
+                throw new Error('Module not found in cache');
+            }
+            return module.packages.flatMap(pkg =>
+                pkg.benchmarks.filter(scope.includes).map(benchmark => this.benchmarkItem(module, pkg, benchmark))
+            );
         }
-    };
+        throw new Error(`Cannot run ${item.label}`);
+    }
 
-    getTreeItem(element: Item): vscode.TreeItem {
-        return element;
+    private async runBenchmarks(benchmarkItems: BenchmarkItem[], overrides?: RunOverrides): Promise<void> {
+        const runnable = benchmarkItems.filter(item => !item.benchmark.unsaved);
+        await Promise.all(runnable.map(item => this.enqueue(item, overrides)));
     }
 
-    getParent(element: Item): vscode.ProviderResult<Item> {
-        if (!element) {
-            return undefined; // Root level
-        }
+    // Problems from runs, by benchmark, shown in the Problems panel
+    private diagnostics: vscode.DiagnosticCollection | undefined;
+    private problems = new Map<string, Problem[]>();
+    // Compile errors from each benchmark's latest run, by pinKey; their package's are all of them
+    private buildErrors = new Map<string, BuildError[]>();
 
-        if (element instanceof ModuleItem) {
-            return undefined; // Module is at root level
+    setDiagnostics(diagnostics: vscode.DiagnosticCollection): void {
+        this.diagnostics = diagnostics;
+    }
+
+    private escapeDiagnostics: vscode.DiagnosticCollection | undefined;
+    // The latest escape analysis findings, and inlining decisions, by file
+    private escapes = new Map<string, EscapeFinding[]>();
+    private inlining = new Map<string, InliningDecision[]>();
+
+    setEscapeDiagnostics(diagnostics: vscode.DiagnosticCollection): void {
+        this.escapeDiagnostics = diagnostics;
+    }
+
+    /**
+     * Runs escape analysis on the package of the benchmark or package, or
+     * of the file in the editor, and shows what escapes to the heap as
+     * diagnostics, with how much the results allocated there: why, and how
+     * much. Replaces the package's earlier findings; returns how many.
+     */
+    async showEscapeAnalysis(item: Item | undefined): Promise<number> {
+        const dir = item instanceof BenchmarkItem ? item.folderPath
+            : item instanceof PackageItem ? item.filePath
+                : vscode.window.activeTextEditor ? path.dirname(vscode.window.activeTextEditor.document.uri.fsPath)
+                    : undefined;
+        if (!dir) {
+            throw new Error('Select a package or benchmark, or open a Go file, for escape analysis.');
+        }
+        // Built as the benchmark's latest run was, or would be
+        const env = item instanceof BenchmarkItem ? item.env : goEnv();
+        const { go, flags } = item instanceof BenchmarkItem
+            ? item.build ?? { go: goCommand(), flags: item.defaultFlags() }
+            : { go: goCommand(), flags: item instanceof PackageItem && this.benchmarkItemsBeneath(item).length > 0 ? this.defaultFlags(item) : [] };
+        const { escapes: findings, inlining } = await escapeAnalysis(go, dir, splitFlags(flags).buildFlags, env, this.abortSignal());
+
+        const byFile = new Map<string, vscode.Diagnostic[]>();
+        for (const finding of findings) {
+            let message = finding.message;
+            const [top] = this.allocationsAt(finding.file, finding.line);
+            if (top) {
+                const { sampleTypes, flat } = top.allocation.allocationData;
+                const index = sampleTypes.findIndex(st => st.type === 'alloc_space');
+                if (index >= 0) {
+                    message += `; ${formatValue(flat[index], 'bytes')} allocated here by ${top.benchmark.fullName}`;
+                }
+            }
+            const position = new vscode.Position(finding.line - 1, finding.column - 1);
+            const diagnostic = new vscode.Diagnostic(new vscode.Range(position, position), message, vscode.DiagnosticSeverity.Information);
+            diagnostic.source = 'escape analysis';
+            byFile.set(finding.file, [...byFile.get(finding.file) ?? [], diagnostic]);
         }
 
-        if (element instanceof PackageItem) {
-            return element.parent;
+        // Earlier findings in the package go, whether or not their files have any now
+        const earlier: vscode.Uri[] = [];
+        this.escapeDiagnostics?.forEach(uri => earlier.push(uri));
+        for (const uri of earlier.filter(uri => path.dirname(uri.fsPath) === path.resolve(dir))) {
+            this.escapeDiagnostics?.delete(uri);
+        }
+        for (const [file, diagnostics] of byFile) {
+            this.escapeDiagnostics?.set(vscode.Uri.file(file), diagnostics);
+        }
+        for (const file of [...this.escapes.keys()].filter(file => path.dirname(file) === path.resolve(dir))) {
+            this.escapes.delete(file);
         }
+        for (const finding of findings) {
+            this.escapes.set(finding.file, [...this.escapes.get(finding.file) ?? [], finding]);
+        }
+        for (const file of [...this.inlining.keys()].filter(file => path.dirname(file) === path.resolve(dir))) {
+            this.inlining.delete(file);
+        }
+        for (const decision of inlining) {
+            this.inlining.set(decision.file, [...this.inlining.get(decision.file) ?? [], decision]);
+        }
+        this.inliningNotes.clear();
+        return findings.length;
+    }
 
-        if (element instanceof BenchmarkItem) {
-            return element.parent;
+    /**
+     * Disassembles the function an allocation site's code is in, from the
+     * test binary of its benchmark, built with the run's toolchain and
+     * flags: the site's function, or the caller it was inlined into.
+     */
+    async disassembly(allocation: AllocationItem): Promise<string> {
+        const site = this.resultAllocations().find(s => s.allocation === allocation);
+        if (!site) {
+            throw new Error('Disassembly needs an allocation from a benchmark run, not an opened profile.');
         }
+        const { function: fn } = allocation.allocationData;
+        const [stack] = allocation.allocationData.stacks();
+        const frames = stack?.frames ?? [];
+        const at = frames.findIndex(frame => frame.fn.name === fn.name && frame.line === allocation.lineNumber);
+        const symbol = frames.slice(Math.max(0, at)).find(frame => !frame.inlined)?.fn.name ?? fn.name;
+
+        // TODO: the binary is rebuilt if the sources changed since the run
+        const { benchmark } = site;
+        const { go, flags } = benchmark.build ?? { go: goCommand(), flags: benchmark.defaultFlags() };
+        const binary = await testBinary(go, benchmark.folderPath, splitFlags(flags).buildFlags, benchmark.env, this.abortSignal());
+        return disassemble(go, binary, symbol, allocation.filePath, allocation.lineNumber, benchmark.env, this.abortSignal());
+    }
 
-        if (element instanceof AllocationItem) {
-            return undefined;
+    // The profile of a benchmark's results, as the tree shows them, for its flame graph
+    flameGraphSource(benchmark: BenchmarkItem): { profile: Profile; index: number; resolvePath: (file: string) => string } {
+        // TODO: a run with several -cpu values or experiments, which shows the first
+        const [site] = this.benchmarkAllocations(benchmark);
+        if (!site) {
+            throw new Error(`${benchmark.label} has no allocations to show. Run it first.`);
         }
+        const data = site.allocation.allocationData;
+        return { profile: data.source.profile, index: sampleIndex(data, this.allocationView), resolvePath: data.source.options.resolvePath };
+    }
 
-        return undefined;
+    /**
+     * Whether the calls at a line, to functions that allocated below it,
+     * were inlined, as the profile's frames say, with the compiler's reason
+     * for those that weren't, from escape analysis of the callee's package.
+     */
+    inliningAt(filePath: string, lineNumber: number): InliningNote[] {
+        const file = path.resolve(filePath);
+        let byLine = this.inliningNotes.get(file);
+        if (!byLine) {
+            byLine = this.fileInliningNotes(file);
+            this.inliningNotes.set(file, byLine);
+        }
+        return [...(byLine.get(lineNumber)?.values() ?? [])];
     }
 
-    async getChildren(element?: Item): Promise<Item[]> {
-        if (!element) {
-            // If not loaded, start loading
-            if (!this.loadingPromise) {
-                // Start loading in the background and store the promise
-                this.loadingPromise = this.loadModules().catch(error => {
-                    console.error('Error loading packages:', error);
+    // By file, then line, then callee, the notes of inliningAt, until the results or escape analysis change
+    private inliningNotes = new Map<string, Map<number, Map<string, InliningNote>>>();
+
+    private fileInliningNotes(file: string): Map<number, Map<string, InliningNote>> {
+        const byLine = new Map<number, Map<string, InliningNote>>();
+        for (const { allocation } of this.currentAllocations()) {
+            if (path.resolve(allocation.filePath) !== file) {
+                continue;
+            }
+            const lineNumber = allocation.lineNumber;
+            const notes = byLine.get(lineNumber) ?? new Map<string, InliningNote>();
+            byLine.set(lineNumber, notes);
+            const { resolvePath } = allocation.allocationData.source.options;
+            for (const { frames } of allocation.allocationData.stacks()) {
+                frames.forEach((frame, i) => {
+                    if (i === 0 || frame.line !== lineNumber || path.resolve(resolvePath(frame.fn.filename)) !== file) {
+                        return;
+                    }
+                    // A frame is inlined into the one after it, its caller
+                    const callee = frames[i - 1];
+                    if (notes.has(callee.fn.name)) {
+                        return;
+                    }
+                    const decision = callee.inlined ? undefined : this.inlining.get(path.resolve(resolvePath(callee.fn.filename)))
+                        ?.find(d => d.kind === 'notInlinable' && d.line === callee.fn.startLine);
+                    notes.set(callee.fn.name, { callee: shortFunctionName(callee.fn.name), inlined: callee.inlined, reason: decision?.reason });
                 });
             }
+        }
+        return byLine;
+    }
 
-            // Always include instructional text at the top
-            const instruction = new InformationItem(
-                'Click a benchmark below to discover allocations'
-            );
-
-            // Return currently discovered modules immediately (even if loading is still in progress)
-            const moduleItems = this.modules.map(module => new ModuleItem(module.name, module.path));
+    // What escapes to the heap at a line, from the latest escape analysis of its package
+    escapesAt(filePath: string, lineNumber: number): EscapeFinding[] {
+        return (this.escapes.get(path.resolve(filePath)) ?? []).filter(finding => finding.line === lineNumber);
+    }
 
-            return [instruction, ...moduleItems];
+    /**
+     * Records the problems of the benchmark's latest run, replacing earlier
+     * ones, and shows a failed build under its package too.
+     */
+    private reportProblems(item: BenchmarkItem): void {
+        const key = pinKey(item);
+        if (item.problems.length > 0) {
+            this.problems.set(key, item.problems);
+        } else {
+            this.problems.delete(key);
         }
 
-        if (element instanceof ModuleItem) {
-            return element.getChildren(this.modules);
+        // Several benchmarks report the same compile error, show it once
+        const byFile = new Map<string, Map<string, vscode.Diagnostic>>();
+        for (const problem of [...this.problems.values()].flat()) {
+            const position = new vscode.Position(problem.line - 1, problem.column - 1);
+            const diagnostic = new vscode.Diagnostic(
+                new vscode.Range(position, position),
+                problem.message,
+                problem.severity === 'warning' ? vscode.DiagnosticSeverity.Warning : vscode.DiagnosticSeverity.Error
+            );
+            diagnostic.source = problem.source;
+            const diagnostics = byFile.get(problem.file) ?? new Map<string, vscode.Diagnostic>();
+            diagnostics.set(`${problem.line}:${problem.column}:${problem.message}`, diagnostic);
+            byFile.set(problem.file, diagnostics);
         }
-
-        if (element instanceof PackageItem) {
-            return element.getChildren(this.modules, this.benchmarkItems);
+        this.diagnostics?.clear();
+        for (const [file, diagnostics] of byFile) {
+            this.diagnostics?.set(vscode.Uri.file(file), [...diagnostics.values()]);
         }
 
-        if (element instanceof BenchmarkItem) {
-            return await element.getChildren(this.abortSignal());
+        if (item.buildErrors?.length) {
+            this.buildErrors.set(key, item.buildErrors);
+        } else {
+            this.buildErrors.delete(key);
         }
 
-        return Promise.resolve([]);
+        // The cache is the source of truth for the package's build errors; the package shows them first.
+        // Benchmarks with other build tags build differently, so one's run doesn't clear another's errors.
+        const pkg = this.modules.flatMap(m => m.packages).find(p => p.path === item.folderPath);
+        if (pkg) {
+            const folder = `${path.resolve(item.folderPath)}\n`;
+            const errors = new Map<string, BuildError>();
+            for (const [k, buildErrors] of this.buildErrors) {
+                if (k.startsWith(folder)) {
+                    buildErrors.forEach(e => errors.set(`${e.file}:${e.line}:${e.column}:${e.message}`, e));
+                }
+            }
+            const changed = (pkg.buildErrors?.length ?? 0) > 0 || errors.size > 0;
+            pkg.buildErrors = errors.size > 0 ? [...errors.values()] : undefined;
+            const packageItem = this.packageItems.get(pkg.path);
+            if (changed && packageItem) {
+                this._onDidChangeTreeData.fire(packageItem);
+            }
+        }
     }
 
-    private async loadModules(): Promise<void> {
-        const signal = this.abortSignal();
+    private treeView: vscode.TreeView<Item> | undefined;
 
-        if (!vscode.workspace.workspaceFolders) {
-            this._onDidChangeTreeData.fire();
-            return;
-        }
+    // Runs from the queue are revealed, to show their progress
+    setTreeView(treeView: vscode.TreeView<Item>): void {
+        this.treeView = treeView;
+    }
 
-        try {
-            console.log('Using workspace symbol search for benchmark discovery');
+    // Runs waiting for a turn, in order. At most runLimit run at once.
+    private queue: QueuedRun[] = [];
+    private activeRuns = 0;
 
-            // Get all benchmark symbols once for the entire workspace
-            console.log('Searching for benchmark functions via workspace symbols...');
-            let allBenchmarkSymbols: vscode.SymbolInformation[] = [];
+    private runLimit(): number {
+        const config = vscode.workspace.getConfiguration('goAllocations');
+        return Math.max(1, Math.floor(config.get<number>('concurrency', 1)));
+    }
 
-            try {
-                // Search for all symbols containing "Benchmark" across the workspace
-                const workspaceSymbols: vscode.SymbolInformation[] = await vscode.commands.executeCommand(
-                    'vscode.executeWorkspaceSymbolProvider',
-                    'Benchmark'
-                );
-
-                allBenchmarkSymbols = workspaceSymbols.filter(symbol =>
-                    symbol.kind === vscode.SymbolKind.Function &&
-                    symbol.location.uri.fsPath.endsWith('_test.go') &&
-                    this.benchmarkNameRegex.test(symbol.name)
-                );
-            } catch (error) {
-                console.warn('Workspace symbol search failed:', error);
-            }
+    /**
+     * Queues a run of the benchmark, resolving when the run finishes or is
+     * removed from the queue. A benchmark already queued keeps its place.
+     */
+    enqueue(item: BenchmarkItem, overrides?: RunOverrides): Promise<void> {
+        const queued = this.queue.find(run => run.item === item);
+        if (queued) {
+            queued.overrides = overrides ?? queued.overrides;
+            return queued.finished;
+        }
 
-            console.log(`Found ${allBenchmarkSymbols.length} benchmark functions total`);
+        let done!: () => void;
+        const finished = new Promise<void>(resolve => done = resolve);
+        this.queue.push({ item, overrides, done, finished });
+        this.pump();
+        return finished;
+    }
 
-            // Process each workspace folder with the filtered symbols
-            for (const workspaceFolder of vscode.workspace.workspaceFolders) {
-                if (signal.aborted) {
-                    throw new Error('Operation cancelled');
-                }
+    cancelQueued(item: BenchmarkItem): void {
+        const index = this.queue.findIndex(run => run.item === item);
+        if (index < 0) {
+            return; // Already started, or never queued
+        }
+        const [run] = this.queue.splice(index, 1);
+        item.setQueuePosition(undefined);
+        this._onDidChangeTreeData.fire(item);
+        run.done();
+        this.updateQueuePositions();
+    }
 
-                try {
-                    await this.loadModulesInWorkspace(workspaceFolder, allBenchmarkSymbols);
-                } catch (error) {
-                    if (signal.aborted) {
-                        throw error;
-                    }
-                    console.error('Error processing workspace folder:', error);
-                    throw error; // Don't silently continue if gopls fails
-                }
-            }
+    // Moves a queued run earlier (negative) or later (positive) in the queue
+    moveQueued(item: BenchmarkItem, offset: number): void {
+        const index = this.queue.findIndex(run => run.item === item);
+        if (index < 0) {
+            return;
+        }
+        const target = Math.max(0, Math.min(this.queue.length - 1, index + offset));
+        const [run] = this.queue.splice(index, 1);
+        this.queue.splice(target, 0, run);
+        this.updateQueuePositions();
+    }
 
-            console.log('Discovery completed using workspace symbols');
-        } catch (error) {
-            if (signal.aborted) {
-                console.log('Package loading cancelled');
-                throw error;
-            }
-        } finally {
-            this._onDidChangeTreeData.fire();
+    // Starts queued runs while there are free slots
+    private pump(): void {
+        while (this.activeRuns < this.runLimit() && this.queue.length > 0) {
+            const run = this.queue.shift()!;
+            run.item.nextRun = run.overrides;
+            run.item.setQueuePosition(undefined);
+            this.start(run.item).catch(error => console.error('Benchmark error:', error)).finally(run.done);
         }
+        this.updateQueuePositions();
     }
 
-    private readonly benchmarkNameRegex = /^Benchmark[A-Z_]/;
-    private async loadModulesInWorkspace(
-        workspaceFolder: vscode.WorkspaceFolder,
-        allBenchmarkSymbols: vscode.SymbolInformation[]
-    ): Promise<void> {
-        const signal = this.abortSignal();
+    /**
+     * Runs the dequeued item, holding a slot until it's done. It's revealed,
+     * expanded, to show its progress; the run doesn't depend on that.
+     */
+    private async start(item: BenchmarkItem): Promise<void> {
+        this.activeRuns++;
+        this.previousResults.delete(pinKey(item));
+        item.results = undefined;
+        item.setBaselineDelta(this.baselineDelta(item));
+        item.warmup = this.warmupFor(item);
+
+        // Edits during the run may or may not be in what it built
+        const startedAt = Date.now();
+        const versions = this.documentVersions();
+
+        // Results stream in as each run completes
+        const results = item.getChildren(this.abortSignal(), progress => {
+            item.progress = progress;
+            this._onDidChangeTreeData.fire(item);
+        });
+        this.runningItems.set(item, results);
+        this.updateRunningContext();
+        this._onDidChangeTreeData.fire(item);
+        this.treeView?.reveal(item, { expand: true }).then(undefined, error => {
+            console.error('Could not reveal benchmark:', error);
+        });
 
+        const description = item.description;
         try {
-            if (signal.aborted) {
-                throw new Error('Operation cancelled');
+            item.results = await results;
+            this.showBenchmarkState(item);
+            await this.markChangedSince(this.indexResultFiles(item), startedAt, versions);
+            item.finishedAt = Date.now();
+            this._onDidFinishRun.fire(item);
+            item.problems.push(...this.regressions(item));
+            this.reportProblems(item);
+            saveResult(this.workspaceState, this.storageDir, pinKey(item), item.result, item.resultProfiles).catch(error => {
+                console.error('Could not save results:', error);
+            });
+            item.resultProfiles = [];
+            this.addRecent(`${item.fullName} at ${new Date().toLocaleTimeString()}`, item.results);
+            // The run may change badges, such as race, and progress needs replacing
+            if (item.description !== description || item.progress) {
+                this._onDidChangeTreeData.fire(item);
+            }
+        } finally {
+            item.progress = undefined;
+            this.runningItems.delete(item);
+            if (!this.cancelledRuns.delete(item)) {
+                this.batchDone++;
             }
+            this.updateRunningContext();
+            this.activeRuns--;
+            this.pump();
+        }
+    }
 
-            const rootPath = workspaceFolder.uri.fsPath;
+    private updateQueuePositions(): void {
+        this.queue.forEach((run, i) => {
+            if (run.item.queuePosition !== i + 1) {
+                run.item.setQueuePosition(i + 1);
+                this._onDidChangeTreeData.fire(run.item);
+            }
+        });
+        this.updateProgress();
+    }
 
-            // Get the module name for this workspace (still need go list for this)
-            const { stdout: moduleName } = await execAsync('go list -m', {
-                cwd: rootPath,
-                signal: signal
-            });
+    /**
+     * Shows the benchmark's results from the last session, if it has any
+     * and hasn't run since; returns whether it did.
+     */
+    private async restorePrevious(item: BenchmarkItem): Promise<boolean> {
+        const previous = this.previousResults.get(pinKey(item));
+        this.previousResults.delete(pinKey(item));
+        if (!previous || !this.storageDir) {
+            return false;
+        }
+        try {
+            const profiles = await savedProfiles(this.workspaceState, this.storageDir, pinKey(item));
+            item.results = await item.restore(previous, profiles, this.abortSignal());
+            this.showBenchmarkState(item);
+            // Files edited since the saved run make it stale, as edits during a session do
+            await this.markChangedSince(this.indexResultFiles(item), Date.parse(previous.time), new Map());
+            item.finishedAt = Date.parse(previous.time);
+            // For the description, which says where the results are from
+            this._onDidChangeTreeData.fire(item);
+            this._onDidFinishRun.fire(item);
+            return true;
+        } catch (error) {
+            console.error('Could not restore results:', error);
+            return false;
+        }
+    }
 
-            if (!moduleName.trim() || moduleName.trim() === 'command-line-arguments') {
-                return; // Skip if not a valid module
+    /**
+     * Restores every benchmark's results from the last session that isn't
+     * shown yet, so questions about the source cover them too.
+     */
+    async restoreSavedResults(): Promise<void> {
+        for (const key of [...this.previousResults.keys()]) {
+            const [folder, fullName] = key.split('\n');
+            // TODO: sub-benchmarks, which the tree makes as their parent runs
+            const item = fullName.includes('/') ? undefined : this.lookupBenchmarkItem(folder, fullName);
+            if (item && !item.results && !item.running) {
+                await this.restorePrevious(item);
             }
+        }
+    }
 
-            // Create module entry (each workspace folder should have a unique module)
-            const module: ModuleCache = {
-                name: moduleName.trim(),
-                path: rootPath,
-                packages: []
-            };
-            this.modules.push(module);
-
-            // Filter benchmark symbols for this workspace folder
-            if (signal.aborted) {
-                throw new Error('Operation cancelled');
+    /**
+     * Runs the benchmark for getChildren, when it has a slot. Expanded by
+     * hand while all slots are busy, it joins the queue instead.
+     */
+    private async runBenchmarkChildren(item: BenchmarkItem): Promise<BenchmarkChildItem[]> {
+        // Re-rendered while queued, running, or after; none of them a new run
+        const shown = (): BenchmarkChildItem[] | Promise<BenchmarkChildItem[]> | undefined => {
+            if (item.queuePosition !== undefined) {
+                return [new InformationItem('Queued, waiting for other runs to finish', 'clock')];
             }
+            const running = this.runningItems.get(item);
+            return running ? item.progress ?? running : item.results;
+        };
+        const children = shown();
+        if (children) {
+            return children;
+        }
 
-            const benchmarkSymbols = allBenchmarkSymbols.filter(symbol =>
-                symbol.location.uri.fsPath.startsWith(rootPath)
-            );
+        // Expanded without a run asked for, show the last session's results, if any
+        if (await this.restorePrevious(item) && item.results) {
+            return item.results;
+        }
 
-            console.log(`Found ${benchmarkSymbols.length} benchmark functions in ${workspaceFolder.name}`);
+        // Expanded by hand, that's a run too, which starts now if there's a slot
+        if (!shown()) {
+            this.lastRun = { items: [item], overrides: {}, pinned: new Map() };
+            this.runLast([item]).catch(error => console.error('Benchmark error:', error));
+        }
+        return shown() ?? [];
+    }
 
-            // Group benchmarks by package directory
-            const packageMap = new Map<string, PackageCache>();
+    async findBenchmark(packagePath: string, benchmarkName: string): Promise<BenchmarkItem> {
+        await this.ensureLoaded();
+        let benchmarkItem = this.lookupBenchmarkItem(packagePath, benchmarkName);
 
-            for (const symbol of benchmarkSymbols) {
-                if (signal.aborted) {
-                    throw new Error('Operation cancelled');
-                }
+        // Retry once after 500ms if not found (workspace symbol index may need time to warm up)
+        // This retry is hiding an await problem that I haven't figured out.
+        if (!benchmarkItem) {
+            await new Promise(resolve => setTimeout(resolve, 500));
+            benchmarkItem = this.lookupBenchmarkItem(packagePath, benchmarkName);
+        }
 
-                const packageDir = path.dirname(symbol.location.uri.fsPath);
-                const packageName = await this.getPackageNameFromPath(packageDir, rootPath);
+        if (!benchmarkItem) {
+            throw new Error(`Benchmark ${benchmarkName} not found in ${packagePath}, perhaps wait until all packages are loaded and click again.`);
+        }
+        return benchmarkItem;
+    }
 
-                if (!packageMap.has(packageDir)) {
-                    packageMap.set(packageDir, {
-                        name: packageName,
-                        path: packageDir,
-                        benchmarks: []
-                    });
-                }
+    private moduleItem(module: ModuleCache): ModuleItem {
+        // A lone module has nothing to be lazy about, nor does a single file's worth
+        const state = this.modules.length === 1 || this.currentFileScope
+            ? vscode.TreeItemCollapsibleState.Expanded
+            : vscode.TreeItemCollapsibleState.Collapsed;
+        const item = new ModuleItem(module.name, module.path, module.goWork, state);
+
+        // In a multi-root workspace, show which root the module belongs to
+        const folders = vscode.workspace.workspaceFolders ?? [];
+        if (folders.length > 1) {
+            item.description = vscode.workspace.getWorkspaceFolder(vscode.Uri.file(module.path))?.name;
+        }
+        return item;
+    }
 
-                packageMap.get(packageDir)!.benchmarks.push({
-                    name: symbol.name,
-                    location: new vscode.Location(symbol.location.uri, symbol.location.range)
-                });
-            }
+    /**
+     * Gets the BenchmarkItem for a benchmark in the module cache. Packages are
+     * lazy, so the item may not exist yet if its package was never expanded;
+     * in that case, create it, along with its ancestors. TreeView.reveal
+     * will expand them.
+     */
+    private benchmarkItem(module: ModuleCache, pkg: PackageCache, benchmark: BenchmarkCache): BenchmarkItem {
+        const existing = this.benchmarkItems.find(pkg.path, benchmark.name);
+        if (existing) {
+            return existing;
+        }
 
-            // Add packages with benchmarks to the module
-            for (const pkg of packageMap.values()) {
-                if (pkg.benchmarks.length > 0) {
-                    module.packages.push(pkg);
-                    console.log(`Added package ${pkg.name} with ${pkg.benchmarks.length} benchmarks`);
+        const packageItem = this.packageItems.get(pkg.path)
+            ?? new PackageItem(getPackageLabel(pkg), pkg.path, this.moduleItem(module));
+        const item = new BenchmarkItem(benchmark, packageItem);
+        this.benchmarkItems.add(item);
+        return item;
+    }
 
-                    // Fire update immediately for responsive UI
-                    this._onDidChangeTreeData.fire();
+    private allBenchmarkItems(): BenchmarkItem[] {
+        const items: BenchmarkItem[] = [];
+        for (const module of this.modules) {
+            for (const pkg of module.packages) {
+                for (const benchmark of pkg.benchmarks) {
+                    items.push(this.benchmarkItem(module, pkg, benchmark));
                 }
             }
-        } catch (error) {
-            if (signal.aborted) {
-                console.log('Gopls package discovery cancelled');
-                throw error;
-            }
-            console.error('Gopls discovery failed:', error);
-            throw error; // Let the caller handle the error
         }
+        return items;
     }
 
-    private async getPackageNameFromPath(packageDir: string, rootPath: string): Promise<string> {
-        const relativePath = path.relative(rootPath, packageDir);
-        if (relativePath === '') {
-            try {
-                const { stdout } = await execAsync('go list -f "{{.Name}}" .', { cwd: packageDir });
-                return stdout.trim();
-            } catch {
-                return relativePath;
+    private packageBenchmarkItems(packageItem: PackageItem): BenchmarkItem[] {
+        for (const module of this.modules) {
+            const pkg = module.packages.find(p => p.path === packageItem.filePath);
+            if (pkg) {
+                return pkg.benchmarks.map(benchmark => this.benchmarkItem(module, pkg, benchmark));
             }
         }
+        throw new Error(`Package ${packageItem.filePath} not found in cache`);
+    }
+
+    // Benchmarks to re-run on save in watch mode, saved for the workspace
+    private pinned: Set<string>;
 
-        return relativePath.replaceAll('\\', '/');
+    togglePin(item: BenchmarkItem): void {
+        const key = pinKey(item);
+        if (!this.pinned.delete(key)) {
+            this.pinned.add(key);
+        }
+        item.setPinned(this.pinned.has(key));
+        this.workspaceState.update(pinnedKey, [...this.pinned]).then(undefined, error => {
+            console.warn('Could not save pinned benchmarks:', error);
+        });
+        this._onDidChangeTreeData.fire(item);
     }
 
-    /**
-     * Discovers all benchmarks, and runs them with semaphore control.
-     * Relies on TreeView.reveal to trigger getChildren automatically.
-     */
-    async runAllBenchmarks(treeView: vscode.TreeView<Item>): Promise<void> {
-        const signal = this.abortSignal();
+    // Whether the benchmark warms up: its own choice, or else the setting
+    private warmupFor(item: BenchmarkItem): boolean {
+        const choices = this.workspaceState.get<Record<string, boolean>>(warmupKey, {});
+        return choices[pinKey(item)] ?? vscode.workspace.getConfiguration('goAllocations').get<boolean>('warmup', false);
+    }
 
-        // Get concurrency setting from configuration
-        const config = vscode.workspace.getConfiguration('goAllocations');
-        const concurrency = Math.max(1, Math.floor(config.get<number>('concurrency', 2)));
+    toggleWarmup(item: BenchmarkItem): void {
+        const choices = { ...this.workspaceState.get<Record<string, boolean>>(warmupKey, {}) };
+        item.warmup = !this.warmupFor(item);
+        choices[pinKey(item)] = item.warmup;
+        this.workspaceState.update(warmupKey, choices).then(undefined, error => {
+            console.warn('Could not save warmup choices:', error);
+        });
+        vscode.window.showInformationMessage(
+            `${item.fullName} will ${item.warmup ? 'warm up' : 'not warm up'} before each run`
+        );
+    }
 
-        const sema = new Sema(concurrency);
-        const promises: Promise<void>[] = [];
+    // In watch mode, saving a file in a package re-runs its pinned benchmarks
+    private watching = false;
 
-        try {
-            for (const benchmarkItem of this.benchmarkItems.values()) {
-                if (signal.aborted) {
-                    return;
-                }
+    setWatching(watching: boolean): void {
+        this.watching = watching;
+    }
 
-                const p = (async () => {
-                    await sema.acquire();
-                    try {
-                        if (signal.aborted) {
-                            return;
-                        }
-
-                        this.clearBenchmarkRunState(benchmarkItem);
-                        await treeView.reveal(benchmarkItem, { expand: true });
-                    } catch (error: any) {
-                        if (signal.aborted) {
-                            console.log('Benchmark cancelled:', benchmarkItem.label);
-                        } else {
-                            console.error('Benchmark error:', error);
-                        }
-                    } finally {
-                        sema.release();
-                    }
-                })();
+    async runPinned(uri: vscode.Uri): Promise<void> {
+        if (!this.watching) {
+            return;
+        }
 
-                promises.push(p);
+        // TODO: also re-run pinned benchmarks in packages that import the saved one
+        const packageDir = path.resolve(path.dirname(uri.fsPath));
+        const items: BenchmarkItem[] = [];
+        for (const key of this.pinned) {
+            const [dir, fullName] = key.split('\n');
+            if (dir !== packageDir) {
+                continue;
             }
-
-            await Promise.all(promises);
-            await sema.drain();
-        } catch (error) {
-            if (signal.aborted) {
-                console.log('Operation cancelled');
-                throw error;
+            const [name, subName] = fullName.split('/');
+            const item = this.lookupBenchmarkItem(dir, name);
+            if (!subName) {
+                if (item) {
+                    items.push(item);
+                }
+                continue;
+            }
+            // Sub-benchmark items only exist after their parent ran
+            // TODO: run the parent when the sub-benchmark item doesn't exist yet
+            const sub = item?.results?.find((child): child is BenchmarkItem =>
+                child instanceof BenchmarkItem && child.fullName === fullName);
+            if (sub) {
+                items.push(sub);
             }
-            console.error('Error running all benchmarks:', error);
-            throw error;
         }
+        await this.runBenchmarks(items);
     }
 
-    async findBenchmark(packagePath: string, benchmarkName: string): Promise<BenchmarkItem> {
-        await this.ensureLoaded();
-        let benchmarkItem = this.benchmarkItems.find(packagePath, benchmarkName);
+    /**
+     * The benchmark's latest results, for its CodeLens, e.g. 128 B/op ·
+     * 3 allocs/op · 2m ago. Undefined if it hasn't run.
+     */
+    lastResult(packagePath: string, benchmarkName: string): string | undefined {
+        const item = this.lookupBenchmarkItem(packagePath, benchmarkName);
+        if (!item?.results || item.finishedAt === undefined) {
+            return undefined;
+        }
+        const stats = item.results
+            .filter((child): child is StatsItem => child instanceof StatsItem && ['B/op', 'allocs/op'].includes(child.unit))
+            .map(child => `${formatStat(child.stats.median)} ${child.unit}`);
+        return [...stats, formatAgo(Date.now() - item.finishedAt)].join(' · ');
+    }
 
-        // Retry once after 500ms if not found (workspace symbol index may need time to warm up)
-        // This retry is hiding an await problem that I haven't figured out.
-        if (!benchmarkItem) {
-            await new Promise(resolve => setTimeout(resolve, 500));
-            benchmarkItem = this.benchmarkItems.find(packagePath, benchmarkName);
+    // The benchmark's latest results in a line, for the status bar, e.g. 128 B/op · 3 allocs/op · vs baseline +12% B/op
+    headline(item: BenchmarkItem): string | undefined {
+        if (!item.results) {
+            return undefined;
         }
+        const stats = item.results
+            .filter((child): child is StatsItem => child instanceof StatsItem && ['B/op', 'allocs/op'].includes(child.unit))
+            .map(child => `${formatStat(child.stats.median)} ${child.unit}`);
+        // Without numbers to compare, the delta only says when the baseline is from
+        const delta = this.baselineDelta(item);
+        if (delta && !delta.startsWith('from ')) {
+            stats.push(`vs baseline ${delta}`);
+        }
+        return stats.join(' · ');
+    }
 
-        if (!benchmarkItem) {
-            throw new Error(`Benchmark ${benchmarkName} not found in ${packagePath}, perhaps wait until all packages are loaded and click again.`);
+    // The median allocs/op of the benchmark's latest run, if it has one
+    allocsPerOp(item: BenchmarkItem): number | undefined {
+        const stats = item.results?.find((child): child is StatsItem => child instanceof StatsItem && child.unit === 'allocs/op');
+        return stats?.stats.median;
+    }
+
+    private lookupBenchmarkItem(packagePath: string, benchmarkName: string): BenchmarkItem | undefined {
+        const p = path.resolve(packagePath);
+        for (const module of this.modules) {
+            const pkg = module.packages.find(pkg => path.resolve(pkg.path) === p);
+            const benchmark = pkg?.benchmarks.find(b => b.name === benchmarkName);
+            if (pkg && benchmark) {
+                return this.benchmarkItem(module, pkg, benchmark);
+            }
         }
-        return benchmarkItem;
+        return undefined;
     }
 
     private async ensureLoaded(): Promise<void> {
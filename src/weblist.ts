@@ -0,0 +1,89 @@
+import * as vscode from 'vscode';
+import * as fs from 'fs';
+import { Profile, ValueType, lineTotals, formatValue } from './profile';
+
+// The sample types weblist shows, when the profile has them
+const shownTypes = ['alloc_space', 'alloc_objects'];
+
+// For text in webviews' HTML, attribute values included
+export const escapeHtml = (s: string): string =>
+    s.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+
+// A function's source lines, from its declaration to its closing brace, as gofmt leaves it
+const functionLines = (file: string, startLine: number): string[] => {
+    if (!fs.existsSync(file)) {
+        throw new Error(`${file} not found. A dependency's source may need go mod download.`);
+    }
+    const lines = fs.readFileSync(file, 'utf8').split('\n');
+    const end = lines.findIndex((line, i) => i >= startLine - 1 && line.trimEnd() === '}');
+    return lines.slice(startLine - 1, end < 0 ? lines.length : end + 1);
+}
+
+/**
+ * The HTML of a function's source with what each line allocated, flat and
+ * cumulative, in columns before it, as pprof weblist shows it. Line
+ * numbers link to the line in the editor.
+ */
+const weblistHtml = (title: string, file: string, startLine: number, sampleTypes: ValueType[], lines: Map<number, { flat: number[]; cum: number[] }>): string => {
+    const shown = sampleTypes.filter(st => shownTypes.includes(st.type));
+    const columns = (shown.length > 0 ? shown : sampleTypes).map(st => ({ ...st, index: sampleTypes.indexOf(st) }));
+    const cell = (value: number | undefined, unit: string) => `<td class="n">${value ? escapeHtml(formatValue(value, unit)) : '.'}</td>`;
+
+    const rows = functionLines(file, startLine).map((text, i) => {
+        const line = startLine + i;
+        const values = lines.get(line);
+        const args = encodeURIComponent(JSON.stringify([vscode.Uri.file(file), { selection: { start: { line: line - 1, character: 0 }, end: { line: line - 1, character: 0 } } }]));
+        return `<tr${values ? ' class="hot"' : ''}>${columns.map(c => cell(values?.flat[c.index], c.unit) + cell(values?.cum[c.index], c.unit)).join('')}`
+            + `<td class="n"><a href="command:vscode.open?${args}">${line}</a></td><td class="src">${escapeHtml(text)}</td></tr>`;
+    });
+    const header = columns.map(c => `<th>flat ${escapeHtml(c.type)}</th><th>cum ${escapeHtml(c.type)}</th>`).join('');
+
+    return `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="Content-Security-Policy" content="default-src 'none'; style-src 'unsafe-inline';">
+<style>
+    body { font-family: var(--vscode-editor-font-family); font-size: var(--vscode-editor-font-size); }
+    table { border-collapse: collapse; }
+    th { text-align: right; font-weight: normal; color: var(--vscode-descriptionForeground); padding: 0 1em 0.5em 0; }
+    td { padding: 0 1em 0 0; white-space: pre; }
+    td.n { text-align: right; color: var(--vscode-descriptionForeground); }
+    tr.hot td { color: var(--vscode-editor-foreground); }
+    tr.hot td.src { background: var(--vscode-diffEditor-removedLineBackground); }
+    a { color: inherit; text-decoration: none; }
+</style>
+</head>
+<body>
+<h3>${escapeHtml(title)}</h3>
+<table>
+<tr>${header}<th></th><th></th></tr>
+${rows.join('\n')}
+</table>
+</body>
+</html>`;
+}
+
+/**
+ * Opens a weblist of the function, as pprof -weblist shows one: its source
+ * with what each line allocated in the profile, beside the editor.
+ */
+export const showWeblist = (profile: Profile, functionName: string, file: string, startLine: number): void => {
+    // Each line sums its columns, as weblist does
+    const lines = new Map<number, { flat: number[]; cum: number[] }>();
+    for (const total of lineTotals(profile, fn => fn.name === functionName)) {
+        const line = lines.get(total.line) ?? { flat: total.flat.map(() => 0), cum: total.cum.map(() => 0) };
+        total.flat.forEach((v, i) => line.flat[i] += v);
+        total.cum.forEach((v, i) => line.cum[i] += v);
+        lines.set(total.line, line);
+    }
+
+    const short = functionName.slice(functionName.lastIndexOf('/') + 1);
+    const panel = vscode.window.createWebviewPanel(
+        'goAllocations.weblist',
+        `Weblist: ${short}`,
+        { viewColumn: vscode.ViewColumn.Beside, preserveFocus: true },
+        { enableCommandUris: ['vscode.open'] }
+    );
+    panel.webview.html = weblistHtml(functionName, file, startLine, profile.sampleTypes, lines);
+}